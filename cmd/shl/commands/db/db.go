@@ -0,0 +1,18 @@
+package db
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// DbCmd performs maintenance operations on the database of a stopped node
+var DbCmd = &cobra.Command{
+	Use:              "db",
+	Short:            "Maintain the Ethereum database",
+	TraverseChildren: true,
+}
+
+func init() {
+	//Subcommands
+	DbCmd.AddCommand(
+		NewPruneCmd())
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/abassian/shuffle/src/config"
+	"github.com/abassian/shuffle/src/database"
+	"github.com/abassian/shuffle/src/state"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	dbFile    = config.DefaultEthConfig().DbFile
+	dbBackend = config.DefaultEthConfig().DbBackend
+	cache     = config.DefaultEthConfig().Cache
+	retention = config.DefaultEthConfig().Retention
+	logLevel  = "info"
+)
+
+// AddPruneFlags adds flags to the Prune command
+func AddPruneFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&dbFile, "db", dbFile, "Eth database file")
+	cmd.Flags().StringVar(&dbBackend, "db-backend", dbBackend, "Eth database backend: leveldb or bolt")
+	cmd.Flags().IntVar(&cache, "cache", cache, "Megabytes of memory allocated to internal caching (min 16MB / database forced)")
+	cmd.Flags().Uint64Var(&retention, "retention", retention, "Number of recent block states to keep")
+	cmd.Flags().StringVar(&logLevel, "log", logLevel, "debug, info, warn, error, fatal, panic")
+	viper.BindPFlags(cmd.Flags())
+}
+
+// NewPruneCmd returns the command that prunes the state tries
+func NewPruneCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete the state of old blocks",
+		Long: `
+Delete the trie nodes and contract code that are not part of the state of the
+last blocks, as set by --retention. Blocks, transactions, and receipts are kept.
+
+The node must be stopped. Historical queries on older blocks are no longer
+possible afterwards, even in archive mode.`,
+		Args: cobra.NoArgs,
+		RunE: prune,
+	}
+
+	AddPruneFlags(cmd)
+
+	return cmd
+}
+
+func prune(cmd *cobra.Command, args []string) error {
+	if retention == 0 {
+		return fmt.Errorf("the state of at least one block must be retained")
+	}
+
+	level, err := logrus.ParseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	logger := logrus.New()
+	logger.Level = level
+
+	db, err := database.New(dbBackend, dbFile, cache)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deleted, err := state.Prune(db, retention, logger)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %d trie nodes and contracts\n", deleted)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package genesis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/abassian/shuffle/src/state"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	baseFile string
+	outFile  string
+)
+
+// AddFromDumpFlags adds flags to the FromDump command
+func AddFromDumpFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&baseFile, "genesis", baseFile, "Genesis file of the exported network, to copy the config, fees, and POA contract from")
+	cmd.Flags().StringVar(&outFile, "out", outFile, "Write the genesis to this file instead of the standard output")
+	viper.BindPFlags(cmd.Flags())
+}
+
+// NewFromDumpCmd returns the command that creates a genesis from a state dump
+func NewFromDumpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "from-dump [dump]",
+		Short: "Create a genesis file from a state dump",
+		Long: `
+Create a genesis file that starts a new network with the state exported by 'shl
+state dump', so that its history does not need to be replayed.
+
+Every account of the dump is created with its balance, nonce, code, and storage.
+The config and fees sections, as well as the address and ABI of the POA
+contract, are copied from the genesis file of the exported network, given with
+--genesis. The POA contract keeps its whitelist. The sections can be edited
+afterwards, for instance to change the chain ID.`,
+		Args: cobra.ExactArgs(1),
+		RunE: fromDump,
+	}
+
+	AddFromDumpFlags(cmd)
+
+	return cmd
+}
+
+func fromDump(cmd *cobra.Command, args []string) error {
+	var base bcommon.Genesis
+	if baseFile != "" {
+		contents, err := ioutil.ReadFile(baseFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(contents, &base); err != nil {
+			return fmt.Errorf("parsing %s: %v", baseFile, err)
+		}
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dump, err := state.ReadDump(f)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %v", args[0], err)
+	}
+
+	genesis := state.GenesisFromDump(dump, base)
+
+	js, err := json.MarshalIndent(genesis, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	if outFile == "" {
+		_, err = os.Stdout.Write(js)
+		return err
+	}
+	return ioutil.WriteFile(outFile, js, 0644)
+}
@@ -0,0 +1,18 @@
+package genesis
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// GenesisCmd creates genesis files
+var GenesisCmd = &cobra.Command{
+	Use:              "genesis",
+	Short:            "Create genesis files",
+	TraverseChildren: true,
+}
+
+func init() {
+	//Subcommands
+	GenesisCmd.AddCommand(
+		NewFromDumpCmd())
+}
@@ -0,0 +1,118 @@
+package raft
+
+import (
+	"net/url"
+
+	"github.com/abassian/shuffle/src/service"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	apiAddr    string
+	outputJSON bool
+)
+
+// RaftCmd manages the membership of a Raft cluster through the API of one of
+// its nodes
+var RaftCmd = &cobra.Command{
+	Use:              "raft",
+	Short:            "Manage the membership of a Raft cluster",
+	TraverseChildren: true,
+}
+
+func init() {
+	//Subcommands
+	RaftCmd.AddCommand(
+		NewServersCmd(),
+		NewAddVoterCmd(),
+		NewAddNonvoterCmd(),
+		NewRemoveServerCmd(),
+		NewTransferLeadershipCmd())
+
+	//Commonly used command line flags
+	RaftCmd.PersistentFlags().StringVar(&apiAddr, "api", "localhost:8080", "IP:PORT of the API service of any node in the cluster")
+	RaftCmd.PersistentFlags().BoolVar(&outputJSON, "json", false, "output JSON instead of human-readable format")
+	viper.BindPFlags(RaftCmd.Flags())
+}
+
+// NewServersCmd returns the command that lists the members of the cluster
+func NewServersCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "servers",
+		Short: "List the members of the cluster",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return request("GET", "/membership", nil)
+		},
+	}
+}
+
+// NewAddVoterCmd returns the command that adds a voting server to the cluster
+func NewAddVoterCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "add-voter [id] [address]",
+		Short: "Add a voting server to the cluster",
+		Long: `
+Add a voting server to the cluster. The server must have been started without a
+peers.json file, so that it waits to be added. The address is the IP:PORT of its
+Raft node.
+
+If the cluster checks the POA contract, the id must be an authorised Ethereum
+address.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return request("POST", "/membership/voter", &service.JsonServerArgs{
+				ID:      args[0],
+				Address: args[1],
+			})
+		},
+	}
+}
+
+// NewAddNonvoterCmd returns the command that adds a nonvoting server to the
+// cluster
+func NewAddNonvoterCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "add-nonvoter [id] [address]",
+		Short: "Add a server that replicates the log without voting",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return request("POST", "/membership/nonvoter", &service.JsonServerArgs{
+				ID:      args[0],
+				Address: args[1],
+			})
+		},
+	}
+}
+
+// NewRemoveServerCmd returns the command that removes a server from the cluster
+func NewRemoveServerCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove-server [id]",
+		Short: "Remove a server from the cluster",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return request("DELETE", "/membership/"+url.PathEscape(args[0]), nil)
+		},
+	}
+}
+
+// NewTransferLeadershipCmd returns the command that makes the leader step down
+func NewTransferLeadershipCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "transfer-leadership [id]",
+		Short: "Transfer the leadership to another server",
+		Long: `
+Make the leader step down in favour of the given server, or of the most
+up-to-date follower if no server is given.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var serverArgs *service.JsonServerArgs
+			if len(args) > 0 {
+				serverArgs = &service.JsonServerArgs{ID: args[0]}
+			}
+			return request("POST", "/membership/leader", serverArgs)
+		},
+	}
+}
@@ -0,0 +1,85 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abassian/shuffle/src/service"
+)
+
+// apiRequest is a call received by the fake API service
+type apiRequest struct {
+	method string
+	path   string
+	args   service.JsonServerArgs
+}
+
+func TestMembershipCommands(t *testing.T) {
+	var received []apiRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := apiRequest{method: r.Method, path: r.URL.EscapedPath()}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(body) > 0 {
+			if err := json.Unmarshal(body, &req.args); err != nil {
+				t.Fatal(err)
+			}
+		}
+		received = append(received, req)
+
+		if req.path == "/membership/unknown" {
+			http.Error(w, "unknown server unknown", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode([]service.JsonServer{{ID: "node1", Address: "127.0.0.1:1337", Suffrage: "Voter", Leader: true}})
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		args []string
+		want apiRequest
+	}{
+		{
+			[]string{"add-voter", "node2", "127.0.0.1:1338"},
+			apiRequest{"POST", "/membership/voter", service.JsonServerArgs{ID: "node2", Address: "127.0.0.1:1338"}},
+		},
+		{
+			[]string{"add-nonvoter", "node3", "127.0.0.1:1339"},
+			apiRequest{"POST", "/membership/nonvoter", service.JsonServerArgs{ID: "node3", Address: "127.0.0.1:1339"}},
+		},
+		{
+			[]string{"remove-server", "node/2"},
+			apiRequest{"DELETE", "/membership/node%2F2", service.JsonServerArgs{}},
+		},
+		{
+			[]string{"servers"},
+			apiRequest{"GET", "/membership", service.JsonServerArgs{}},
+		},
+	}
+
+	for _, c := range cases {
+		received = nil
+
+		RaftCmd.SetArgs(append([]string{"--api", server.URL}, c.args...))
+		if err := RaftCmd.Execute(); err != nil {
+			t.Fatalf("%v: %v", c.args, err)
+		}
+
+		if len(received) != 1 || received[0] != c.want {
+			t.Fatalf("%v should call %+v, got %+v", c.args, c.want, received)
+		}
+	}
+
+	// errors of the API service are reported
+	RaftCmd.SetArgs([]string{"--api", server.URL, "remove-server", "unknown"})
+	if err := RaftCmd.Execute(); err == nil {
+		t.Fatal("Removing an unknown server should fail")
+	}
+}
@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/abassian/shuffle/src/service"
+)
+
+var client = &http.Client{Timeout: 60 * time.Second}
+
+// request calls a membership endpoint of the API service and prints the
+// resulting list of servers.
+func request(method, path string, args *service.JsonServerArgs) error {
+	var body io.Reader
+	if args != nil {
+		data, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	addr := apiAddr
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+
+	req, err := http.NewRequest(method, addr+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var servers []service.JsonServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return fmt.Errorf("Error decoding response: %v", err)
+	}
+
+	printServers(servers)
+
+	return nil
+}
+
+func printServers(servers []service.JsonServer) {
+	if outputJSON {
+		data, err := json.MarshalIndent(servers, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to marshal JSON: %v\n", err)
+			return
+		}
+		fmt.Println(string(data))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tADDRESS\tSUFFRAGE\tLEADER")
+	for _, s := range servers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\n", s.ID, s.Address, s.Suffrage, s.Leader)
+	}
+	w.Flush()
+}
@@ -1,8 +1,12 @@
 package commands
 
 import (
+	"github.com/abassian/shuffle/cmd/shl/commands/db"
+	"github.com/abassian/shuffle/cmd/shl/commands/genesis"
 	"github.com/abassian/shuffle/cmd/shl/commands/keys"
+	"github.com/abassian/shuffle/cmd/shl/commands/raft"
 	"github.com/abassian/shuffle/cmd/shl/commands/run"
+	"github.com/abassian/shuffle/cmd/shl/commands/state"
 	"github.com/spf13/cobra"
 )
 
@@ -16,6 +20,10 @@ func init() {
 	RootCmd.AddCommand(
 		run.RunCmd,
 		keys.KeysCmd,
+		raft.RaftCmd,
+		db.DbCmd,
+		state.StateCmd,
+		genesis.GenesisCmd,
 		VersionCmd,
 	)
 	//do not print usage when error occurs
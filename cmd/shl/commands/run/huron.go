@@ -12,7 +12,7 @@ import (
 
 //AddHuronFlags adds flags to the Huron command
 func AddHuronFlags(cmd *cobra.Command) {
-	cmd.Flags().String("huron.datadir", config.Huron.DataDir, "Directory contaning priv_key.pem and peers.json files")
+	cmd.Flags().String("huron.datadir", config.Huron.DataDir, "Directory contaning priv_key and peers.json files")
 	cmd.Flags().String("huron.listen", config.Huron.BindAddr, "IP:PORT of Huron node")
 	cmd.Flags().String("huron.service-listen", config.Huron.ServiceAddr, "IP:PORT of Huron HTTP API service")
 	cmd.Flags().Duration("huron.heartbeat", config.Huron.Heartbeat, "Heartbeat time milliseconds (time between gossips)")
@@ -57,7 +57,5 @@ func runHuron(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Error building Engine: %s", err)
 	}
 
-	engine.Run()
-
-	return nil
+	return engine.Run()
 }
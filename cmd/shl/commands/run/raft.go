@@ -2,6 +2,7 @@ package run
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/abassian/shuffle/src/consensus/raft"
 	"github.com/abassian/shuffle/src/engine"
@@ -17,8 +18,20 @@ func AddRaftFlags(cmd *cobra.Command) {
 	cmd.Flags().String("raft.snapshot-dir", config.Raft.SnapshotDir, "Snapshot directory")
 	cmd.Flags().String("raft.node-addr", config.Raft.NodeAddr, "IP:PORT of Raft node")
 	cmd.Flags().String("raft.server-id", string(config.Raft.LocalID), "Unique ID of this server")
+	cmd.Flags().Bool("raft.store", config.Raft.Store, "Use persistent store")
+	cmd.Flags().Bool("raft.poa", config.Raft.POA, "Check new servers against the POA contract")
+	cmd.Flags().Duration("raft.apply-timeout", config.Raft.ApplyTimeout, "How long the leader waits for Raft to accept a transaction")
+	cmd.Flags().Duration("raft.snapshot-interval", config.Raft.SnapshotInterval, "How often to check if a snapshot should be taken")
+	cmd.Flags().Uint64("raft.snapshot-threshold", config.Raft.SnapshotThreshold, "Number of outstanding log entries that trigger a snapshot")
+	cmd.Flags().Uint64("raft.trailing-logs", config.Raft.TrailingLogs, "Number of log entries left after a snapshot")
 
 	viper.BindPFlags(cmd.Flags())
+
+	// the config keys of these options use underscores, like the other Raft
+	// tuning keys, while the flags use dashes
+	for _, key := range []string{"apply_timeout", "snapshot_interval", "snapshot_threshold", "trailing_logs"} {
+		viper.BindPFlag("raft."+key, cmd.Flags().Lookup("raft."+strings.Replace(key, "_", "-", -1)))
+	}
 }
 
 //NewRaftCmd returns the command that starts Shuffle with Raft consensus
@@ -52,7 +65,5 @@ func runRaft(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Error building Engine: %s", err)
 	}
 
-	engine.Run()
-
-	return nil
+	return engine.Run()
 }
@@ -56,8 +56,15 @@ func init() {
 	RunCmd.PersistentFlags().String("eth.keystore", config.Eth.Keystore, "Location of Ethereum account keys")
 	RunCmd.PersistentFlags().String("eth.pwd", config.Eth.PwdFile, "Password file to unlock accounts")
 	RunCmd.PersistentFlags().String("eth.db", config.Eth.DbFile, "Eth database file")
+	RunCmd.PersistentFlags().String("eth.db-backend", config.Eth.DbBackend, "Eth database backend: leveldb, bolt, or memory")
 	RunCmd.PersistentFlags().String("eth.listen", config.Eth.EthAPIAddr, "Address of HTTP API service")
 	RunCmd.PersistentFlags().Int("eth.cache", config.Eth.Cache, "Megabytes of memory allocated to internal caching (min 16MB / database forced)")
+	RunCmd.PersistentFlags().Bool("eth.archive", config.Eth.Archive, "Keep the state of every block to answer historical queries")
+	RunCmd.PersistentFlags().Uint64("eth.retention", config.Eth.Retention, "Number of recent block states kept when not in archive mode")
+	RunCmd.PersistentFlags().String("eth.coinbase", config.Eth.Coinbase, "Address paid the transaction fees of the blocks proposed by this node")
+	RunCmd.PersistentFlags().Uint64("eth.min-gas-price", config.Eth.MinGasPrice, "Lowest gas price of the transactions accepted by this node")
+	RunCmd.PersistentFlags().Int("eth.txpool-size", config.Eth.TxPoolSize, "Number of transactions held by the transaction pool, pending and queued")
+	RunCmd.PersistentFlags().Duration("eth.tx-lifetime", config.Eth.TxLifetime, "Time after which a transaction still in the transaction pool is dropped")
 
 }
 
@@ -100,7 +100,5 @@ func runSolo(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Error building Engine: %s", err)
 	}
 
-	engine.Run()
-
-	return nil
+	return engine.Run()
 }
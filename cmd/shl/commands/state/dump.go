@@ -0,0 +1,94 @@
+package state
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/abassian/shuffle/src/config"
+	"github.com/abassian/shuffle/src/database"
+	bstate "github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	dbFile    = config.DefaultEthConfig().DbFile
+	dbBackend = config.DefaultEthConfig().DbBackend
+	cache     = config.DefaultEthConfig().Cache
+	block     uint64
+	root      string
+	outFile   string
+)
+
+// AddDumpFlags adds flags to the Dump command
+func AddDumpFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&dbFile, "db", dbFile, "Eth database file")
+	cmd.Flags().StringVar(&dbBackend, "db-backend", dbBackend, "Eth database backend: leveldb or bolt")
+	cmd.Flags().IntVar(&cache, "cache", cache, "Megabytes of memory allocated to internal caching (min 16MB / database forced)")
+	cmd.Flags().Uint64Var(&block, "block", block, "Dump the state of this block instead of the head block")
+	cmd.Flags().StringVar(&root, "root", root, "Dump the state with this root instead of the head block's")
+	cmd.Flags().StringVar(&outFile, "out", outFile, "Write the dump to this file instead of the standard output")
+	viper.BindPFlags(cmd.Flags())
+}
+
+// NewDumpCmd returns the command that dumps the state
+func NewDumpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Export every account to JSON",
+		Long: `
+Write every account of the state of the head block, with its balance, nonce,
+code, and storage, as JSON. The --block or --root option selects another state,
+which must still be in the database: in archive mode, every block's state is;
+otherwise only the recent ones, and only after a clean shutdown.
+
+The node must be stopped. The dump can be turned into the genesis file of a new
+network with 'shl genesis from-dump'.`,
+		Args: cobra.NoArgs,
+		RunE: dump,
+	}
+
+	AddDumpFlags(cmd)
+
+	return cmd
+}
+
+func dump(cmd *cobra.Command, args []string) error {
+	db, err := database.New(dbBackend, dbFile, cache)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var stateRoot common.Hash
+	switch {
+	case cmd.Flags().Changed("root"):
+		stateRoot = common.HexToHash(root)
+	case cmd.Flags().Changed("block"):
+		if stateRoot, err = bstate.StateRoot(db, &block); err != nil {
+			return err
+		}
+	default:
+		if stateRoot, err = bstate.StateRoot(db, nil); err != nil {
+			return err
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if outFile != "" {
+		f, err := os.Create(outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	buf := bufio.NewWriter(w)
+	if err := bstate.DumpState(db, stateRoot, buf); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
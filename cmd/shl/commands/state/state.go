@@ -0,0 +1,18 @@
+package state
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// StateCmd reads the world state from the database of a stopped node
+var StateCmd = &cobra.Command{
+	Use:              "state",
+	Short:            "Inspect the Ethereum state",
+	TraverseChildren: true,
+}
+
+func init() {
+	//Subcommands
+	StateCmd.AddCommand(
+		NewDumpCmd())
+}
@@ -1,20 +1,59 @@
 package common
 
+import "math/big"
+
 type Genesis struct {
-	Alloc AccountMap
-	Poa   PoaMap
+	Config *ChainConfig `json:"config,omitempty"`
+	Fees   *FeeConfig   `json:"fees,omitempty"`
+	Alloc  AccountMap   `json:"alloc"`
+	Poa    PoaMap       `json:"poa"`
+}
+
+// ChainConfig sets the chain ID, which protects signed transactions from being
+// replayed on other chains (EIP-155), and the block numbers from which the
+// rules of each Ethereum hard-fork apply. A fork whose block is not set is
+// never enabled.
+type ChainConfig struct {
+	ChainID             *big.Int `json:"chainId,omitempty"`
+	HomesteadBlock      *big.Int `json:"homesteadBlock,omitempty"`
+	EIP150Block         *big.Int `json:"eip150Block,omitempty"`
+	EIP155Block         *big.Int `json:"eip155Block,omitempty"`
+	EIP158Block         *big.Int `json:"eip158Block,omitempty"`
+	ByzantiumBlock      *big.Int `json:"byzantiumBlock,omitempty"`
+	ConstantinopleBlock *big.Int `json:"constantinopleBlock,omitempty"`
+	PetersburgBlock     *big.Int `json:"petersburgBlock,omitempty"`
+	IstanbulBlock       *big.Int `json:"istanbulBlock,omitempty"`
+}
+
+// FeeConfig decides who receives the transaction fees, ie. the gas used by
+// transactions multiplied by their gas price. By default, the fees of a block
+// are paid to the coinbase of the node that proposed it. Recipient pays them to
+// a fixed address instead, and Burn destroys them. Without a FeeConfig, the fees
+// of the blocks without a known proposer are paid to the zero address, as they
+// were before fee policies; with one, they are burnt.
+type FeeConfig struct {
+	Recipient string `json:"recipient,omitempty"`
+	Burn      bool   `json:"burn,omitempty"`
 }
 
+// AccountMap lists the accounts created by the genesis, by address. Code is
+// hex-encoded without the 0x prefix. The nonce is only set for the accounts
+// of a state that was exported from another network.
 type AccountMap map[string]struct {
-	Code        string
-	Storage     map[string]string
-	Balance     string
-	Authorising bool
+	Code        string            `json:"code,omitempty"`
+	Storage     map[string]string `json:"storage,omitempty"`
+	Balance     string            `json:"balance"`
+	Nonce       uint64            `json:"nonce,omitempty"`
+	Authorising bool              `json:"authorising,omitempty"`
 }
 
+// PoaMap is the account of the POA smart-contract. Like Nonce, Storage is only
+// set when the contract was exported from another network, with its whitelist.
 type PoaMap struct {
-	Address string
-	Balance string
-	Abi     string
-	Code    string
+	Address string            `json:"address,omitempty"`
+	Balance string            `json:"balance,omitempty"`
+	Abi     string            `json:"abi,omitempty"`
+	Code    string            `json:"code,omitempty"`
+	Storage map[string]string `json:"storage,omitempty"`
+	Nonce   uint64            `json:"nonce,omitempty"`
 }
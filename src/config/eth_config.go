@@ -1,15 +1,24 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+
+	"github.com/abassian/shuffle/src/database"
+)
 
 var (
 	defaultEthAPIAddr   = ":8080"
 	defaultCache        = 128
+	defaultRetention    = uint64(128)
+	defaultTxPoolSize   = 4096
+	defaultTxLifetime   = 3 * time.Hour
 	defaultEthDir       = fmt.Sprintf("%s/eth", DefaultDataDir)
 	defaultKeystoreFile = fmt.Sprintf("%s/keystore", defaultEthDir)
 	defaultGenesisFile  = fmt.Sprintf("%s/genesis.json", defaultEthDir)
 	defaultPwdFile      = fmt.Sprintf("%s/pwd.txt", defaultEthDir)
 	defaultDbFile       = fmt.Sprintf("%s/chaindata", defaultEthDir)
+	defaultDbBackend    = database.LevelDB
 )
 
 // EthConfig contains the configuration relative to the accounts, EVM, trie/db,
@@ -25,14 +34,35 @@ type EthConfig struct {
 	// File containing passwords to unlock ethereum accounts
 	PwdFile string `mapstructure:"pwd"`
 
-	// File containing the levelDB database
+	// File containing the database
 	DbFile string `mapstructure:"db"`
 
+	// Key-value store of the database: leveldb, bolt, or memory
+	DbBackend string `mapstructure:"db-backend"`
+
 	// Address of HTTP API Service
 	EthAPIAddr string `mapstructure:"listen"`
 
 	// Megabytes of memory allocated to internal caching (min 16MB / database forced)
 	Cache int `mapstructure:"cache"`
+
+	// Keep the state of every block to answer historical queries
+	Archive bool `mapstructure:"archive"`
+
+	// Number of recent block states kept when not in archive mode
+	Retention uint64 `mapstructure:"retention"`
+
+	// Address paid the transaction fees of the blocks proposed by this node
+	Coinbase string `mapstructure:"coinbase"`
+
+	// Lowest gas price of the transactions accepted by this node
+	MinGasPrice uint64 `mapstructure:"min-gas-price"`
+
+	// Number of transactions held by the transaction pool, pending and queued
+	TxPoolSize int `mapstructure:"txpool-size"`
+
+	// Time after which a transaction still in the transaction pool is dropped
+	TxLifetime time.Duration `mapstructure:"tx-lifetime"`
 }
 
 // DefaultEthConfig return the default configuration for Eth services
@@ -42,8 +72,12 @@ func DefaultEthConfig() *EthConfig {
 		Keystore:   defaultKeystoreFile,
 		PwdFile:    defaultPwdFile,
 		DbFile:     defaultDbFile,
+		DbBackend:  defaultDbBackend,
 		EthAPIAddr: defaultEthAPIAddr,
 		Cache:      defaultCache,
+		Retention:  defaultRetention,
+		TxPoolSize: defaultTxPoolSize,
+		TxLifetime: defaultTxLifetime,
 	}
 }
 
@@ -23,7 +23,7 @@ var (
 // HuronConfig contains the configuration of a Huron node
 type HuronConfig struct {
 
-	// Directory containing priv_key.pem and peers.json files
+	// Directory containing priv_key and peers.json files
 	DataDir string `mapstructure:"datadir"`
 
 	// Address of Huron node (where it talks to other Huron nodes)
@@ -39,6 +39,10 @@ type RaftConfig struct {
 	// staggering, may be delayed as much as 2x this value.
 	CommitTimeout time.Duration `mapstructure:"commit_timeout"`
 
+	// ApplyTimeout bounds the time that the leader waits for a transaction to
+	// be accepted by Raft, before it is retried.
+	ApplyTimeout time.Duration `mapstructure:"apply_timeout"`
+
 	// MaxAppendEntries controls the maximum number of append entries
 	// to send at once. We want to strike a balance between efficiency
 	// and avoiding waste if the follower is going to reject because of
@@ -88,6 +92,16 @@ type RaftConfig struct {
 	RaftDir     string `mapstructure:"dir"`
 	SnapshotDir string `mapstructure:"snapshot-dir"`
 	NodeAddr    string `mapstructure:"node-addr"`
+
+	// Store enables a persistent log and stable store (BoltDB in RaftDir),
+	// which is the default. Otherwise, the Raft log, term, and vote are kept in
+	// memory and lost when the node stops, and a node that already committed
+	// blocks cannot restart, unless it has a snapshot.
+	Store bool `mapstructure:"store"`
+
+	// POA requires the servers that join the cluster to be authorised by the
+	// POA smart-contract. Their ids must then be Ethereum addresses.
+	POA bool `mapstructure:"poa"`
 }
 
 // DefaultRaftConfig returns the default configuration for a Raft node
@@ -97,6 +111,7 @@ func DefaultRaftConfig() *RaftConfig {
 		HeartbeatTimeout:   1000 * time.Millisecond,
 		ElectionTimeout:    1000 * time.Millisecond,
 		CommitTimeout:      50 * time.Millisecond,
+		ApplyTimeout:       5 * time.Second,
 		MaxAppendEntries:   64,
 		ShutdownOnRemove:   true,
 		TrailingLogs:       10240,
@@ -107,6 +122,7 @@ func DefaultRaftConfig() *RaftConfig {
 		RaftDir:            defaultRaftDir,
 		SnapshotDir:        defaultSnapshotDir,
 		NodeAddr:           defaultNodeAddr,
+		Store:              true,
 	}
 }
 
@@ -120,3 +136,22 @@ func (c *RaftConfig) SetDataDir(datadir string) {
 		c.SnapshotDir = fmt.Sprintf("%s/snapshots", c.RaftDir)
 	}
 }
+
+// ToRealRaftConfig converts an shuffle/src/config.RaftConfig to a
+// hashicorp/raft.Config as used by Raft
+func (c *RaftConfig) ToRealRaftConfig() *_raft.Config {
+	raftConfig := _raft.DefaultConfig()
+	raftConfig.ProtocolVersion = c.ProtocolVersion
+	raftConfig.HeartbeatTimeout = c.HeartbeatTimeout
+	raftConfig.ElectionTimeout = c.ElectionTimeout
+	raftConfig.CommitTimeout = c.CommitTimeout
+	raftConfig.MaxAppendEntries = c.MaxAppendEntries
+	raftConfig.ShutdownOnRemove = c.ShutdownOnRemove
+	raftConfig.TrailingLogs = c.TrailingLogs
+	raftConfig.SnapshotInterval = c.SnapshotInterval
+	raftConfig.SnapshotThreshold = c.SnapshotThreshold
+	raftConfig.LeaderLeaseTimeout = c.LeaderLeaseTimeout
+	raftConfig.StartAsLeader = c.StartAsLeader
+	raftConfig.LocalID = c.LocalID
+	return raftConfig
+}
@@ -5,9 +5,12 @@ import (
 	"github.com/abassian/shuffle/src/state"
 )
 
-// Consensus is the interface that abstracts the consensus system
+// Consensus is the interface that abstracts the consensus system. Run blocks
+// until Shutdown is called, and returns once the blocks in progress are
+// committed.
 type Consensus interface {
 	Init(*state.State, *service.Service) error
 	Run() error
+	Shutdown()
 	Info() (map[string]string, error)
 }
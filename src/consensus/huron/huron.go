@@ -1,10 +1,15 @@
 package huron
 
 import (
+	"fmt"
+	"path/filepath"
+
 	_huron "github.com/abassian/huron/src/huron"
 	"github.com/abassian/shuffle/src/config"
 	"github.com/abassian/shuffle/src/service"
 	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,13 +42,30 @@ func (b *InmemHuron) Init(state *state.State, service *service.Service) error {
 	b.ethState = state
 	b.ethService = service
 
+	// Every node must pay the fees of a block to the same address, and Huron
+	// blocks have no creator whose coinbase could be used.
+	if coinbase := state.GetCoinbase(); coinbase != (common.Address{}) {
+		b.logger.WithField("coinbase", coinbase.Hex()).Warn("Huron blocks have no creator, " +
+			"the coinbase is ignored; set a fee recipient in the genesis file instead")
+	}
+
+	// Huron delivers the blocks again when it bootstraps from its store
+	state.SetReplayable(b.config.Store && b.config.Bootstrap)
+
+	// The transactions submitted by this node are stamped with its validator
+	// key, so that the blocks can weigh the timestamps of each validator.
+	keyFile := filepath.Join(b.config.DataDir, "priv_key")
+	key, err := crypto.LoadECDSA(keyFile)
+	if err != nil {
+		return fmt.Errorf("reading validator key %s: %v", keyFile, err)
+	}
+
 	realConfig := b.config.ToRealHuronConfig()
-	realConfig.Proxy = NewInmemProxy(state, service, service.GetSubmitCh(), b.logger)
+	realConfig.Proxy = NewInmemProxy(state, service, service.GetSubmitCh(), key, b.logger)
 
 	huron := _huron.NewHuron(realConfig)
 
-	err := huron.Init()
-	if err != nil {
+	if err := huron.Init(); err != nil {
 		return err
 	}
 
@@ -58,6 +80,11 @@ func (b *InmemHuron) Run() error {
 	return nil
 }
 
+// Shutdown stops the Huron node
+func (b *InmemHuron) Shutdown() {
+	b.huron.Node.Shutdown()
+}
+
 // Info returns Huron stats
 func (b *InmemHuron) Info() (map[string]string, error) {
 	info := b.huron.Node.GetStats()
@@ -1,12 +1,17 @@
 package huron
 
 import (
-	ethCommon "github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/crypto"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"sort"
+	"time"
+
 	"github.com/abassian/huron/src/hashgraph"
 	"github.com/abassian/huron/src/proxy"
 	"github.com/abassian/shuffle/src/service"
 	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,21 +20,141 @@ type InmemProxy struct {
 	service  *service.Service
 	state    *state.State
 	submitCh chan []byte
+	key      *ecdsa.PrivateKey
 	logger   *logrus.Entry
+
+	// authorised tells whether an address is that of a validator. It defaults
+	// to the POA smart-contract.
+	authorised func(common.Address) (bool, error)
 }
 
-// NewInmemProxy initializes and return a new InmemProxy
+// stampedTxPrefix starts a transaction submitted to Huron with a timestamp,
+// cf. stampTx. RLP-encoded transactions start with a list prefix, which is at
+// least 0xc0, so the transactions submitted before they were stamped are told
+// apart.
+const stampedTxPrefix = 0x01
+
+// stampSize is the size of the prefix, the timestamp, and the 65-byte
+// signature that precede a stamped transaction
+const stampSize = 1 + 8 + 65
+
+// NewInmemProxy initializes and return a new InmemProxy. The transactions
+// that the Service sends to submitCh are stamped with the time at which they
+// were received, signed with the validator key of the node, and passed on to
+// Huron.
 func NewInmemProxy(state *state.State,
 	service *service.Service,
 	submitCh chan []byte,
+	key *ecdsa.PrivateKey,
 	logger *logrus.Logger) *InmemProxy {
 
-	return &InmemProxy{
-		service:  service,
-		state:    state,
-		submitCh: submitCh,
-		logger:   logger.WithField("module", "huron/proxy"),
+	p := &InmemProxy{
+		service:    service,
+		state:      state,
+		submitCh:   make(chan []byte),
+		key:        key,
+		logger:     logger.WithField("module", "huron/proxy"),
+		authorised: state.CheckAuthorised,
+	}
+
+	go p.stampTxs(submitCh)
+
+	return p
+}
+
+// stampTxs relays transactions from txCh to Huron, stamped with the current
+// time. A transaction that cannot be stamped is relayed as is.
+func (p *InmemProxy) stampTxs(txCh chan []byte) {
+	for tx := range txCh {
+		data, err := stampTx(tx, uint64(time.Now().Unix()), p.key)
+		if err != nil {
+			p.logger.WithError(err).Error("Stamping transaction")
+			data = tx
+		}
+		p.submitCh <- data
+	}
+}
+
+// stampTx prepends a timestamp, in seconds, to a transaction, with the
+// signature of the timestamp and the transaction by the validator key
+func stampTx(tx []byte, timestamp uint64, key *ecdsa.PrivateKey) ([]byte, error) {
+	data := make([]byte, stampSize+len(tx))
+	data[0] = stampedTxPrefix
+	binary.BigEndian.PutUint64(data[1:9], timestamp)
+	copy(data[stampSize:], tx)
+
+	sig, err := crypto.Sign(stampHash(data), key)
+	if err != nil {
+		return nil, err
+	}
+	copy(data[9:stampSize], sig)
+
+	return data, nil
+}
+
+// unstampTx splits the data of a Huron transaction into the transaction, its
+// timestamp, and the address of the validator that stamped it. ok is false if
+// the transaction was not stamped, or if the signature is invalid.
+func unstampTx(data []byte) (tx []byte, timestamp uint64, creator common.Address, ok bool) {
+	if len(data) < stampSize || data[0] != stampedTxPrefix {
+		return data, 0, common.Address{}, false
 	}
+
+	tx = data[stampSize:]
+
+	pub, err := crypto.SigToPub(stampHash(data), data[9:stampSize])
+	if err != nil {
+		return tx, 0, common.Address{}, false
+	}
+
+	return tx, binary.BigEndian.Uint64(data[1:9]), crypto.PubkeyToAddress(*pub), true
+}
+
+// stampHash is the hash signed by the validator that stamps a transaction. It
+// covers the timestamp and the transaction.
+func stampHash(data []byte) []byte {
+	return crypto.Keccak256(data[1:9], data[stampSize:])
+}
+
+// medianTimestamp returns the lower median of the timestamps, or zero if there
+// are none
+func medianTimestamp(timestamps []uint64) uint64 {
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sorted := append([]uint64{}, timestamps...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)/2]
+}
+
+// blockTimestamp returns the timestamp of a block, given the timestamps of its
+// transactions by the validator that stamped them. The timestamps of each
+// validator are reduced to their median, so that a validator counts once,
+// however many transactions it submitted, and the timestamp of the block is
+// the median of the validators' medians. The stamps of the other nodes are
+// ignored. A block never goes before its parent, so a block without stamps, or
+// whose validators' clocks are behind, has the timestamp of its parent.
+func (p *InmemProxy) blockTimestamp(stamps map[common.Address][]uint64) uint64 {
+	var medians []uint64
+	for creator, timestamps := range stamps {
+		ok, err := p.authorised(creator)
+		if err != nil {
+			p.logger.WithError(err).Error("Error in checkAuthorised")
+		}
+		if !ok {
+			p.logger.WithField("creator", creator.Hex()).Warn("Ignoring timestamps of unknown validator")
+			continue
+		}
+		medians = append(medians, medianTimestamp(timestamps))
+	}
+
+	timestamp := medianTimestamp(medians)
+
+	if parent := p.state.GetHeadBlock(); parent != nil && timestamp < parent.Timestamp {
+		timestamp = parent.Timestamp
+	}
+
+	return timestamp
 }
 
 /*******************************************************************************
@@ -42,23 +167,62 @@ func (p *InmemProxy) SubmitCh() chan []byte {
 	return p.submitCh
 }
 
-// CommitBlock applies the block's transactions to the state and commits. It
+// CommitBlock applies the block's transactions to the state and commits. The
+// transactions that cannot be applied are skipped, and recorded as rejected;
+// as every node rejects the same ones, the resulting state is the same. It
 // also checks the block's internal transactions against the POA smart-contract
 // to check if joining peers are authorised to become validators in Huron. It
 // returns the resulting state-hash and internal transaction receips.
 func (p *InmemProxy) CommitBlock(block hashgraph.Block) (proxy.CommitResponse, error) {
 	p.logger.Debug("CommitBlock")
 
-	blockHashBytes, err := block.Hash()
-	blockHash := ethCommon.BytesToHash(blockHashBytes)
+	// When Huron bootstraps from its store, it replays the blocks it already
+	// committed. Skip the ones that are already reflected in the state.
+	if head := p.state.GetHeadBlock(); head != nil &&
+		head.Consensus == "huron" &&
+		uint64(block.Index()) <= head.ConsensusIndex {
+		p.logger.WithField("index", block.Index()).Debug("Skipping committed block")
+		return proxy.CommitResponse{
+			StateHash:                   head.StateRoot.Bytes(),
+			InternalTransactionReceipts: p.processInternalTransactions(block.InternalTransactions()),
+		}, nil
+	}
 
-	for i, tx := range block.Transactions() {
-		if err := p.state.ApplyTransaction(tx, i, blockHash); err != nil {
-			return proxy.CommitResponse{}, err
+	blockHash, err := block.Hash()
+	if err != nil {
+		return proxy.CommitResponse{}, err
+	}
+
+	// The timestamp of the block is derived from the stamps of its
+	// transactions, which every node reads from the same block, so a few
+	// validators with a wrong clock cannot move it.
+	txs := make([][]byte, len(block.Transactions()))
+	stamps := make(map[common.Address][]uint64)
+	for i, data := range block.Transactions() {
+		tx, timestamp, creator, ok := unstampTx(data)
+		if ok {
+			stamps[creator] = append(stamps[creator], timestamp)
 		}
+		txs[i] = tx
 	}
+	timestamp := p.blockTimestamp(stamps)
 
-	hash, err := p.state.Commit()
+	// Huron blocks have no creator: they gather the events of every validator,
+	// and their signatures, which cover the state hash, are only collected once
+	// they are committed. So the proposer is left empty, and the fees go to the
+	// recipient of the fee policy, if any.
+	for _, tx := range txs {
+		if err := p.state.ApplyTransaction(tx, timestamp); err != nil {
+			p.logger.WithError(err).Warn("Skipping transaction")
+		}
+	}
+
+	hash, err := p.state.Commit(state.BlockInfo{
+		Timestamp:      timestamp,
+		Consensus:      "huron",
+		ConsensusIndex: uint64(block.Index()),
+		ConsensusHash:  blockHash,
+	})
 	if err != nil {
 		return proxy.CommitResponse{}, err
 	}
@@ -111,11 +275,31 @@ func (p *InmemProxy) processInternalTransactions(internalTransactions []hashgrap
 	return receipts
 }
 
-//TODO - Implement these two functions
+// GetSnapshot returns the state at the given block index, for Huron's
+// FastSync. The snapshot contains the whole EVM state, so that a fast-syncing
+// node can resume from it without the preceding transactions.
 func (p *InmemProxy) GetSnapshot(blockIndex int) ([]byte, error) {
-	return []byte{}, nil
+	p.logger.WithField("block", blockIndex).Debug("GetSnapshot")
+
+	snapshot, err := p.state.GetStateSnapshot("huron", uint64(blockIndex))
+	if err != nil {
+		p.logger.WithError(err).Error("Getting snapshot")
+		return nil, err
+	}
+
+	return snapshot, nil
 }
 
+// Restore replaces the local state with a snapshot produced by GetSnapshot.
+// The resulting state root is the one that was committed in the snapshot's
+// block, which Huron verifies against the block's StateHash.
 func (p *InmemProxy) Restore(snapshot []byte) error {
+	p.logger.Debug("Restore")
+
+	if err := p.state.RestoreStateSnapshot(snapshot); err != nil {
+		p.logger.WithError(err).Error("Restoring snapshot")
+		return err
+	}
+
 	return nil
 }
@@ -1,13 +1,21 @@
 package huron
 
 import (
+	"crypto/ecdsa"
+	"encoding/binary"
+	"math/big"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/abassian/huron/src/hashgraph"
 	"github.com/abassian/huron/src/peers"
+	"github.com/abassian/shuffle/src/database"
 	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/sirupsen/logrus"
 
 	bcommon "github.com/abassian/shuffle/src/common"
@@ -75,7 +83,7 @@ func NewTest(dataDir string, logger *logrus.Logger, t *testing.T) *Test {
 	genesisFile := filepath.Join(dataDir, "genesis.json")
 	cache := 128
 
-	state, err := state.NewState(logger, dbFile, cache, genesisFile)
+	state, err := state.NewState(logger, database.Memory, dbFile, cache, genesisFile, false, 128)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -126,3 +134,191 @@ func TestMixedContract(t *testing.T) {
 	}
 
 }
+
+func TestSkipRejectedTransaction(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+
+	inmemProxy := &InmemProxy{
+		state:  test.state,
+		logger: testLogger.WithField("module", "huron/proxy"),
+	}
+
+	// A transaction without signature cannot be applied
+	tx := ethTypes.NewTransaction(0, common.Address{}, big.NewInt(0), 21000, big.NewInt(0), nil)
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := hashgraph.NewBlock(1,
+		1,
+		[]byte("frameHash"),
+		[]*peers.Peer{},
+		[][]byte{data},
+		[]hashgraph.InternalTransaction{})
+
+	if _, err := inmemProxy.CommitBlock(*block); err != nil {
+		t.Fatalf("CommitBlock should skip the transaction, not fail: %v", err)
+	}
+
+	if _, err := test.state.GetRejectedTx(tx.Hash()); err != nil {
+		t.Fatalf("Transaction should be recorded as rejected: %v", err)
+	}
+}
+
+// stampTestTx stamps a transaction like stampTx, and fails the test if it
+// cannot
+func stampTestTx(t *testing.T, tx []byte, timestamp uint64, key *ecdsa.PrivateKey) []byte {
+	data, err := stampTx(tx, timestamp, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBlockTimestamp(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+
+	// Three validators, and a node that is not one
+	keys := make([]*ecdsa.PrivateKey, 4)
+	validators := make(map[common.Address]bool)
+	for i := range keys {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = key
+		validators[crypto.PubkeyToAddress(key.PublicKey)] = i < 3
+	}
+
+	inmemProxy := &InmemProxy{
+		state:  test.state,
+		logger: testLogger.WithField("module", "huron/proxy"),
+		authorised: func(addr common.Address) (bool, error) {
+			return validators[addr], nil
+		},
+	}
+
+	tx := ethTypes.NewTransaction(0, common.Address{}, big.NewInt(0), 21000, big.NewInt(0), nil)
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit := func(index int, txs [][]byte) uint64 {
+		block := hashgraph.NewBlock(index,
+			1,
+			[]byte("frameHash"),
+			[]*peers.Peer{},
+			txs,
+			[]hashgraph.InternalTransaction{})
+		if _, err := inmemProxy.CommitBlock(*block); err != nil {
+			t.Fatal(err)
+		}
+		return test.state.GetHeadBlock().Timestamp
+	}
+
+	// The first validator is late, and submits most of the transactions. It
+	// counts once, as does each validator, and the other nodes do not count.
+	txs := [][]byte{
+		stampTestTx(t, data, 1000, keys[1]),
+		stampTestTx(t, data, 1100, keys[2]),
+	}
+	for i := 0; i < 5; i++ {
+		txs = append(txs, stampTestTx(t, data, 5000, keys[0]))
+		txs = append(txs, stampTestTx(t, data, 9000, keys[3]))
+	}
+
+	// A stamp whose timestamp was changed is not signed by a validator anymore
+	forged := stampTestTx(t, data, 1000, keys[1])
+	binary.BigEndian.PutUint64(forged[1:9], 9000)
+	txs = append(txs, forged)
+
+	if ts := commit(0, txs); ts != 1100 {
+		t.Fatalf("Block timestamp should be the median of the validators' timestamps, 1100, not %d", ts)
+	}
+
+	// The transactions are unstamped before they are applied
+	if _, err := test.state.GetRejectedTx(tx.Hash()); err != nil {
+		t.Fatalf("Transaction should be recorded as rejected: %v", err)
+	}
+
+	// A block never goes before its parent
+	if ts := commit(1, [][]byte{stampTestTx(t, data, 500, keys[0])}); ts != 1100 {
+		t.Fatalf("Block timestamp should be that of its parent, 1100, not %d", ts)
+	}
+	if ts := commit(2, [][]byte{data}); ts != 1100 {
+		t.Fatalf("Block without stamps should have the timestamp of its parent, 1100, not %d", ts)
+	}
+}
+
+func TestSkipCommittedBlock(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	testLogger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", testLogger, t)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inmemProxy := &InmemProxy{
+		state:      test.state,
+		logger:     testLogger.WithField("module", "huron/proxy"),
+		authorised: func(common.Address) (bool, error) { return true, nil },
+	}
+
+	tx := ethTypes.NewTransaction(0, common.Address{}, big.NewInt(0), 21000, big.NewInt(0), nil)
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for index := 0; index < 2; index++ {
+		block := hashgraph.NewBlock(index,
+			1,
+			[]byte("frameHash"),
+			[]*peers.Peer{},
+			[][]byte{stampTestTx(t, data, 1000, key)},
+			[]hashgraph.InternalTransaction{})
+		if _, err := inmemProxy.CommitBlock(*block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := test.state.GetHeadBlock()
+
+	// Huron replays block 0 when it bootstraps
+	block := hashgraph.NewBlock(0,
+		1,
+		[]byte("frameHash"),
+		[]*peers.Peer{},
+		[][]byte{stampTestTx(t, data, 2000, key)},
+		[]hashgraph.InternalTransaction{})
+	res, err := inmemProxy.CommitBlock(*block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if test.state.GetHeadBlock().Hash() != head.Hash() {
+		t.Fatal("Replayed block should not be committed again")
+	}
+	if common.BytesToHash(res.StateHash) != head.StateRoot {
+		t.Fatalf("State hash should be %v, not %x", head.StateRoot.Hex(), res.StateHash)
+	}
+}
@@ -0,0 +1,212 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	_raft "github.com/hashicorp/raft"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// submitAttempts is the number of times a transaction is applied or
+	// forwarded before giving up. Leader changes make the first attempts fail.
+	submitAttempts = 5
+
+	// forwardTimeout bounds a single forwarding round-trip to the leader
+	forwardTimeout = 10 * time.Second
+)
+
+// errNotLeader is returned when a transaction reaches a node that is not, or
+// no longer, the leader, or when the leader cannot accept it in time. The
+// transaction can be retried.
+var errNotLeader = errors.New("node is not the leader")
+
+// forwardRequest is sent by a follower to the leader. It carries either a
+// transaction or a membership change.
+type forwardRequest struct {
+	Tx     []byte
+	Change *membershipChange
+}
+
+// forwardResponse is the leader's answer to a forwardRequest
+type forwardResponse struct {
+	Error     string
+	NotLeader bool
+}
+
+// submitTx appends a transaction to the Raft log. If this node is not the
+// leader, the transaction is forwarded to the leader.
+func (r *Raft) submitTx(tx []byte) error {
+	return r.submit(forwardRequest{Tx: tx})
+}
+
+// submit executes a request on the leader, locally or by forwarding it.
+// Failures caused by leadership changes are retried; the other errors are
+// returned as is.
+func (r *Raft) submit(req forwardRequest) error {
+	var err error
+
+	for attempt := 0; attempt < submitAttempts; attempt++ {
+		if attempt > 0 {
+			// Give the cluster a chance to elect a new leader
+			time.Sleep(r.config.ElectionTimeout)
+		}
+
+		if r.raftNode.State() == _raft.Leader {
+			err = r.apply(req)
+		} else {
+			err = r.forward(req)
+		}
+
+		if !retryable(err) {
+			return err
+		}
+
+		r.logger.WithFields(logrus.Fields{
+			"attempt": attempt,
+			"state":   r.raftNode.State(),
+		}).WithError(err).Debug("Retrying request")
+	}
+
+	return fmt.Errorf("submitting to leader: %v", err)
+}
+
+// apply executes a request on the leader
+func (r *Raft) apply(req forwardRequest) error {
+	if req.Change != nil {
+		return r.applyChange(*req.Change)
+	}
+	return r.applyTx(req.Tx)
+}
+
+// applyTx appends a transaction to the Raft log and waits for it to be
+// applied to the FSM. Only the leader can do that. The entry carries the
+// leader's coinbase and clock in its extensions, as the leader proposes the
+// block; every node then uses the same block timestamp.
+func (r *Raft) applyTx(tx []byte) error {
+	f := r.raftNode.ApplyLog(_raft.Log{
+		Data:       tx,
+		Extensions: encodeExtensions(r.state.GetCoinbase(), uint64(time.Now().Unix())),
+	}, r.config.ApplyTimeout)
+	if err := leaderError(f.Error()); err != nil {
+		return err
+	}
+
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+
+	atomic.AddUint64(&r.txIndex, 1)
+
+	return nil
+}
+
+// forward sends a request to the current leader
+func (r *Raft) forward(req forwardRequest) error {
+	leader := r.raftNode.Leader()
+	if leader == "" {
+		return errNotLeader
+	}
+
+	r.logger.WithField("leader", leader).Debug("Forwarding request")
+
+	conn, err := r.forwardLayer.Dial(leader, forwardTimeout)
+	if err != nil {
+		return forwardError{err}
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	// Once the request is sent, the leader may apply it even if its response
+	// is lost, so the request is not retried, lest it be applied twice.
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return fmt.Errorf("forwarding to leader, the request may have been applied: %v", err)
+	}
+
+	var resp forwardResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return fmt.Errorf("forwarding to leader, the request may have been applied: %v", err)
+	}
+
+	if resp.NotLeader {
+		return errNotLeader
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+
+	return nil
+}
+
+// serveForward executes the requests forwarded by the followers. It does not
+// forward them any further; a node that is not the leader tells the follower
+// to try again.
+func (r *Raft) serveForward() {
+	for {
+		conn, err := r.forwardLayer.Accept()
+		if err != nil {
+			r.logger.WithError(err).Debug("Forward listener closed")
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+			var req forwardRequest
+			if err := json.NewDecoder(conn).Decode(&req); err != nil {
+				r.logger.WithError(err).Error("Decoding forwarded request")
+				return
+			}
+
+			var resp forwardResponse
+			if r.raftNode.State() != _raft.Leader {
+				resp.NotLeader = true
+			} else if err := r.apply(req); err == errNotLeader {
+				resp.NotLeader = true
+			} else if err != nil {
+				resp.Error = err.Error()
+			}
+
+			if err := json.NewEncoder(conn).Encode(resp); err != nil {
+				r.logger.WithError(err).Error("Encoding forward response")
+			}
+		}()
+	}
+}
+
+// forwardError wraps the network errors that occur before a request is sent to
+// the leader. The leader may have gone away, and it did not receive the
+// request, so they can be retried.
+type forwardError struct {
+	err error
+}
+
+func (e forwardError) Error() string {
+	return fmt.Sprintf("forwarding to leader: %v", e.err)
+}
+
+// leaderError converts the Raft errors returned before an entry is appended to
+// the log to errNotLeader. ErrLeadershipLost is returned after, and the entry
+// may still be committed by the next leader, so it is not retried.
+func leaderError(err error) error {
+	switch err {
+	case _raft.ErrNotLeader, _raft.ErrEnqueueTimeout:
+		return errNotLeader
+	}
+	return err
+}
+
+func retryable(err error) bool {
+	if err == errNotLeader {
+		return true
+	}
+	_, ok := err.(forwardError)
+	return ok
+}
@@ -1,12 +1,12 @@
 package raft
 
 import (
-	"fmt"
+	"encoding/binary"
 	"io"
 
-	_ethCommon "github.com/ethereum/go-ethereum/common"
 	_raft "github.com/hashicorp/raft"
 	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,7 +29,10 @@ IMPLEMENT RAFT FSM INTERFACE
 *******************************************************************************/
 
 // Apply is invoked once a log entry is committed.
-// It applies the log data to the state as a transaction.
+// It applies the log data to the state as a transaction. It returns the
+// resulting state root, or an error if the transaction could not be applied.
+// A rejected transaction is still committed, as part of an empty block, so
+// that it is recorded.
 func (f *FSM) Apply(log *_raft.Log) interface{} {
 
 	f.logger.WithFields(logrus.Fields{
@@ -39,26 +42,128 @@ func (f *FSM) Apply(log *_raft.Log) interface{} {
 		"data":  log.Data,
 	}).Debug("Apply")
 
-	if err := f.state.ApplyTransaction(log.Data, int(log.Index), _ethCommon.Hash{}); err != nil {
-		f.logger.WithError(err).Error("Error applying transaction")
+	// With a persistent log store, Raft replays the entries that follow the
+	// last snapshot when the node restarts. Skip the ones that are already
+	// reflected in the state.
+	if head := f.state.GetHeadBlock(); head != nil &&
+		head.Consensus == "raft" &&
+		log.Index <= head.ConsensusIndex {
+		f.logger.WithField("index", log.Index).Debug("Skipping applied log entry")
 		return nil
 	}
 
-	hash, err := f.state.Commit()
+	// The leader that appended the entry proposed the block, at the time it
+	// recorded along with its coinbase.
+	proposer, timestamp := decodeExtensions(log.Extensions)
+	f.state.SetProposer(proposer)
+
+	applyErr := f.state.ApplyTransaction(log.Data, timestamp)
+	if applyErr != nil {
+		f.logger.WithError(applyErr).Error("Error applying transaction")
+	}
+
+	// Each log entry is committed in its own block
+	hash, err := f.state.Commit(state.BlockInfo{
+		Timestamp:      timestamp,
+		Consensus:      "raft",
+		ConsensusIndex: log.Index,
+	})
 	if err != nil {
 		f.logger.WithError(err).Error("Error committing")
-		return nil
+		return err
+	}
+
+	if applyErr != nil {
+		return applyErr
 	}
 
 	return hash.Bytes()
 }
 
-// Snapshot is not implemented yet
+// Snapshot captures the committed state. The returned FSMSnapshot is a
+// point-in-time view of the database, so Apply can keep being called while it
+// is persisted.
 func (f *FSM) Snapshot() (_raft.FSMSnapshot, error) {
-	return nil, fmt.Errorf("Snapshot function not implemented")
+	snap, err := f.state.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	f.logger.WithField("root", snap.Root.Hex()).Debug("Snapshot")
+
+	return &fsmSnapshot{
+		snap:   snap,
+		logger: f.logger,
+	}, nil
+}
+
+// Restore replaces the state with the content of a snapshot produced by
+// Snapshot.
+func (f *FSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	if err := f.state.Restore(rc); err != nil {
+		f.logger.WithError(err).Error("Error restoring snapshot")
+		return err
+	}
+
+	f.logger.WithField("root", f.state.GetHeadBlock().StateRoot.Hex()).Debug("Restored snapshot")
+
+	return nil
+}
+
+// encodeExtensions packs the proposer of a log entry and the timestamp of its
+// block into the extensions of the entry
+func encodeExtensions(proposer common.Address, timestamp uint64) []byte {
+	ext := make([]byte, common.AddressLength+8)
+	copy(ext, proposer.Bytes())
+	binary.BigEndian.PutUint64(ext[common.AddressLength:], timestamp)
+	return ext
+}
+
+// decodeExtensions unpacks the extensions written by encodeExtensions. Entries
+// appended before coinbases were recorded have no proposer, and the ones
+// appended before timestamps were recorded have a zero timestamp.
+func decodeExtensions(ext []byte) (common.Address, uint64) {
+	var (
+		proposer  common.Address
+		timestamp uint64
+	)
+	switch len(ext) {
+	case common.AddressLength + 8:
+		timestamp = binary.BigEndian.Uint64(ext[common.AddressLength:])
+		fallthrough
+	case common.AddressLength:
+		proposer = common.BytesToAddress(ext[:common.AddressLength])
+	}
+	return proposer, timestamp
+}
+
+/*******************************************************************************
+FSMSnapshot
+*******************************************************************************/
+
+// fsmSnapshot implements the Raft FSMSnapshot interface
+type fsmSnapshot struct {
+	snap   *state.Snapshot
+	logger *logrus.Entry
+}
+
+// Persist writes the snapshot to the sink
+func (s *fsmSnapshot) Persist(sink _raft.SnapshotSink) error {
+	size, err := s.snap.WriteTo(sink)
+	if err != nil {
+		s.logger.WithError(err).Error("Error persisting snapshot")
+		sink.Cancel()
+		return err
+	}
+
+	s.logger.WithField("size", size).Debug("Persisted snapshot")
+
+	return sink.Close()
 }
 
-// Restore is not implemented yet
-func (f *FSM) Restore(io.ReadCloser) error {
-	return fmt.Errorf("Restore function not implemented")
+// Release is invoked when we are finished with the snapshot
+func (s *fsmSnapshot) Release() {
+	s.snap.Release()
 }
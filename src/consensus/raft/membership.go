@@ -0,0 +1,165 @@
+package raft
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/abassian/shuffle/src/service"
+	"github.com/ethereum/go-ethereum/common"
+	_raft "github.com/hashicorp/raft"
+)
+
+// Membership operations carried by a membershipChange
+const (
+	addVoterOp           = "add-voter"
+	addNonvoterOp        = "add-nonvoter"
+	removeServerOp       = "remove-server"
+	transferLeadershipOp = "transfer-leadership"
+)
+
+// membershipTimeout bounds the time the leader waits to enqueue a
+// configuration change
+const membershipTimeout = 10 * time.Second
+
+// membershipChange is a change of the cluster configuration, requested on any
+// node and carried out by the leader.
+type membershipChange struct {
+	Op      string
+	ID      string
+	Address string
+}
+
+/*******************************************************************************
+IMPLEMENT SERVICE MEMBERSHIP INTERFACE
+*******************************************************************************/
+
+// Servers returns the cluster configuration as known by this node
+func (r *Raft) Servers() ([]service.JsonServer, error) {
+	f := r.raftNode.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+
+	leader := r.raftNode.Leader()
+
+	servers := []service.JsonServer{}
+	for _, s := range f.Configuration().Servers {
+		servers = append(servers, service.JsonServer{
+			ID:       string(s.ID),
+			Address:  string(s.Address),
+			Suffrage: s.Suffrage.String(),
+			Leader:   s.Address == leader,
+		})
+	}
+
+	return servers, nil
+}
+
+// AddVoter adds a voting server to the cluster
+func (r *Raft) AddVoter(id, address string) error {
+	return r.submitChange(membershipChange{Op: addVoterOp, ID: id, Address: address})
+}
+
+// AddNonvoter adds a server that replicates the log without voting
+func (r *Raft) AddNonvoter(id, address string) error {
+	return r.submitChange(membershipChange{Op: addNonvoterOp, ID: id, Address: address})
+}
+
+// RemoveServer removes a server from the cluster
+func (r *Raft) RemoveServer(id string) error {
+	return r.submitChange(membershipChange{Op: removeServerOp, ID: id})
+}
+
+// TransferLeadership makes the leader step down in favour of the given server,
+// or of the most up-to-date follower if id is empty
+func (r *Raft) TransferLeadership(id, address string) error {
+	return r.submitChange(membershipChange{Op: transferLeadershipOp, ID: id, Address: address})
+}
+
+//------------------------------------------------------------------------------
+
+func (r *Raft) submitChange(c membershipChange) error {
+	r.logger.WithField("change", c).Debug("Membership change")
+	return r.submit(forwardRequest{Change: &c})
+}
+
+// applyChange carries out a membership change. Only the leader can do that.
+func (r *Raft) applyChange(c membershipChange) error {
+	id := _raft.ServerID(c.ID)
+	address := _raft.ServerAddress(c.Address)
+
+	if c.Op != transferLeadershipOp && id == "" {
+		return fmt.Errorf("server id required")
+	}
+
+	var f _raft.Future
+	switch c.Op {
+	case addVoterOp:
+		if err := r.checkAuthorised(c.ID); err != nil {
+			return err
+		}
+		f = r.raftNode.AddVoter(id, address, 0, membershipTimeout)
+	case addNonvoterOp:
+		if err := r.checkAuthorised(c.ID); err != nil {
+			return err
+		}
+		f = r.raftNode.AddNonvoter(id, address, 0, membershipTimeout)
+	case removeServerOp:
+		f = r.raftNode.RemoveServer(id, 0, membershipTimeout)
+	case transferLeadershipOp:
+		if id == "" {
+			f = r.raftNode.LeadershipTransfer()
+			break
+		}
+		if address == "" {
+			var err error
+			if address, err = r.serverAddress(id); err != nil {
+				return err
+			}
+		}
+		f = r.raftNode.LeadershipTransferToServer(id, address)
+	default:
+		return fmt.Errorf("unknown membership operation %q", c.Op)
+	}
+
+	return leaderError(f.Error())
+}
+
+// serverAddress looks up the address of a server in the cluster configuration
+func (r *Raft) serverAddress(id _raft.ServerID) (_raft.ServerAddress, error) {
+	f := r.raftNode.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return "", err
+	}
+	for _, s := range f.Configuration().Servers {
+		if s.ID == id {
+			return s.Address, nil
+		}
+	}
+	return "", fmt.Errorf("unknown server %s", id)
+}
+
+// checkAuthorised enforces the POA contract, if enabled, on the servers that
+// join the cluster. Their ids must then be the Ethereum addresses that are
+// whitelisted in the contract.
+func (r *Raft) checkAuthorised(id string) error {
+	if !r.config.POA {
+		return nil
+	}
+
+	if !common.IsHexAddress(id) {
+		return fmt.Errorf("server id %s is not an address", id)
+	}
+
+	ok, err := r.state.CheckAuthorised(common.HexToAddress(id))
+	if err != nil {
+		r.logger.WithError(err).Error("Error in checkAuthorised")
+		return err
+	}
+	if !ok {
+		r.logger.WithField("id", id).Error("Rejected server")
+		return fmt.Errorf("server %s is not authorised", id)
+	}
+
+	return nil
+}
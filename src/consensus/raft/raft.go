@@ -3,7 +3,8 @@ package raft
 import (
 	"fmt"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	_raft "github.com/hashicorp/raft"
@@ -16,13 +17,17 @@ import (
 // Raft implements the Consensus interface.
 // It uses Hashicorp Raft
 type Raft struct {
-	config    config.RaftConfig
-	service   *service.Service
-	fsm       _raft.FSM
-	raftNode  *_raft.Raft
-	logger    *logrus.Entry
-	terminate chan os.Signal
-	txIndex   int
+	config       config.RaftConfig
+	state        *state.State
+	service      *service.Service
+	fsm          _raft.FSM
+	raftNode     *_raft.Raft
+	mux          *streamMux
+	forwardLayer *muxLayer
+	boltStore    *boltStore
+	logger       *logrus.Entry
+	terminate    chan struct{}
+	txIndex      uint64
 }
 
 // NewRaft returns a new Raft object
@@ -30,7 +35,7 @@ func NewRaft(config config.RaftConfig, logger *logrus.Logger) *Raft {
 	return &Raft{
 		config:    config,
 		logger:    logger.WithField("module", "raft"),
-		terminate: make(chan os.Signal, 1),
+		terminate: make(chan struct{}),
 	}
 }
 
@@ -43,89 +48,176 @@ func (r *Raft) Init(state *state.State, service *service.Service) error {
 
 	r.logger.Debug("INIT")
 
+	r.state = state
 	r.service = service
 
 	r.fsm = NewFSM(state, r.logger)
 
+	// The log is replayed from the last snapshot when the node restarts
+	state.SetReplayable(true)
+
 	// Initialize raft node
 
-	//TODO: Use r.config
-	config := _raft.DefaultConfig()
-	config.LocalID = r.config.LocalID
+	config := r.config.ToRealRaftConfig()
 
-	// Setup Raft communication.
-	transport, err := _raft.NewTCPTransport(r.config.NodeAddr,
-		nil,
-		3,
-		10*time.Second,
-		os.Stderr)
+	// Setup Raft communication. The Raft port is shared with the followers
+	// forwarding transactions to the leader.
+	mux, err := newStreamMux(r.config.NodeAddr, r.logger)
 	if err != nil {
 		return err
 	}
+	r.mux = mux
+	transport := _raft.NewNetworkTransport(mux.Layer(raftConnType),
+		3,
+		10*time.Second,
+		os.Stderr)
+	r.forwardLayer = mux.Layer(forwardConnType)
 
 	// Create the snapshot store. This allows the Raft to truncate the log.
 	snapshots, err := _raft.NewFileSnapshotStore(r.config.SnapshotDir, 1, os.Stderr)
 	if err != nil {
+		r.close()
 		return fmt.Errorf("file snapshot store: %s", err)
 	}
 
 	// Create the log store and stable store.
-	// TODO: Add option for persistent store
-	logStore := _raft.NewInmemStore()
-	stableStore := _raft.NewInmemStore()
+	logStore, stableStore, err := r.newStores()
+	if err != nil {
+		r.close()
+		return err
+	}
+
+	// A node that restarts with a persistent store already has a cluster
+	// configuration in its log or snapshots, and must not bootstrap again.
+	hasState, err := _raft.HasExistingState(logStore, stableStore, snapshots)
+	if err != nil {
+		r.close()
+		return fmt.Errorf("checking existing raft state: %s", err)
+	}
+
+	// The FSM skips the log entries that the head block already reflects, by
+	// index, which is only valid if the blocks were committed from this log. A
+	// new log starts again at index 1, so its entries would be skipped.
+	if head := state.GetHeadBlock(); !hasState && head != nil && head.Consensus == "raft" {
+		r.close()
+		return fmt.Errorf("the database has blocks committed up to Raft log index %d, "+
+			"but the Raft log is empty: restart with the Raft directory of the node "+
+			"and --raft.store, or with a new database", head.ConsensusIndex)
+	}
 
 	// Instantiate the Raft systems.
 	ra, err := _raft.NewRaft(config, r.fsm, logStore, stableStore, snapshots, transport)
 	if err != nil {
+		r.close()
 		return fmt.Errorf("new raft: %s", err)
 	}
 
-	//TODO: We should be using the new dynmamic membership protocol
-	configuration, err := _raft.ReadConfigJSON(fmt.Sprintf("%s/peers.json", r.config.RaftDir))
+	r.raftNode = ra
+
+	if hasState {
+		r.logger.Debug("Existing Raft state found, skipping bootstrap")
+	} else if err := r.bootstrap(ra); err != nil {
+		r.shutdown()
+		return err
+	}
+
+	// Transactions are handed over synchronously so that the clients know
+	// whether they made it into the log.
+	service.SetSubmitCallback(r.submitTx)
+	service.SetMembership(r)
+
+	go r.serveForward()
+
+	return nil
+}
+
+// bootstrap starts a new cluster with the servers listed in peers.json. Without
+// a peers.json file, the node waits to be added to an existing cluster through
+// the membership API.
+func (r *Raft) bootstrap(ra *_raft.Raft) error {
+	peersFile := fmt.Sprintf("%s/peers.json", r.config.RaftDir)
+
+	if _, err := os.Stat(peersFile); os.IsNotExist(err) {
+		r.logger.Info("No peers.json, waiting to join a cluster")
+		return nil
+	}
+
+	configuration, err := _raft.ReadConfigJSON(peersFile)
 	if err != nil {
 		return fmt.Errorf("Unable to create cluster configuration from peers.json: %v", err)
 	}
-	ra.BootstrapCluster(configuration)
 
-	r.raftNode = ra
+	return ra.BootstrapCluster(configuration).Error()
+}
 
-	return nil
+// newStores returns the Raft log store and stable store, persisted in a BoltDB
+// file if the Store option is set, or in memory otherwise.
+func (r *Raft) newStores() (_raft.LogStore, _raft.StableStore, error) {
+	if !r.config.Store {
+		return _raft.NewInmemStore(), _raft.NewInmemStore(), nil
+	}
+
+	if err := os.MkdirAll(r.config.RaftDir, 0700); err != nil {
+		return nil, nil, err
+	}
+
+	store, err := newBoltStore(filepath.Join(r.config.RaftDir, "raft.db"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("new bolt store: %s", err)
+	}
+	r.boltStore = store
+
+	return store, store, nil
+}
+
+// shutdown stops the Raft node, so that no entry is applied to the state once
+// it returns, and releases the stores and the listener
+func (r *Raft) shutdown() error {
+	err := r.raftNode.Shutdown().Error()
+	r.close()
+	return err
+}
+
+// close releases the log store and the listener
+func (r *Raft) close() {
+	if r.boltStore != nil {
+		r.boltStore.Close()
+	}
+	if r.mux != nil {
+		r.mux.Close()
+	}
 }
 
 // Run starts the Raft node and service
 func (r *Raft) Run() error {
 
-	// Relay submitCh to Raft
+	// Relay submitCh to Raft. The Service submits transactions through the
+	// submit callback, but other producers may still use the channel.
 	submitCh := r.service.GetSubmitCh()
-	signal.Notify(r.terminate, os.Interrupt)
 	for {
 		select {
 		case t := <-submitCh:
 			r.logger.WithFields(logrus.Fields{
-				"tx":    r.txIndex,
+				"tx":    atomic.LoadUint64(&r.txIndex),
 				"state": r.raftNode.State(),
 			}).Debug("Adding Transaction")
 
-			if r.raftNode.State() != _raft.Leader {
-				r.logger.Debug("NOT LEADER")
-				//TODO: Relay message to leader
-				break
-			}
-
-			f := r.raftNode.Apply(t, r.config.CommitTimeout)
-			if err := f.Error(); err != nil {
-				r.logger.WithError(err).Error("Applying Raft tx")
-				break
+			if err := r.submitTx(t); err != nil {
+				r.logger.WithError(err).Error("Submitting Raft tx")
 			}
-
-			r.txIndex++
 		case <-r.terminate:
 			r.logger.Debug("Raft exiting")
-			return nil
+			return r.shutdown()
 		}
 	}
 }
 
+// Shutdown stops Run, which shuts the Raft node down once the entries in
+// progress are applied
+func (r *Raft) Shutdown() {
+	close(r.terminate)
+}
+
 // Info returns Raft stats
 func (r *Raft) Info() (map[string]string, error) {
 	info := r.raftNode.Stats()
@@ -0,0 +1,400 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	_raft "github.com/hashicorp/raft"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/abassian/shuffle/src/config"
+	"github.com/abassian/shuffle/src/database"
+	"github.com/abassian/shuffle/src/service"
+	"github.com/abassian/shuffle/src/state"
+)
+
+// freeAddr returns a local address that nothing listens on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// newTestConfig returns the configuration of a node whose data is in dir
+func newTestConfig(t *testing.T, dir string, id string) *config.RaftConfig {
+	conf := config.DefaultRaftConfig()
+	conf.SetDataDir(dir)
+	conf.NodeAddr = freeAddr(t)
+	conf.LocalID = _raft.ServerID(id)
+	return conf
+}
+
+// writePeers writes the peers.json file that makes a node bootstrap a cluster
+// of the given voters
+func writePeers(t *testing.T, dir string, confs ...*config.RaftConfig) {
+	peers := []string{}
+	for _, c := range confs {
+		peers = append(peers, fmt.Sprintf(`{"id":"%s","address":"%s","non_voter":false}`, c.LocalID, c.NodeAddr))
+	}
+	data := "[" + strings.Join(peers, ",") + "]"
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "peers.json"), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startNode starts a Raft node with a new State, or the State left in dir by
+// a previous run
+func startNode(t *testing.T, dir string, conf *config.RaftConfig) (*Raft, *state.State, error) {
+	logger := bcommon.NewTestLogger(t)
+
+	st, err := state.NewState(logger,
+		database.LevelDB,
+		filepath.Join(dir, "chaindata"),
+		16,
+		filepath.Join(dir, "genesis.json"),
+		false,
+		128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := service.NewService(filepath.Join(dir, "keystore"), "", "", st, make(chan []byte), logger)
+
+	r := NewRaft(*conf, logger)
+	if err := r.Init(st, svc); err != nil {
+		st.Close()
+		return nil, nil, err
+	}
+
+	return r, st, nil
+}
+
+// stopNode shuts a node down and closes its State
+func stopNode(t *testing.T, r *Raft, st *state.State) {
+	if err := r.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it holds, or fails the test after 10 seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	timeout := time.After(10 * time.Second)
+	for !cond() {
+		select {
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s", what)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// waitLeader waits until r is the leader of its cluster
+func waitLeader(t *testing.T, r *Raft) {
+	waitFor(t, "the leader", func() bool {
+		return r.raftNode.State() == _raft.Leader
+	})
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuffle-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := newTestConfig(t, dir, "node1")
+	writePeers(t, dir, conf)
+
+	start := func() (*Raft, *state.State, error) {
+		r, st, err := startNode(t, dir, conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		waitLeader(t, r)
+		return r, st, nil
+	}
+
+	// Every entry is committed in a block, even if it is not a transaction
+	apply := func(r *Raft) {
+		if err := r.raftNode.Apply([]byte("entry"), time.Second).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, st, err := start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply(r)
+	apply(r)
+	head := st.GetHeadBlock()
+	stopNode(t, r, st)
+
+	// With the default configuration, the log is persisted. Its entries are
+	// replayed, and skipped, and the new ones are applied.
+	r, st, err = start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply(r)
+	if n := st.GetHeadBlock().Number; n != head.Number+1 {
+		t.Fatalf("Head block should be %d after a restart, not %d", head.Number+1, n)
+	}
+	stopNode(t, r, st)
+
+	// Without the log, the node refuses to start, rather than skip the new
+	// entries whose indexes were already used
+	if err := os.Remove(filepath.Join(dir, "raft.db")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := start(); err == nil {
+		t.Fatal("Node should not start without the Raft log of its blocks")
+	}
+}
+
+func TestMembership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuffle-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// node1 bootstraps the cluster, the others wait to be added
+	confs := []*config.RaftConfig{}
+	nodes := []*Raft{}
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("node%d", i)
+		nodeDir := filepath.Join(dir, id)
+
+		conf := newTestConfig(t, nodeDir, id)
+		if i == 1 {
+			writePeers(t, nodeDir, conf)
+		}
+
+		r, st, err := startNode(t, nodeDir, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stopNode(t, r, st)
+
+		confs = append(confs, conf)
+		nodes = append(nodes, r)
+	}
+	waitLeader(t, nodes[0])
+
+	joined := func(i int) func() bool {
+		return func() bool {
+			return nodes[i].raftNode.Leader() == _raft.ServerAddress(confs[0].NodeAddr)
+		}
+	}
+
+	servers := func() map[string]service.JsonServer {
+		list, err := nodes[0].Servers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID := make(map[string]service.JsonServer)
+		for _, s := range list {
+			byID[s.ID] = s
+		}
+		return byID
+	}
+
+	// The leader adds a voter
+	if err := nodes[0].AddVoter("node2", confs[1].NodeAddr); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "node2 to join", joined(1))
+
+	// A follower forwards the changes to the leader
+	if err := nodes[1].AddNonvoter("node3", confs[2].NodeAddr); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "node3 to join", joined(2))
+
+	got := servers()
+	if len(got) != 3 || !got["node1"].Leader || got["node2"].Suffrage != "Voter" || got["node3"].Suffrage != "Nonvoter" {
+		t.Fatalf("Cluster should have the leader node1, the voter node2, and the nonvoter node3, not %v", got)
+	}
+
+	if err := nodes[1].RemoveServer("node3"); err != nil {
+		t.Fatal(err)
+	}
+
+	got = servers()
+	if _, ok := got["node3"]; len(got) != 2 || ok {
+		t.Fatalf("node3 should be removed, got %v", got)
+	}
+}
+
+// TestForwarding submits transactions through a follower of a 3-node cluster
+// whose Raft logs are kept in memory
+func TestForwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuffle-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := fmt.Sprintf(`{"alloc":{"%s":{"balance":"1337000000000000000000"}}}`,
+		crypto.PubkeyToAddress(key.PublicKey).Hex())
+
+	confs := []*config.RaftConfig{}
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("node%d", i)
+		conf := newTestConfig(t, filepath.Join(dir, id), id)
+		conf.Store = false
+		confs = append(confs, conf)
+	}
+
+	// Every node bootstraps the same cluster
+	nodes := make([]*Raft, len(confs))
+	states := make([]*state.State, len(confs))
+	stopped := make([]bool, len(confs))
+	for i, conf := range confs {
+		nodeDir := filepath.Join(dir, string(conf.LocalID))
+		writePeers(t, nodeDir, confs...)
+		if err := ioutil.WriteFile(filepath.Join(nodeDir, "genesis.json"), []byte(genesis), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		r, st, err := startNode(t, nodeDir, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i], states[i] = r, st
+	}
+	defer func() {
+		for i := range nodes {
+			if !stopped[i] {
+				stopNode(t, nodes[i], states[i])
+			}
+		}
+	}()
+
+	leader := func() int {
+		l := -1
+		waitFor(t, "a leader", func() bool {
+			for i, r := range nodes {
+				if !stopped[i] && r.raftNode.State() == _raft.Leader {
+					l = i
+					return true
+				}
+			}
+			return false
+		})
+		return l
+	}
+
+	newTx := func(nonce uint64) (*ethTypes.Transaction, []byte) {
+		tx := ethTypes.NewTransaction(nonce, common.Address{1}, big.NewInt(1), 21000, big.NewInt(0), nil)
+		signed, err := ethTypes.SignTx(tx, states[0].GetSigner(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed, data
+	}
+
+	// The transaction is committed once, on every running node
+	committed := func(tx *ethTypes.Transaction, number uint64) {
+		for i, st := range states {
+			if stopped[i] {
+				continue
+			}
+			waitFor(t, fmt.Sprintf("block %d on node%d", number, i+1), func() bool {
+				return st.GetHeadBlock().Number >= number
+			})
+			block, err := st.GetBlockByNumber(number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(block.TxHashes) != 1 || block.TxHashes[0] != tx.Hash() || st.GetHeadBlock().Number != number {
+				t.Fatalf("node%d should commit the transaction in block %d only", i+1, number)
+			}
+		}
+	}
+
+	l := leader()
+	follower := (l + 1) % len(nodes)
+	head := states[l].GetHeadBlock().Number
+
+	tx0, data := newTx(0)
+	if err := nodes[follower].submitTx(data); err != nil {
+		t.Fatal(err)
+	}
+	committed(tx0, head+1)
+
+	// The leader applies an invalid entry and reports the error, which is not
+	// retried, lest the entry be appended again
+	start := time.Now()
+	if err := nodes[follower].submitTx([]byte("not a transaction")); err == nil {
+		t.Fatal("An invalid transaction should fail")
+	}
+	if elapsed := time.Since(start); elapsed >= confs[follower].ElectionTimeout {
+		t.Fatalf("An invalid transaction should not be retried, it took %v", elapsed)
+	}
+	waitFor(t, "the invalid entry", func() bool {
+		return states[follower].GetHeadBlock().Number == head+2
+	})
+
+	// Once the leader is gone, the follower retries until a new leader is
+	// elected, and the transaction is applied once
+	stopNode(t, nodes[l], states[l])
+	stopped[l] = true
+
+	tx1, data := newTx(1)
+	if err := nodes[follower].submitTx(data); err != nil {
+		t.Fatal(err)
+	}
+	leader()
+	committed(tx1, head+3)
+}
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		err   error
+		retry bool
+	}{
+		{leaderError(_raft.ErrNotLeader), true},
+		{leaderError(_raft.ErrEnqueueTimeout), true},
+		{leaderError(_raft.ErrLeadershipLost), false},
+		{forwardError{errors.New("connection refused")}, true},
+		{errors.New("forwarding to leader, the request may have been applied: EOF"), false},
+		{errors.New("nonce too low"), false},
+	}
+
+	for _, c := range cases {
+		if retryable(c.err) != c.retry {
+			t.Fatalf("retryable(%v) should be %v", c.err, c.retry)
+		}
+	}
+}
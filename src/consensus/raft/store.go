@@ -0,0 +1,183 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/hashicorp/go-msgpack/codec"
+	_raft "github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	logsBucket = []byte("logs")
+	confBucket = []byte("conf")
+
+	// errKeyNotFound is returned by the stable store for a missing key. Raft
+	// matches it by message.
+	errKeyNotFound = errors.New("not found")
+)
+
+// boltStore is a Raft LogStore and StableStore persisted in a BoltDB file. It
+// uses the same layout as raft-boltdb, so that it opens the raft.db files
+// written by earlier versions.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens or creates the BoltDB file at path
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(logsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(confBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// Close closes the BoltDB file
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// FirstIndex implements the LogStore interface
+func (s *boltStore) FirstIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(logsBucket).Cursor().First(); k != nil {
+			index = bytesToUint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// LastIndex implements the LogStore interface
+func (s *boltStore) LastIndex() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(logsBucket).Cursor().Last(); k != nil {
+			index = bytesToUint64(k)
+		}
+		return nil
+	})
+	return index, err
+}
+
+// GetLog implements the LogStore interface
+func (s *boltStore) GetLog(index uint64, log *_raft.Log) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(logsBucket).Get(uint64ToBytes(index))
+		if val == nil {
+			return _raft.ErrLogNotFound
+		}
+		return decodeMsgPack(val, log)
+	})
+}
+
+// StoreLog implements the LogStore interface
+func (s *boltStore) StoreLog(log *_raft.Log) error {
+	return s.StoreLogs([]*_raft.Log{log})
+}
+
+// StoreLogs implements the LogStore interface
+func (s *boltStore) StoreLogs(logs []*_raft.Log) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logsBucket)
+		for _, log := range logs {
+			val, err := encodeMsgPack(log)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(uint64ToBytes(log.Index), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange implements the LogStore interface
+func (s *boltStore) DeleteRange(min, max uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(logsBucket).Cursor()
+		for k, _ := cursor.Seek(uint64ToBytes(min)); k != nil; k, _ = cursor.Next() {
+			if bytesToUint64(k) > max {
+				break
+			}
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Set implements the StableStore interface
+func (s *boltStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(confBucket).Put(key, val)
+	})
+}
+
+// Get implements the StableStore interface
+func (s *boltStore) Get(key []byte) ([]byte, error) {
+	var val []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(confBucket).Get(key)
+		if v == nil {
+			return errKeyNotFound
+		}
+		// the value is only valid for the life of the transaction
+		val = append([]byte{}, v...)
+		return nil
+	})
+	return val, err
+}
+
+// SetUint64 implements the StableStore interface
+func (s *boltStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, uint64ToBytes(val))
+}
+
+// GetUint64 implements the StableStore interface
+func (s *boltStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return bytesToUint64(val), nil
+}
+
+func decodeMsgPack(buf []byte, out interface{}) error {
+	return codec.NewDecoder(bytes.NewReader(buf), &codec.MsgpackHandle{}).Decode(out)
+}
+
+func encodeMsgPack(in interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := codec.NewEncoder(&buf, &codec.MsgpackHandle{}).Encode(in)
+	return buf.Bytes(), err
+}
+
+func bytesToUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func uint64ToBytes(u uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf
+}
@@ -0,0 +1,81 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_raft "github.com/hashicorp/raft"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuffle-raft-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "raft.db")
+
+	store, err := newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := []*_raft.Log{}
+	for i := uint64(1); i <= 5; i++ {
+		logs = append(logs, &_raft.Log{Index: i, Term: 1, Type: _raft.LogCommand, Data: []byte{byte(i)}})
+	}
+	if err := store.StoreLogs(logs); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteRange(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUint64([]byte("CurrentTerm"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get([]byte("LastVoteCand")); err == nil || err.Error() != "not found" {
+		t.Fatalf("Missing key error should be 'not found', not %v", err)
+	}
+	store.Close()
+
+	// the logs and the term survive a reopen
+	store, err = newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	first, err := store.FirstIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := store.LastIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != 3 || last != 5 {
+		t.Fatalf("Index range should be 3-5, not %d-%d", first, last)
+	}
+
+	var log _raft.Log
+	if err := store.GetLog(2, &log); err != _raft.ErrLogNotFound {
+		t.Fatalf("Deleted log should not be found, got %v", err)
+	}
+	if err := store.GetLog(4, &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Index != 4 || log.Term != 1 || len(log.Data) != 1 || log.Data[0] != 4 {
+		t.Fatalf("Log 4 should be restored, got %+v", log)
+	}
+
+	term, err := store.GetUint64([]byte("CurrentTerm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if term != 1 {
+		t.Fatalf("CurrentTerm should be 1, not %d", term)
+	}
+}
@@ -0,0 +1,166 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	_raft "github.com/hashicorp/raft"
+	"github.com/sirupsen/logrus"
+)
+
+// The first byte written on every connection to the Raft port says what the
+// connection is for. It lets Raft RPCs and forwarded transactions share the
+// same address, so nodes do not need to know about each other's service
+// address.
+const (
+	raftConnType byte = iota
+	forwardConnType
+)
+
+// routeTimeout is how long an incoming connection has to announce its type
+const routeTimeout = 10 * time.Second
+
+// streamMux accepts the connections on the Raft port and dispatches them to
+// the appropriate muxLayer.
+type streamMux struct {
+	listener net.Listener
+
+	layers map[byte]*muxLayer
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	logger *logrus.Entry
+}
+
+// newStreamMux starts listening on addr
+func newStreamMux(addr string, logger *logrus.Entry) (*streamMux, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &streamMux{
+		listener: listener,
+		layers:   make(map[byte]*muxLayer),
+		closeCh:  make(chan struct{}),
+		logger:   logger,
+	}
+
+	for _, t := range []byte{raftConnType, forwardConnType} {
+		m.layers[t] = &muxLayer{
+			mux:      m,
+			connType: t,
+			connCh:   make(chan net.Conn),
+		}
+	}
+
+	go m.serve()
+
+	return m, nil
+}
+
+// Layer returns the StreamLayer for the given connection type
+func (m *streamMux) Layer(connType byte) *muxLayer {
+	return m.layers[connType]
+}
+
+// Close stops the listener. It is safe to call it multiple times.
+func (m *streamMux) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.closeCh)
+		err = m.listener.Close()
+	})
+	return err
+}
+
+func (m *streamMux) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.closeCh:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				m.logger.WithError(err).Debug("Accepting connection")
+				continue
+			}
+			m.logger.WithError(err).Error("Accepting connection")
+			return
+		}
+		go m.route(conn)
+	}
+}
+
+func (m *streamMux) route(conn net.Conn) {
+	connType := make([]byte, 1)
+
+	conn.SetReadDeadline(time.Now().Add(routeTimeout))
+	if _, err := conn.Read(connType); err != nil {
+		m.logger.WithError(err).Debug("Reading connection type")
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	layer, ok := m.layers[connType[0]]
+	if !ok {
+		m.logger.WithField("type", connType[0]).Debug("Unknown connection type")
+		conn.Close()
+		return
+	}
+
+	select {
+	case layer.connCh <- conn:
+	case <-m.closeCh:
+		conn.Close()
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// muxLayer implements the Raft StreamLayer interface for one type of
+// connection of a streamMux.
+type muxLayer struct {
+	mux      *streamMux
+	connType byte
+	connCh   chan net.Conn
+}
+
+// Accept waits for the next connection of this layer's type
+func (l *muxLayer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.mux.closeCh:
+		return nil, fmt.Errorf("transport closed")
+	}
+}
+
+// Close closes the underlying streamMux
+func (l *muxLayer) Close() error {
+	return l.mux.Close()
+}
+
+// Addr returns the address of the Raft port
+func (l *muxLayer) Addr() net.Addr {
+	return l.mux.listener.Addr()
+}
+
+// Dial opens a connection of this layer's type to another node
+func (l *muxLayer) Dial(address _raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{l.connType}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -1,10 +1,9 @@
 package solo
 
 import (
-	"fmt"
 	"strconv"
+	"time"
 
-	"github.com/ethereum/go-ethereum/common"
 	"github.com/abassian/shuffle/src/service"
 	"github.com/abassian/shuffle/src/state"
 	"github.com/sirupsen/logrus"
@@ -15,16 +14,22 @@ Solo implements the Consensus interface.
 It relays messages directly from the State to the Service.
 */
 type Solo struct {
-	txIndex int
-	state   *state.State
-	service *service.Service
-	logger  *logrus.Entry
+	txIndex   int
+	state     *state.State
+	service   *service.Service
+	logger    *logrus.Entry
+	terminate chan struct{}
+
+	// now returns the wall clock time, which timestamps the blocks
+	now func() time.Time
 }
 
 // NewSolo returns a Solo object with nil State and Service
 func NewSolo(logger *logrus.Logger) *Solo {
 	return &Solo{
-		logger: logger.WithField("module", "solo"),
+		logger:    logger.WithField("module", "solo"),
+		terminate: make(chan struct{}),
+		now:       time.Now,
 	}
 }
 
@@ -40,6 +45,11 @@ func (s *Solo) Init(state *state.State, service *service.Service) error {
 	s.state = state
 	s.service = service
 
+	// Carry on with the indexes of the blocks committed before a restart
+	if head := state.GetHeadBlock(); head != nil && head.Consensus == "solo" {
+		s.txIndex = int(head.ConsensusIndex) + 1
+	}
+
 	return nil
 }
 
@@ -52,14 +62,25 @@ func (s *Solo) Run() error {
 		case t := <-submitCh:
 			s.logger.WithField("tx", s.txIndex).Debug("Adding Transaction")
 
-			err := s.state.ApplyTransaction(t,
-				s.txIndex,
-				common.BytesToHash([]byte(fmt.Sprintf("block %d", s.txIndex))))
+			// This node proposes every block
+			s.state.SetProposer(s.state.GetCoinbase())
+
+			// The transaction sees the timestamp of the block it goes in. If
+			// the clock went back, the State dates the block, and the context
+			// of the transaction, like the previous block.
+			timestamp := uint64(s.now().Unix())
+
+			err := s.state.ApplyTransaction(t, timestamp)
 			if err != nil {
 				s.logger.WithField("tx", s.txIndex).WithError(err).Errorf("ApplyTransaction")
 			}
 
-			hash, err := s.state.Commit()
+			// Each transaction is committed in its own block
+			hash, err := s.state.Commit(state.BlockInfo{
+				Timestamp:      timestamp,
+				Consensus:      "solo",
+				ConsensusIndex: uint64(s.txIndex),
+			})
 			if err != nil {
 				s.logger.WithField("tx", s.txIndex).WithError(err).Errorf("Commit")
 			}
@@ -67,10 +88,18 @@ func (s *Solo) Run() error {
 			s.logger.WithField("tx", s.txIndex).Debugf("Result State Hash: %v", hash)
 
 			s.txIndex++
+		case <-s.terminate:
+			s.logger.Debug("Solo exiting")
+			return nil
 		}
 	}
 }
 
+// Shutdown stops Run once the current block is committed
+func (s *Solo) Shutdown() {
+	close(s.terminate)
+}
+
 // Info returns the current transaction index
 func (s *Solo) Info() (map[string]string, error) {
 	info := map[string]string{
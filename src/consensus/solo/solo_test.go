@@ -0,0 +1,91 @@
+package solo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/abassian/shuffle/src/database"
+	"github.com/abassian/shuffle/src/service"
+	"github.com/abassian/shuffle/src/state"
+)
+
+func TestClockGoesBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuffle-solo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := bcommon.NewTestLogger(t)
+
+	st, err := state.NewState(logger,
+		database.Memory,
+		filepath.Join(dir, "chaindata"),
+		16,
+		filepath.Join(dir, "genesis.json"),
+		false,
+		128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	submitCh := make(chan []byte)
+	svc := service.NewService(filepath.Join(dir, "keystore"), "", "", st, submitCh, logger)
+
+	s := NewSolo(logger)
+	if err := s.Init(st, svc); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := make(chan time.Time, 1)
+	s.now = func() time.Time { return <-clock }
+
+	done := make(chan error)
+	go func() {
+		done <- s.Run()
+	}()
+
+	// Every submission is committed in a block, even if it is not a valid
+	// transaction
+	commit := func(now int64) uint64 {
+		number := uint64(0)
+		if head := st.GetHeadBlock(); head != nil {
+			number = head.Number + 1
+		}
+
+		clock <- time.Unix(now, 0)
+		submitCh <- []byte("tx")
+
+		timeout := time.After(5 * time.Second)
+		for {
+			if head := st.GetHeadBlock(); head != nil && head.Number == number {
+				return head.Timestamp
+			}
+			select {
+			case <-timeout:
+				t.Fatalf("Block %d should be committed", number)
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+
+	if ts := commit(2000); ts != 2000 {
+		t.Fatalf("Block timestamp should be 2000, not %d", ts)
+	}
+	if ts := commit(1500); ts != 2000 {
+		t.Fatalf("Block timestamp should not go back to 1500, got %d", ts)
+	}
+	if ts := commit(2500); ts != 2500 {
+		t.Fatalf("Block timestamp should be 2500, not %d", ts)
+	}
+
+	s.Shutdown()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
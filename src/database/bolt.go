@@ -0,0 +1,324 @@
+package database
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltBucket is the bucket that holds all the entries
+	boltBucket = []byte("shuffle")
+
+	// boltIteratorChunk is the number of entries that an iterator reads per
+	// transaction
+	boltIteratorChunk = 1024
+)
+
+// boltDB is a Database backed by a BoltDB file. Every write is a transaction,
+// which is synced to disk, so large updates should go through a batch.
+type boltDB struct {
+	db *bolt.DB
+}
+
+// NewBoltDB opens the BoltDB file at the given path, and creates it if needed
+func NewBoltDB(file string) (Database, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltDB{db: db}, nil
+}
+
+func (db *boltDB) Put(key []byte, value []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (db *boltDB) Has(key []byte) (bool, error) {
+	var ok bool
+	err := db.db.View(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(boltBucket).Get(key) != nil
+		return nil
+	})
+	return ok, err
+}
+
+func (db *boltDB) Get(key []byte) ([]byte, error) {
+	var data []byte
+	err := db.db.View(func(tx *bolt.Tx) error {
+		// The value is only valid during the transaction
+		if value := tx.Bucket(boltBucket).Get(key); value != nil {
+			data = common.CopyBytes(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (db *boltDB) Delete(key []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+func (db *boltDB) Close() error {
+	return db.db.Close()
+}
+
+func (db *boltDB) NewBatch() ethdb.Batch {
+	return &boltBatch{db: db.db}
+}
+
+// NewIterator returns an iterator that reads the entries in chunks, each in
+// its own transaction, so that the database can be written while iterating.
+// BoltDB cannot grow its file while a transaction is open.
+func (db *boltDB) NewIterator() Iterator {
+	return &boltIterator{db: db.db, pos: -1}
+}
+
+func (db *boltDB) NewIteratorWithStart(start []byte) Iterator {
+	return &boltIterator{db: db.db, pos: -1, start: common.CopyBytes(start)}
+}
+
+func (db *boltDB) NewIteratorWithPrefix(prefix []byte) Iterator {
+	prefix = common.CopyBytes(prefix)
+	return &boltIterator{db: db.db, pos: -1, start: prefix, prefix: prefix}
+}
+
+// NewSnapshot opens a read-only transaction, which is the snapshot. Writes
+// that need to grow the file wait until it is released.
+func (db *boltDB) NewSnapshot() (Snapshot, error) {
+	tx, err := db.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshot{tx: tx}, nil
+}
+
+// Compact does nothing, as BoltDB reuses the pages of deleted entries
+func (db *boltDB) Compact(start []byte, limit []byte) error {
+	return nil
+}
+
+// Stat returns no statistics, BoltDB has no properties
+func (db *boltDB) Stat(property string) (string, error) {
+	return "", nil
+}
+
+// boltOp is a write recorded in a boltBatch
+type boltOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// boltBatch is a write batch of a boltDB, written in a single transaction
+type boltBatch struct {
+	db   *bolt.DB
+	ops  []boltOp
+	size int
+}
+
+func (b *boltBatch) Put(key, value []byte) error {
+	b.ops = append(b.ops, boltOp{key: common.CopyBytes(key), value: common.CopyBytes(value)})
+	b.size += len(value)
+	return nil
+}
+
+func (b *boltBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, boltOp{key: common.CopyBytes(key), delete: true})
+	b.size++
+	return nil
+}
+
+func (b *boltBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *boltBatch) Write() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range b.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltBatch) Reset() {
+	b.ops = nil
+	b.size = 0
+}
+
+func (b *boltBatch) Replay(w ethdb.KeyValueWriter) error {
+	for _, op := range b.ops {
+		var err error
+		if op.delete {
+			err = w.Delete(op.key)
+		} else {
+			err = w.Put(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltIterator iterates over a boltDB, boltIteratorChunk entries at a time.
+// Each chunk is read after the last key of the previous one. The first chunk
+// starts at start, and the iteration stops at the first key without prefix.
+type boltIterator struct {
+	db     *bolt.DB
+	start  []byte
+	prefix []byte
+	keys   [][]byte
+	values [][]byte
+	pos    int
+	done   bool
+	err    error
+}
+
+func (it *boltIterator) Next() bool {
+	if it.pos+1 < len(it.keys) {
+		it.pos++
+		return true
+	}
+	if it.done || it.err != nil {
+		return false
+	}
+
+	var last []byte
+	if len(it.keys) > 0 {
+		last = it.keys[len(it.keys)-1]
+	}
+
+	it.keys, it.values, it.pos = nil, nil, 0
+	it.err = it.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+
+		var k, v []byte
+		if last == nil {
+			if it.start == nil {
+				k, v = c.First()
+			} else {
+				k, v = c.Seek(it.start)
+			}
+		} else if k, v = c.Seek(last); bytes.Equal(k, last) {
+			k, v = c.Next()
+		}
+
+		for ; k != nil && len(it.keys) < boltIteratorChunk; k, v = c.Next() {
+			if !bytes.HasPrefix(k, it.prefix) {
+				k = nil
+				break
+			}
+			it.keys = append(it.keys, common.CopyBytes(k))
+			it.values = append(it.values, common.CopyBytes(v))
+		}
+		it.done = k == nil
+
+		return nil
+	})
+
+	return it.err == nil && len(it.keys) > 0
+}
+
+func (it *boltIterator) Key() []byte {
+	return it.keys[it.pos]
+}
+
+func (it *boltIterator) Value() []byte {
+	return it.values[it.pos]
+}
+
+func (it *boltIterator) Error() error {
+	return it.err
+}
+
+func (it *boltIterator) Release() {
+	it.keys, it.values = nil, nil
+}
+
+// boltSnapshot is a Snapshot of a boltDB, backed by a read-only transaction
+type boltSnapshot struct {
+	tx *bolt.Tx
+}
+
+func (s *boltSnapshot) NewIterator() Iterator {
+	return &boltTxIterator{c: s.tx.Bucket(boltBucket).Cursor()}
+}
+
+func (s *boltSnapshot) Release() {
+	s.tx.Rollback()
+}
+
+// boltTxIterator iterates over the entries of a transaction
+type boltTxIterator struct {
+	c       *bolt.Cursor
+	key     []byte
+	value   []byte
+	started bool
+}
+
+func (it *boltTxIterator) Next() bool {
+	if it.c == nil {
+		return false
+	}
+	if !it.started {
+		it.key, it.value = it.c.First()
+		it.started = true
+	} else {
+		it.key, it.value = it.c.Next()
+	}
+	if it.key == nil {
+		it.c = nil
+		return false
+	}
+	return true
+}
+
+func (it *boltTxIterator) Key() []byte {
+	return it.key
+}
+
+func (it *boltTxIterator) Value() []byte {
+	return it.value
+}
+
+func (it *boltTxIterator) Error() error {
+	return nil
+}
+
+func (it *boltTxIterator) Release() {
+	it.c = nil
+}
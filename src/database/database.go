@@ -0,0 +1,85 @@
+// Package database provides the key-value stores that the State can be
+// persisted to. They all implement the Database interface, which extends
+// go-ethereum's ethdb.KeyValueStore with the snapshots needed to export,
+// restore, and prune the State.
+package database
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Backends
+const (
+	// LevelDB stores the database on disk, in a LevelDB directory. It is the
+	// default.
+	LevelDB = "leveldb"
+
+	// Memory keeps the database in memory, where it is lost when the process
+	// exits. It is meant for tests and ephemeral dev nodes.
+	Memory = "memory"
+
+	// Bolt stores the database on disk, in a single BoltDB file
+	Bolt = "bolt"
+)
+
+// ErrNotFound is returned by Get when a key is not in the database
+var ErrNotFound = errors.New("not found")
+
+// Database is a key-value store, safe for concurrent use, that can be read
+// and modified while iterating: the iterators may or may not see the
+// changes. Compact reclaims the space of the deleted entries, if the backend
+// needs to.
+type Database interface {
+	ethdb.KeyValueStore
+
+	// NewSnapshot returns a consistent, read-only view of the database. It
+	// holds resources until it is released.
+	NewSnapshot() (Snapshot, error)
+}
+
+// Iterator walks the entries of a Database or Snapshot, in key order. The key
+// and value slices are only valid until the next call to Next.
+type Iterator = ethdb.Iterator
+
+// Snapshot is a point-in-time view of a Database
+type Snapshot interface {
+	// NewIterator returns an iterator over all the entries of the snapshot,
+	// in key order
+	NewIterator() Iterator
+
+	Release()
+}
+
+// New opens a Database with the given backend. file is the LevelDB directory
+// or the BoltDB file, and is not used in memory. cache is the megabytes of
+// memory allocated to LevelDB's caches.
+func New(backend string, file string, cache int) (Database, error) {
+	switch backend {
+	case LevelDB:
+		handles, err := getFdLimit()
+		if err != nil {
+			return nil, err
+		}
+		return NewLevelDB(file, cache, handles)
+	case Memory:
+		return NewMemoryDB()
+	case Bolt:
+		return NewBoltDB(file)
+	default:
+		return nil, fmt.Errorf("unknown database backend %q", backend)
+	}
+}
+
+// getFdLimit retrieves the number of file descriptors allowed to be opened by this
+// process.
+func getFdLimit() (int, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return int(limit.Cur), nil
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDatabases opens an empty database of every backend. The returned
+// function closes them and deletes their files.
+func testDatabases(t *testing.T) (map[string]Database, func()) {
+	dir, err := ioutil.TempDir("", "shuffle-database")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbs := make(map[string]Database)
+	for _, backend := range []string{LevelDB, Memory, Bolt} {
+		db, err := New(backend, filepath.Join(dir, backend), 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs[backend] = db
+	}
+
+	return dbs, func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key-%05d", i))
+}
+
+func TestPutGetDelete(t *testing.T) {
+	dbs, cleanup := testDatabases(t)
+	defer cleanup()
+
+	for backend, db := range dbs {
+		if _, err := db.Get([]byte("missing")); err != ErrNotFound {
+			t.Fatalf("%s: Get of a missing key should return ErrNotFound, not %v", backend, err)
+		}
+
+		if err := db.Put([]byte("a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		value, err := db.Get([]byte("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(value, []byte("1")) {
+			t.Fatalf("%s: value should be 1, not %s", backend, value)
+		}
+		if ok, _ := db.Has([]byte("a")); !ok {
+			t.Fatalf("%s: key should exist", backend)
+		}
+
+		if err := db.Delete([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := db.Has([]byte("a")); ok {
+			t.Fatalf("%s: key should be deleted", backend)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	dbs, cleanup := testDatabases(t)
+	defer cleanup()
+
+	for backend, db := range dbs {
+		db.Put(key(0), []byte("old"))
+
+		batch := db.NewBatch()
+		batch.Put(key(1), []byte("new"))
+		batch.Delete(key(0))
+
+		if ok, _ := db.Has(key(1)); ok {
+			t.Fatalf("%s: batch should not be written before Write", backend)
+		}
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := db.Has(key(1)); !ok {
+			t.Fatalf("%s: batch should be written", backend)
+		}
+		if ok, _ := db.Has(key(0)); ok {
+			t.Fatalf("%s: batch should delete the key", backend)
+		}
+
+		batch.Reset()
+		if batch.ValueSize() != 0 {
+			t.Fatalf("%s: batch should be empty after Reset", backend)
+		}
+	}
+}
+
+func TestIterator(t *testing.T) {
+	dbs, cleanup := testDatabases(t)
+	defer cleanup()
+
+	// More entries than a BoltDB iterator reads at once
+	count := 2*boltIteratorChunk + 10
+
+	for backend, db := range dbs {
+		batch := db.NewBatch()
+		for i := count - 1; i >= 0; i-- {
+			batch.Put(key(i), []byte{byte(i)})
+		}
+		if err := batch.Write(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Delete every entry while iterating, as the State does when it prunes
+		// or wipes the database
+		it := db.NewIterator()
+		i := 0
+		for ; it.Next(); i++ {
+			if !bytes.Equal(it.Key(), key(i)) {
+				t.Fatalf("%s: key %d should be %s, not %s", backend, i, key(i), it.Key())
+			}
+			if !bytes.Equal(it.Value(), []byte{byte(i)}) {
+				t.Fatalf("%s: value of key %d should be %d, not %v", backend, i, i, it.Value())
+			}
+			if err := db.Delete(it.Key()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := it.Error(); err != nil {
+			t.Fatal(err)
+		}
+		it.Release()
+
+		if i != count {
+			t.Fatalf("%s: iterator should return %d entries, not %d", backend, count, i)
+		}
+		if err := db.Compact(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIteratorRange(t *testing.T) {
+	dbs, cleanup := testDatabases(t)
+	defer cleanup()
+
+	for backend, db := range dbs {
+		for i := 0; i < 30; i++ {
+			db.Put(key(i), []byte{byte(i)})
+		}
+		db.Put([]byte("other"), []byte{})
+
+		collect := func(it Iterator) [][]byte {
+			defer it.Release()
+			var keys [][]byte
+			for it.Next() {
+				keys = append(keys, append([]byte{}, it.Key()...))
+			}
+			if err := it.Error(); err != nil {
+				t.Fatal(err)
+			}
+			return keys
+		}
+
+		keys := collect(db.NewIteratorWithPrefix([]byte("key-0001")))
+		if len(keys) != 10 || !bytes.Equal(keys[0], key(10)) || !bytes.Equal(keys[9], key(19)) {
+			t.Fatalf("%s: prefix iterator should return %s to %s, not %s", backend, key(10), key(19), keys)
+		}
+
+		keys = collect(db.NewIteratorWithStart(key(25)))
+		if len(keys) != 6 || !bytes.Equal(keys[0], key(25)) || !bytes.Equal(keys[5], []byte("other")) {
+			t.Fatalf("%s: iterator should start at %s, got %s", backend, key(25), keys)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dbs, cleanup := testDatabases(t)
+	defer cleanup()
+
+	for backend, db := range dbs {
+		db.Put(key(0), []byte("a"))
+		db.Put(key(1), []byte("b"))
+
+		snap, err := db.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Changes after the snapshot are not part of it. Run them in the
+		// background, as BoltDB may wait for the snapshot to be released.
+		done := make(chan error)
+		go func() {
+			if err := db.Delete(key(0)); err != nil {
+				done <- err
+				return
+			}
+			done <- db.Put(key(2), []byte("c"))
+		}()
+
+		var keys [][]byte
+		it := snap.NewIterator()
+		for it.Next() {
+			keys = append(keys, append([]byte{}, it.Key()...))
+		}
+		it.Release()
+		snap.Release()
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 2 || !bytes.Equal(keys[0], key(0)) || !bytes.Equal(keys[1], key(1)) {
+			t.Fatalf("%s: snapshot should contain %s and %s, not %s", backend, key(0), key(1), keys)
+		}
+		if ok, _ := db.Has(key(2)); !ok {
+			t.Fatalf("%s: database should be written after the snapshot is released", backend)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelDB is a Database backed by LevelDB, on disk or in memory
+type levelDB struct {
+	db *leveldb.DB
+}
+
+// NewLevelDB opens the LevelDB database in the given directory, with the same
+// options as go-ethereum's ethdb.NewLDBDatabase. A corrupted database is
+// recovered.
+func NewLevelDB(file string, cache int, handles int) (Database, error) {
+	// Ensure we have some minimal caching and file guarantees
+	if cache < 16 {
+		cache = 16
+	}
+	if handles < 16 {
+		handles = 16
+	}
+
+	db, err := leveldb.OpenFile(file, &opt.Options{
+		OpenFilesCacheCapacity: handles,
+		BlockCacheCapacity:     cache / 2 * opt.MiB,
+		WriteBuffer:            cache / 4 * opt.MiB, // Two of these are used internally
+		Filter:                 filter.NewBloomFilter(10),
+	})
+	if _, corrupted := err.(*errors.ErrCorrupted); corrupted {
+		db, err = leveldb.RecoverFile(file, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &levelDB{db: db}, nil
+}
+
+// NewMemoryDB returns an empty LevelDB database that lives in memory
+func NewMemoryDB() (Database, error) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDB{db: db}, nil
+}
+
+func (db *levelDB) Put(key []byte, value []byte) error {
+	return db.db.Put(key, value, nil)
+}
+
+func (db *levelDB) Has(key []byte) (bool, error) {
+	return db.db.Has(key, nil)
+}
+
+func (db *levelDB) Get(key []byte) ([]byte, error) {
+	data, err := db.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (db *levelDB) Delete(key []byte) error {
+	return db.db.Delete(key, nil)
+}
+
+func (db *levelDB) Close() error {
+	return db.db.Close()
+}
+
+func (db *levelDB) NewBatch() ethdb.Batch {
+	return &levelBatch{db: db.db, b: new(leveldb.Batch)}
+}
+
+func (db *levelDB) NewIterator() Iterator {
+	return db.db.NewIterator(nil, nil)
+}
+
+func (db *levelDB) NewIteratorWithStart(start []byte) Iterator {
+	return db.db.NewIterator(&util.Range{Start: start}, nil)
+}
+
+func (db *levelDB) NewIteratorWithPrefix(prefix []byte) Iterator {
+	return db.db.NewIterator(util.BytesPrefix(prefix), nil)
+}
+
+func (db *levelDB) NewSnapshot() (Snapshot, error) {
+	snap, err := db.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &levelSnapshot{snap: snap}, nil
+}
+
+func (db *levelDB) Compact(start []byte, limit []byte) error {
+	return db.db.CompactRange(util.Range{Start: start, Limit: limit})
+}
+
+// Stat returns the LevelDB property, e.g. "leveldb.stats"
+func (db *levelDB) Stat(property string) (string, error) {
+	return db.db.GetProperty(property)
+}
+
+// levelBatch is a write batch of a levelDB
+type levelBatch struct {
+	db   *leveldb.DB
+	b    *leveldb.Batch
+	size int
+}
+
+func (b *levelBatch) Put(key, value []byte) error {
+	b.b.Put(key, value)
+	b.size += len(value)
+	return nil
+}
+
+func (b *levelBatch) Delete(key []byte) error {
+	b.b.Delete(key)
+	b.size++
+	return nil
+}
+
+func (b *levelBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *levelBatch) Write() error {
+	return b.db.Write(b.b, nil)
+}
+
+func (b *levelBatch) Reset() {
+	b.b.Reset()
+	b.size = 0
+}
+
+func (b *levelBatch) Replay(w ethdb.KeyValueWriter) error {
+	r := &levelReplayer{w: w}
+	if err := b.b.Replay(r); err != nil {
+		return err
+	}
+	return r.err
+}
+
+// levelReplayer replays the writes of a levelBatch to a KeyValueWriter, and
+// stops at the first error
+type levelReplayer struct {
+	w   ethdb.KeyValueWriter
+	err error
+}
+
+func (r *levelReplayer) Put(key, value []byte) {
+	if r.err == nil {
+		r.err = r.w.Put(key, value)
+	}
+}
+
+func (r *levelReplayer) Delete(key []byte) {
+	if r.err == nil {
+		r.err = r.w.Delete(key)
+	}
+}
+
+// levelSnapshot is a Snapshot of a levelDB
+type levelSnapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (s *levelSnapshot) NewIterator() Iterator {
+	return s.snap.NewIterator(nil, nil)
+}
+
+func (s *levelSnapshot) Release() {
+	s.snap.Release()
+}
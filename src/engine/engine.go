@@ -1,10 +1,17 @@
 package engine
 
 import (
+	"fmt"
+	"math/big"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/abassian/shuffle/src/config"
 	"github.com/abassian/shuffle/src/consensus"
 	"github.com/abassian/shuffle/src/service"
 	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/sirupsen/logrus"
 )
 
@@ -13,6 +20,7 @@ type Engine struct {
 	state     *state.State
 	service   *service.Service
 	consensus consensus.Consensus
+	logger    *logrus.Logger
 }
 
 // NewEngine instantiates a new Engine with coupled State, Service, and Consensus
@@ -22,15 +30,27 @@ func NewEngine(config config.Config,
 	submitCh := make(chan []byte)
 
 	state, err := state.NewState(logger,
+		config.Eth.DbBackend,
 		config.Eth.DbFile,
 		config.Eth.Cache,
-		config.Eth.Genesis)
+		config.Eth.Genesis,
+		config.Eth.Archive,
+		config.Eth.Retention)
 	if err != nil {
 
 		logger.Debug("engine.go:NewEngine() NewStart")
 		return nil, err
 	}
 
+	if config.Eth.Coinbase != "" {
+		if !common.IsHexAddress(config.Eth.Coinbase) {
+			return nil, fmt.Errorf("invalid coinbase %q", config.Eth.Coinbase)
+		}
+		state.SetCoinbase(common.HexToAddress(config.Eth.Coinbase))
+	}
+	state.SetMinGasPrice(new(big.Int).SetUint64(config.Eth.MinGasPrice))
+	state.SetTxPoolLimits(config.Eth.TxPoolSize, config.Eth.TxLifetime)
+
 	service := service.NewService(config.Eth.Keystore,
 		config.Eth.EthAPIAddr,
 		config.Eth.PwdFile,
@@ -49,18 +69,40 @@ func NewEngine(config config.Config,
 		state:     state,
 		service:   service,
 		consensus: consensus,
+		logger:    logger,
 	}
 
 	return engine, nil
 }
 
-// Run starts the engine's Service asynchronously and starts the Consensus system
-// synchronously
+// Run starts the engine's Service asynchronously and runs the Consensus system
+// until it stops, or until the process is interrupted or terminated. The
+// State is then closed, which writes the state of the head block to disk.
 func (e *Engine) Run() error {
 
 	go e.service.Run()
 
-	e.consensus.Run()
+	done := make(chan error, 1)
+	go func() {
+		done <- e.consensus.Run()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	var err error
+	select {
+	case err = <-done:
+	case sig := <-sigCh:
+		e.logger.WithField("signal", sig).Info("Shutting down")
+		e.consensus.Shutdown()
+		err = <-done
+	}
+
+	if closeErr := e.state.Close(); err == nil {
+		err = closeErr
+	}
 
-	return nil
+	return err
 }
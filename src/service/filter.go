@@ -0,0 +1,91 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// FilterCriteria is the filter object of the Ethereum JSON-RPC API. It selects
+// logs by block range, emitting contract, and topics. FromBlock and ToBlock are
+// block numbers or tags, as accepted by parseBlockNumber; when BlockHash is
+// set, they are ignored.
+type FilterCriteria struct {
+	FromBlock string
+	ToBlock   string
+	BlockHash *common.Hash
+
+	state.LogFilter
+}
+
+// UnmarshalJSON accepts an address that is a single address or an array, and
+// topics that are null, a single topic, or an array of topics.
+func (fc *FilterCriteria) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		FromBlock string            `json:"fromBlock"`
+		ToBlock   string            `json:"toBlock"`
+		BlockHash *common.Hash      `json:"blockHash"`
+		Address   json.RawMessage   `json:"address"`
+		Topics    []json.RawMessage `json:"topics"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	fc.FromBlock = raw.FromBlock
+	fc.ToBlock = raw.ToBlock
+	fc.BlockHash = raw.BlockHash
+
+	addresses, err := unmarshalAddresses(raw.Address)
+	if err != nil {
+		return fmt.Errorf("invalid address: %v", err)
+	}
+	fc.Addresses = addresses
+
+	fc.Topics = make([][]common.Hash, len(raw.Topics))
+	for i, t := range raw.Topics {
+		topics, err := unmarshalTopics(t)
+		if err != nil {
+			return fmt.Errorf("invalid topic %d: %v", i, err)
+		}
+		fc.Topics[i] = topics
+	}
+
+	return nil
+}
+
+func unmarshalAddresses(raw json.RawMessage) ([]common.Address, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var address common.Address
+	if err := json.Unmarshal(raw, &address); err == nil {
+		return []common.Address{address}, nil
+	}
+
+	var addresses []common.Address
+	if err := json.Unmarshal(raw, &addresses); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+func unmarshalTopics(raw json.RawMessage) ([]common.Hash, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var topic common.Hash
+	if err := json.Unmarshal(raw, &topic); err == nil {
+		return []common.Hash{topic}, nil
+	}
+
+	var topics []common.Hash
+	if err := json.Unmarshal(raw, &topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
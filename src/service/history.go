@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strconv"
+
+	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+)
+
+// stateReader answers account queries and calls. It is implemented by the
+// State, for the latest state, and by HistoricalState.
+type stateReader interface {
+	GetBalance(addr common.Address) *big.Int
+	GetNonce(addr common.Address) uint64
+	GetCode(addr common.Address) []byte
+	GetStorageAt(addr common.Address, key common.Hash) common.Hash
+	GetProof(addr common.Address, keys []common.Hash) (*state.AccountProof, error)
+	Call(callMsg ethTypes.Message) ([]byte, error)
+	EstimateGas(msg ethTypes.Message) (uint64, error)
+	TraceCall(callMsg ethTypes.Message, config *state.TraceConfig) (*state.TraceResult, error)
+}
+
+// blockParam is the block parameter of the JSON-RPC state accessors. It is
+// either a block number or tag, or an object as per EIP-1898 that selects a
+// block by number or hash. The object may also select a state by its root,
+// which is specific to Shuffle.
+type blockParam struct {
+	Number    string
+	BlockHash *common.Hash
+	StateRoot *common.Hash
+}
+
+func (b *blockParam) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &b.Number); err == nil {
+		return nil
+	}
+
+	var obj struct {
+		BlockNumber string       `json:"blockNumber"`
+		BlockHash   *common.Hash `json:"blockHash"`
+		StateRoot   *common.Hash `json:"stateRoot"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+
+	b.Number = obj.BlockNumber
+	b.BlockHash = obj.BlockHash
+	b.StateRoot = obj.StateRoot
+
+	return nil
+}
+
+// isLatest returns true if the parameter selects the latest state
+func (b *blockParam) isLatest() bool {
+	if b.BlockHash != nil || b.StateRoot != nil {
+		return false
+	}
+	switch b.Number {
+	case "", "latest", "pending":
+		return true
+	}
+	return false
+}
+
+// stateAt returns the state selected by a JSON-RPC block parameter. Past
+// states are only available in archive mode.
+func (m *Service) stateAt(b blockParam) (stateReader, error) {
+	switch {
+	case b.isLatest():
+		return m.state, nil
+	case b.StateRoot != nil:
+		return m.state.StateAtRoot(*b.StateRoot)
+	case b.BlockHash != nil:
+		block, err := m.state.GetBlockByHash(*b.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		return m.state.StateAtBlock(block.Number)
+	}
+
+	number, err := parseBlockNumber(m, b.Number)
+	if err != nil {
+		return nil, err
+	}
+	return m.state.StateAtBlock(number)
+}
+
+// queryState returns the state selected by the block or root query parameter
+// of a REST request, or the latest state if there is none. The block is a
+// decimal or hexadecimal number, the root a hash.
+func queryState(r *http.Request, m *Service) (stateReader, error) {
+	query := r.URL.Query()
+
+	if root := query.Get("root"); root != "" {
+		return m.state.StateAtRoot(common.HexToHash(root))
+	}
+
+	if block := query.Get("block"); block != "" {
+		number, err := strconv.ParseUint(block, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		return m.state.StateAtBlock(number)
+	}
+
+	return m.state, nil
+}
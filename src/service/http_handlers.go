@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"math/big"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
@@ -23,11 +25,16 @@ import (
 /*
 GET /account/{address}
 example: /account/0x50bd8a037442af4cdf631495bcaa5443de19685d
+example: /account/0x50bd8a037442af4cdf631495bcaa5443de19685d?block=12
 returns: JSON JsonAccount
 
 This endpoint should be used to fetch information about ANY account as opposed
 to the /accounts/ endpoint which only returns information about accounts for which
 the private key is known and managed by the shuffle Service.
+
+The optional block or root query parameter selects the state of a past block,
+or a state by its root, instead of the latest state. Past states are only
+available when shuffle runs in archive mode (--eth.archive).
 */
 func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	param := r.URL.Path[len("/account/"):]
@@ -35,9 +42,16 @@ func accountHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	address := common.HexToAddress(param)
 	m.logger.WithField("address", address.Hex()).Debug("GET account")
 
-	balance := m.state.GetBalance(address)
-	nonce := m.state.GetNonce(address)
-	code := hexutil.Encode(m.state.GetCode(address))
+	st, err := queryState(r, m)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting State")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	balance := st.GetBalance(address)
+	nonce := st.GetNonce(address)
+	code := hexutil.Encode(st.GetCode(address))
 	if code == "0x" {
 		code = ""
 	} else {
@@ -105,6 +119,7 @@ func accountsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 
 /*
 POST /call
+POST /call?block=12
 data: JSON SendTxArgs
 returns: JSON JsonCallRes
 
@@ -112,6 +127,9 @@ This endpoints allows calling SmartContract code for READONLY operations. These
 calls will NOT modify the EVM state.
 
 The data does NOT need to be signed.
+
+Like with /account, the block or root query parameter executes the call on a
+past state, in archive mode.
 */
 func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	m.logger.WithField("request", r).Debug("POST call")
@@ -133,7 +151,14 @@ func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 		return
 	}
 
-	data, err := m.state.Call(*callMessage)
+	st, err := queryState(r, m)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting State")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := st.Call(*callMessage)
 	if err != nil {
 		m.logger.WithError(err).Error("Executing Call")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -152,6 +177,50 @@ func callHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	w.Write(js)
 }
 
+/*
+POST /estimate
+data: JSON SendTxArgs
+returns: JSON JsonEstimateRes
+
+This endpoint returns the gas that a transaction needs to execute without
+failing, given the transactions that were submitted before it. It executes the
+transaction with increasingly accurate gas limits, up to the gas of the
+SendTxArgs if it is set, and up to the block gas limit otherwise.
+
+The data does NOT need to be signed.
+*/
+func estimateHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.WithField("request", r).Debug("POST estimate")
+
+	decoder := json.NewDecoder(r.Body)
+	var txArgs SendTxArgs
+	err := decoder.Decode(&txArgs)
+	if err != nil {
+		m.logger.WithError(err).Error("Decoding JSON txArgs")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	gas, err := estimateGas(txArgs, m.state, m.state)
+	if err != nil {
+		m.logger.WithError(err).Error("Estimating Gas")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := JsonEstimateRes{Gas: gas}
+	js, err := json.Marshal(res)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 /*
 POST /tx
 data: JSON SendTxArgs
@@ -187,40 +256,12 @@ func transactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	}
 	defer r.Body.Close()
 
-	tx, err := prepareTransaction(txArgs, m.state, m.keyStore)
-	if err != nil {
-		m.logger.WithError(err).Error("Preparing Transaction")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	m.logger.WithFields(logrus.Fields{
-		"hash":     tx.Hash().Hex(),
-		"to":       tx.To(),
-		"payload":  fmt.Sprintf("%x", tx.Data()),
-		"gas":      tx.Gas(),
-		"gasPrice": tx.GasPrice(),
-		"nonce":    tx.Nonce(),
-		"value":    tx.Value(),
-	}).Debug("Service decoded tx")
-
-	if err := m.state.CheckTx(tx); err != nil {
-		m.logger.WithError(err).Error("Checking Transaction")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	data, err := rlp.EncodeToBytes(tx)
+	tx, err := m.sendTx(txArgs)
 	if err != nil {
-		m.logger.WithError(err).Error("Encoding Transaction")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	m.logger.Debug("submitting tx")
-	m.submitCh <- data
-	m.logger.Debug("submitted tx")
-
 	res := JsonTxRes{TxHash: tx.Hash().Hex()}
 	js, err := json.Marshal(res)
 	if err != nil {
@@ -288,16 +329,11 @@ func rawTransactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 		"value":    t.Value(),
 	}).Debug("Service decoded tx")
 
-	if err := m.state.CheckTx(&t); err != nil {
-		m.logger.WithError(err).Error("Checking Transaction")
+	if err := m.submitTx(&t); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	m.logger.Debug("submitting tx")
-	m.submitCh <- rawTxBytes
-	m.logger.Debug("submitted tx")
-
 	res := JsonTxRes{TxHash: t.Hash().Hex()}
 	js, err := json.Marshal(res)
 	if err != nil {
@@ -321,6 +357,10 @@ exists. When a transaction is applied to the EVM , a receipt is saved to allow
 checking if/how the transaction affected the state. This is where one can see such
 information as the address of a newly created contract, how much gas was use and
 the EVM Logs produced by the execution of the transaction.
+
+A transaction that was ordered by the consensus system, but could not be
+applied, like one with a wrong nonce, has a receipt with status 2 and the
+reason in the error field. It did not change the state.
 */
 func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Service) {
 	param := r.URL.Path[len("/tx/"):]
@@ -329,6 +369,10 @@ func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Servic
 
 	tx, err := m.state.GetTransaction(txHash)
 	if err != nil {
+		if rejected, rerr := m.state.GetRejectedTx(txHash); rerr == nil {
+			writeRejectedReceipt(w, m, rejected)
+			return
+		}
 		m.logger.WithError(err).Error("Getting Transaction")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -341,16 +385,25 @@ func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Servic
 		return
 	}
 
-	signer := ethTypes.NewEIP155Signer(big.NewInt(1))
-	from, err := ethTypes.Sender(signer, tx)
+	from, err := ethTypes.Sender(m.state.GetSigner(), tx)
 	if err != nil {
 		m.logger.WithError(err).Error("Getting Tx Sender")
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	txLookup, err := m.state.GetTxLookupEntry(txHash)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Transaction location")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	jsonReceipt := JsonReceipt{
 		Root:              common.BytesToHash(receipt.PostState),
+		BlockHash:         txLookup.BlockHash,
+		BlockNumber:       txLookup.BlockNumber,
+		TransactionIndex:  txLookup.Index,
 		TransactionHash:   txHash,
 		From:              from,
 		To:                tx.To(),
@@ -377,6 +430,159 @@ func transactionReceiptHandler(w http.ResponseWriter, r *http.Request, m *Servic
 	w.Write(js)
 }
 
+// writeRejectedReceipt writes the receipt of a rejected transaction. The sender
+// is left empty if the signature is the reason it was rejected.
+func writeRejectedReceipt(w http.ResponseWriter, m *Service, rejected *state.RejectedTx) {
+	from, _ := ethTypes.Sender(m.state.GetSigner(), rejected.Tx)
+
+	jsonReceipt := JsonReceipt{
+		BlockHash:       rejected.BlockHash,
+		BlockNumber:     rejected.BlockNumber,
+		TransactionHash: rejected.Tx.Hash(),
+		From:            from,
+		To:              rejected.Tx.To(),
+		Logs:            []*ethTypes.Log{},
+		Status:          state.ReceiptStatusRejected,
+		Error:           rejected.Reason,
+	}
+
+	js, err := json.Marshal(jsonReceipt)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+/*
+GET /block/{number_or_hash}
+ex: /block/12
+ex: /block/0x5c5b6ca9a2b3fd3bc48e8add3c4a4758b2dc0b66c9d50d45fdbf5a1ee8d7e3d5
+returns: JSON JsonBlock
+
+This endpoint returns a block, identified by number or hash, with the hashes of
+the transactions it contains. A block is produced every time the consensus
+system commits transactions to the State.
+*/
+func blockHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	param := r.URL.Path[len("/block/"):]
+	m.logger.WithField("param", param).Debug("GET block")
+
+	var block *state.Block
+	var err error
+	if len(param) == 2*common.HashLength+2 {
+		block, err = m.state.GetBlockByHash(common.HexToHash(param))
+	} else {
+		var number uint64
+		number, err = strconv.ParseUint(param, 0, 64)
+		if err != nil {
+			m.logger.WithError(err).Error("Parsing block number")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		block, err = m.state.GetBlockByNumber(number)
+	}
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Block")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonBlock := JsonBlock{
+		Number:         block.Number,
+		Hash:           block.Hash(),
+		ParentHash:     block.ParentHash,
+		StateRoot:      block.StateRoot,
+		ReceiptsRoot:   block.ReceiptsRoot,
+		LogsBloom:      block.LogsBloom,
+		GasUsed:        block.GasUsed,
+		Coinbase:       block.Coinbase,
+		Timestamp:      block.Timestamp,
+		Transactions:   block.TxHashes,
+		Consensus:      block.Consensus,
+		ConsensusIndex: block.ConsensusIndex,
+		ConsensusHash:  block.ConsensusHash,
+	}
+
+	if jsonBlock.Transactions == nil {
+		jsonBlock.Transactions = []common.Hash{}
+	}
+
+	js, err := json.Marshal(jsonBlock)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+/*
+GET /logs
+ex: /logs?fromBlock=0&toBlock=latest&address=0xabbaabbaabbaabbaabbaabbaabbaabbaabbaabba
+ex: /logs?blockHash=0x5c5b...&topic0=0xaaaa...,0xbbbb...&topic2=0xcccc...
+returns: JSON []Log
+
+This endpoint returns the logs that match a filter, like eth_getLogs. The
+address parameter can be repeated to select several contracts. topic0 to topic3
+select logs by topic in the corresponding position; each accepts a
+comma-separated list of alternatives. The blocks that cannot contain matching
+logs are skipped using the bloom index.
+*/
+func logsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	query := r.URL.Query()
+	m.logger.WithField("query", query.Encode()).Debug("GET logs")
+
+	criteria := FilterCriteria{
+		FromBlock: query.Get("fromBlock"),
+		ToBlock:   query.Get("toBlock"),
+	}
+
+	if hash := query.Get("blockHash"); hash != "" {
+		blockHash := common.HexToHash(hash)
+		criteria.BlockHash = &blockHash
+	}
+
+	for _, address := range query["address"] {
+		criteria.Addresses = append(criteria.Addresses, common.HexToAddress(address))
+	}
+
+	for i := 0; i < 4; i++ {
+		param := query.Get(fmt.Sprintf("topic%d", i))
+		if param == "" {
+			continue
+		}
+		for len(criteria.Topics) <= i {
+			criteria.Topics = append(criteria.Topics, nil)
+		}
+		for _, topic := range strings.Split(param, ",") {
+			criteria.Topics[i] = append(criteria.Topics[i], common.HexToHash(topic))
+		}
+	}
+
+	logs, err := m.getLogs(criteria)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Logs")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(logs)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
 /*
 GET /info
 returns: JSON (depends on underlying consensus system)
@@ -538,6 +744,11 @@ func prepareCallMessage(args SendTxArgs, ks *keystore.KeyStore) (*ethTypes.Messa
 }
 
 func prepareTransaction(args SendTxArgs, state *state.State, ks *keystore.KeyStore) (*ethTypes.Transaction, error) {
+	// Pay the lowest price that this node accepts
+	if args.GasPrice == nil {
+		args.GasPrice = state.GetMinGasPrice()
+	}
+
 	var err error
 	args, err = prepareSendTxArgs(args)
 	if err != nil {
@@ -549,6 +760,13 @@ func prepareTransaction(args SendTxArgs, state *state.State, ks *keystore.KeySto
 		*args.Nonce = state.GetPoolNonce(args.From)
 	}
 
+	if args.Gas == 0 {
+		args.Gas, err = estimateGas(args, state, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var tx *ethTypes.Transaction
 	if args.To == nil {
 		tx = ethTypes.NewContractCreation(*args.Nonce,
@@ -565,7 +783,7 @@ func prepareTransaction(args SendTxArgs, state *state.State, ks *keystore.KeySto
 			common.FromHex(args.Data))
 	}
 
-	signer := ethTypes.NewEIP155Signer(big.NewInt(1))
+	signer := state.GetSigner()
 
 	account, err := ks.Find(accounts.Account{Address: args.From})
 	if err != nil {
@@ -583,10 +801,41 @@ func prepareTransaction(args SendTxArgs, state *state.State, ks *keystore.KeySto
 	return signedTx, nil
 }
 
-func prepareSendTxArgs(args SendTxArgs) (SendTxArgs, error) {
-	if args.Gas == 0 {
+// estimateGas returns the gas needed to execute the transaction described by
+// args on st: on top of the TxPool's state if st is the State itself,
+// otherwise on a historical state. A non-zero args.Gas caps the estimation.
+func estimateGas(args SendTxArgs, state *state.State, st stateReader) (uint64, error) {
+	if args.GasPrice == nil {
+		args.GasPrice = state.GetMinGasPrice()
+	}
+
+	var err error
+	args, err = prepareSendTxArgs(args)
+	if err != nil {
+		return 0, err
+	}
 
+	nonce := st.GetNonce(args.From)
+	if st == stateReader(state) {
+		nonce = state.GetPoolNonce(args.From)
+	}
+	if args.Nonce != nil {
+		nonce = *args.Nonce
 	}
+
+	msg := ethTypes.NewMessage(args.From,
+		args.To,
+		nonce,
+		args.Value,
+		args.Gas,
+		args.GasPrice,
+		common.FromHex(args.Data),
+		false)
+
+	return st.EstimateGas(msg)
+}
+
+func prepareSendTxArgs(args SendTxArgs) (SendTxArgs, error) {
 	if args.GasPrice == nil {
 		args.GasPrice = big.NewInt(0)
 	}
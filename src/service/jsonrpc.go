@@ -0,0 +1,220 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+const jsonrpcVersion = "2.0"
+
+// Error codes defined by the JSON-RPC 2.0 specification. Errors returned by
+// the methods themselves (failed calls, rejected transactions, etc.) use the
+// server-error code, as go-ethereum does.
+const (
+	errCodeParse          = -32700
+	errCodeInvalidRequest = -32600
+	errCodeMethodNotFound = -32601
+	errCodeInvalidParams  = -32602
+	errCodeInternal       = -32603
+	errCodeServer         = -32000
+)
+
+type jsonrpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *jsonrpcError) Error() string {
+	return e.Message
+}
+
+// invalidParams wraps an error caused by the request parameters so that it is
+// reported with the appropriate JSON-RPC error code.
+func invalidParams(format string, args ...interface{}) error {
+	return &jsonrpcError{
+		Code:    errCodeInvalidParams,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// jsonrpcMethod is the signature of the functions implementing JSON-RPC
+// methods. The returned value is marshalled into the result field of the
+// response.
+type jsonrpcMethod func(m *Service, params json.RawMessage) (interface{}, error)
+
+/*
+POST /rpc (also accepted on POST /)
+data: JSON-RPC 2.0 request or batch of requests
+returns: JSON-RPC 2.0 response or batch of responses
+
+This endpoint implements the subset of the Ethereum JSON-RPC API that makes
+sense for shuffle, so that standard tooling (web3.js, ethers, Truffle, etc.)
+can talk to a node directly. The supported methods are listed in
+jsonrpc_api.go.
+*/
+func jsonrpcHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("POST rpc")
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		m.logger.WithError(err).Error("Reading request body")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var res interface{}
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			res = newJSONRPCErrorResponse(nil, errCodeParse, err.Error())
+		} else if len(batch) == 0 {
+			res = newJSONRPCErrorResponse(nil, errCodeInvalidRequest, "empty batch")
+		} else {
+			responses := []*jsonrpcResponse{}
+			for _, raw := range batch {
+				if resp := m.handleJSONRPCMessage(raw); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				res = responses
+			}
+		}
+	} else {
+		if resp := m.handleJSONRPCMessage(body); resp != nil {
+			res = resp
+		}
+	}
+
+	// A request made only of notifications does not get a response
+	if res == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	js, err := json.Marshal(res)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// handleJSONRPCMessage decodes and executes a single JSON-RPC request. It
+// returns nil if the request is a notification.
+func (m *Service) handleJSONRPCMessage(raw json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return newJSONRPCErrorResponse(nil, errCodeParse, err.Error())
+		}
+		return newJSONRPCErrorResponse(nil, errCodeInvalidRequest, err.Error())
+	}
+
+	if req.Version != jsonrpcVersion || req.Method == "" {
+		return newJSONRPCErrorResponse(req.ID, errCodeInvalidRequest, "invalid request")
+	}
+
+	m.logger.WithField("method", req.Method).Debug("JSON-RPC")
+
+	result, err := m.callJSONRPCMethod(req.Method, req.Params)
+
+	// Notifications are executed but never answered
+	if req.ID == nil {
+		return nil
+	}
+
+	if err != nil {
+		if rpcErr, ok := err.(*jsonrpcError); ok {
+			return newJSONRPCErrorResponse(req.ID, rpcErr.Code, rpcErr.Message)
+		}
+		return newJSONRPCErrorResponse(req.ID, errCodeServer, err.Error())
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON-RPC result")
+		return newJSONRPCErrorResponse(req.ID, errCodeInternal, err.Error())
+	}
+
+	return &jsonrpcResponse{
+		Version: jsonrpcVersion,
+		ID:      req.ID,
+		Result:  js,
+	}
+}
+
+func (m *Service) callJSONRPCMethod(method string, params json.RawMessage) (interface{}, error) {
+	fn, ok := jsonrpcMethods[method]
+	if !ok {
+		return nil, &jsonrpcError{
+			Code:    errCodeMethodNotFound,
+			Message: fmt.Sprintf("the method %s does not exist/is not available", method),
+		}
+	}
+	return fn(m, params)
+}
+
+func newJSONRPCErrorResponse(id json.RawMessage, code int, message string) *jsonrpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{
+		Version: jsonrpcVersion,
+		ID:      id,
+		Error: &jsonrpcError{
+			Code:    code,
+			Message: message,
+		},
+	}
+}
+
+// parseParams unmarshals positional JSON-RPC parameters into args. The first
+// required arguments must be present; the remaining ones are optional and are
+// left untouched when omitted.
+func parseParams(params json.RawMessage, required int, args ...interface{}) error {
+	var raw []json.RawMessage
+	if len(params) > 0 && string(params) != "null" {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return invalidParams("non-array params: %v", err)
+		}
+	}
+
+	if len(raw) < required {
+		return invalidParams("missing value for required argument %d", len(raw))
+	}
+	if len(raw) > len(args) {
+		return invalidParams("too many arguments, want at most %d", len(args))
+	}
+
+	for i, r := range raw {
+		if err := json.Unmarshal(r, args[i]); err != nil {
+			return invalidParams("invalid argument %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,441 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/abassian/shuffle/src/state"
+	"github.com/abassian/shuffle/src/version"
+)
+
+// jsonrpcMethods maps the supported Ethereum JSON-RPC methods to their
+// implementation.
+//
+// The block parameters of the state accessors select a past state only in
+// archive mode; otherwise they must resolve to the latest committed state.
+var jsonrpcMethods map[string]jsonrpcMethod
+
+func init() {
+	jsonrpcMethods = map[string]jsonrpcMethod{
+		"web3_clientVersion":        web3ClientVersion,
+		"net_version":               netVersion,
+		"eth_chainId":               ethChainID,
+		"eth_gasPrice":              ethGasPrice,
+		"eth_accounts":              ethAccounts,
+		"eth_blockNumber":           ethBlockNumber,
+		"eth_getBlockByNumber":      ethGetBlockByNumber,
+		"eth_getBlockByHash":        ethGetBlockByHash,
+		"eth_getBalance":            ethGetBalance,
+		"eth_getTransactionCount":   ethGetTransactionCount,
+		"eth_getCode":               ethGetCode,
+		"eth_getStorageAt":          ethGetStorageAt,
+		"eth_getProof":              ethGetProof,
+		"eth_call":                  ethCall,
+		"eth_estimateGas":           ethEstimateGas,
+		"eth_sendTransaction":       ethSendTransaction,
+		"eth_sendRawTransaction":    ethSendRawTransaction,
+		"eth_getTransactionByHash":  ethGetTransactionByHash,
+		"eth_getTransactionReceipt": ethGetTransactionReceipt,
+		"eth_getLogs":               ethGetLogs,
+		"eth_newFilter":             ethNewFilter,
+		"eth_newBlockFilter":        ethNewBlockFilter,
+		"eth_getFilterChanges":      ethGetFilterChanges,
+		"eth_getFilterLogs":         ethGetFilterLogs,
+		"eth_uninstallFilter":       ethUninstallFilter,
+		"debug_traceTransaction":    debugTraceTransaction,
+		"debug_traceCall":           debugTraceCall,
+		"txpool_status":             txpoolStatus,
+	}
+}
+
+func web3ClientVersion(m *Service, params json.RawMessage) (interface{}, error) {
+	return fmt.Sprintf("Shuffle/v%s", version.Version), nil
+}
+
+func netVersion(m *Service, params json.RawMessage) (interface{}, error) {
+	return m.state.GetChainID().String(), nil
+}
+
+func ethChainID(m *Service, params json.RawMessage) (interface{}, error) {
+	return (*hexutil.Big)(m.state.GetChainID()), nil
+}
+
+// ethGasPrice returns the minimum gas price accepted by this node
+func ethGasPrice(m *Service, params json.RawMessage) (interface{}, error) {
+	return (*hexutil.Big)(m.state.GetMinGasPrice()), nil
+}
+
+func txpoolStatus(m *Service, params json.RawMessage) (interface{}, error) {
+	pending, queued := m.state.GetPoolStats()
+	return JsonRPCTxPoolStatus{
+		Pending: hexutil.Uint(pending),
+		Queued:  hexutil.Uint(queued),
+	}, nil
+}
+
+func ethAccounts(m *Service, params json.RawMessage) (interface{}, error) {
+	addresses := []common.Address{}
+	for _, account := range m.keyStore.Accounts() {
+		addresses = append(addresses, account.Address)
+	}
+	return addresses, nil
+}
+
+func ethBlockNumber(m *Service, params json.RawMessage) (interface{}, error) {
+	return hexutil.Uint64(m.state.GetHeadBlock().Number), nil
+}
+
+func ethGetBlockByNumber(m *Service, params json.RawMessage) (interface{}, error) {
+	var blockNumber string
+	var fullTx bool
+	if err := parseParams(params, 1, &blockNumber, &fullTx); err != nil {
+		return nil, err
+	}
+
+	number, err := parseBlockNumber(m, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := m.state.GetBlockByNumber(number)
+	if err != nil {
+		return nil, nil
+	}
+
+	return newJSONRPCBlock(m, block, fullTx)
+}
+
+func ethGetBlockByHash(m *Service, params json.RawMessage) (interface{}, error) {
+	var blockHash common.Hash
+	var fullTx bool
+	if err := parseParams(params, 1, &blockHash, &fullTx); err != nil {
+		return nil, err
+	}
+
+	block, err := m.state.GetBlockByHash(blockHash)
+	if err != nil {
+		return nil, nil
+	}
+
+	return newJSONRPCBlock(m, block, fullTx)
+}
+
+func ethGetBalance(m *Service, params json.RawMessage) (interface{}, error) {
+	var address common.Address
+	var block blockParam
+	if err := parseParams(params, 1, &address, &block); err != nil {
+		return nil, err
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+	return (*hexutil.Big)(st.GetBalance(address)), nil
+}
+
+// ethGetTransactionCount returns the nonce from the TxPool when the "pending"
+// block is requested, so that clients can chain transactions without waiting
+// for them to be committed.
+func ethGetTransactionCount(m *Service, params json.RawMessage) (interface{}, error) {
+	var address common.Address
+	var block blockParam
+	if err := parseParams(params, 1, &address, &block); err != nil {
+		return nil, err
+	}
+	if block.Number == "pending" {
+		return hexutil.Uint64(m.state.GetPoolNonce(address)), nil
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+	return hexutil.Uint64(st.GetNonce(address)), nil
+}
+
+func ethGetCode(m *Service, params json.RawMessage) (interface{}, error) {
+	var address common.Address
+	var block blockParam
+	if err := parseParams(params, 1, &address, &block); err != nil {
+		return nil, err
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+	return hexutil.Bytes(st.GetCode(address)), nil
+}
+
+func ethCall(m *Service, params json.RawMessage) (interface{}, error) {
+	var args JsonRPCTxArgs
+	var block blockParam
+	if err := parseParams(params, 1, &args, &block); err != nil {
+		return nil, err
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+
+	txArgs := args.toSendTxArgs()
+	// Calls do not pay for gas, so let them use as much as they need
+	if txArgs.Gas == 0 {
+		txArgs.Gas = m.state.GetGasLimit()
+	}
+
+	callMessage, err := prepareCallMessage(txArgs, m.keyStore)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := st.Call(*callMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	return hexutil.Bytes(data), nil
+}
+
+func ethEstimateGas(m *Service, params json.RawMessage) (interface{}, error) {
+	var args JsonRPCTxArgs
+	var block blockParam
+	if err := parseParams(params, 1, &args, &block); err != nil {
+		return nil, err
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+	gas, err := estimateGas(args.toSendTxArgs(), m.state, st)
+	if err != nil {
+		return nil, err
+	}
+	return hexutil.Uint64(gas), nil
+}
+
+func ethSendTransaction(m *Service, params json.RawMessage) (interface{}, error) {
+	var args JsonRPCTxArgs
+	if err := parseParams(params, 1, &args); err != nil {
+		return nil, err
+	}
+
+	tx, err := m.sendTx(args.toSendTxArgs())
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Hash(), nil
+}
+
+func ethSendRawTransaction(m *Service, params json.RawMessage) (interface{}, error) {
+	var rawTx hexutil.Bytes
+	if err := parseParams(params, 1, &rawTx); err != nil {
+		return nil, err
+	}
+
+	var tx ethTypes.Transaction
+	if err := rlp.Decode(bytes.NewReader(rawTx), &tx); err != nil {
+		return nil, invalidParams("decoding transaction: %v", err)
+	}
+
+	if err := m.submitTx(&tx); err != nil {
+		return nil, err
+	}
+
+	return tx.Hash(), nil
+}
+
+// ethGetTransactionByHash returns null if the transaction has not been
+// committed.
+func ethGetTransactionByHash(m *Service, params json.RawMessage) (interface{}, error) {
+	var txHash common.Hash
+	if err := parseParams(params, 1, &txHash); err != nil {
+		return nil, err
+	}
+
+	tx, err := m.state.GetTransaction(txHash)
+	if err != nil {
+		return nil, nil
+	}
+
+	txLookup, err := m.state.GetTxLookupEntry(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return newJSONRPCTransaction(tx, txLookup, m.state.GetSigner())
+}
+
+// ethGetTransactionReceipt returns null if the transaction has not been
+// committed.
+func ethGetTransactionReceipt(m *Service, params json.RawMessage) (interface{}, error) {
+	var txHash common.Hash
+	if err := parseParams(params, 1, &txHash); err != nil {
+		return nil, err
+	}
+
+	tx, err := m.state.GetTransaction(txHash)
+	if err != nil {
+		return nil, nil
+	}
+
+	receipt, err := m.state.GetReceipt(txHash)
+	if err != nil {
+		return nil, nil
+	}
+
+	txLookup, err := m.state.GetTxLookupEntry(txHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return newJSONRPCReceipt(tx, txLookup, receipt, m.state.GetSigner())
+}
+
+//------------------------------------------------------------------------------
+
+// parseBlockNumber converts a JSON-RPC block parameter into a block number.
+// "latest" and "pending" both resolve to the head block since committed blocks
+// are final.
+func parseBlockNumber(m *Service, blockNumber string) (uint64, error) {
+	switch blockNumber {
+	case "", "latest", "pending":
+		return m.state.GetHeadBlock().Number, nil
+	case "earliest":
+		return 0, nil
+	}
+
+	number, err := hexutil.DecodeUint64(blockNumber)
+	if err != nil {
+		return 0, invalidParams("invalid block number %s: %v", blockNumber, err)
+	}
+
+	return number, nil
+}
+
+//------------------------------------------------------------------------------
+
+func newJSONRPCHeader(m *Service, block *state.Block) *JsonRPCHeader {
+	return &JsonRPCHeader{
+		Number:          hexutil.Uint64(block.Number),
+		Hash:            block.Hash(),
+		ParentHash:      block.ParentHash,
+		Nonce:           make(hexutil.Bytes, 8),
+		Sha3Uncles:      ethTypes.EmptyUncleHash,
+		LogsBloom:       block.LogsBloom,
+		StateRoot:       block.StateRoot,
+		ReceiptsRoot:    block.ReceiptsRoot,
+		Miner:           block.Coinbase,
+		Difficulty:      (*hexutil.Big)(common.Big0),
+		TotalDifficulty: (*hexutil.Big)(common.Big0),
+		ExtraData:       hexutil.Bytes{},
+		GasLimit:        hexutil.Uint64(m.state.GetGasLimit()),
+		GasUsed:         hexutil.Uint64(block.GasUsed),
+		Timestamp:       hexutil.Uint64(block.Timestamp),
+	}
+}
+
+func newJSONRPCBlock(m *Service, block *state.Block, fullTx bool) (*JsonRPCBlock, error) {
+	res := &JsonRPCBlock{
+		JsonRPCHeader: *newJSONRPCHeader(m, block),
+		Transactions:  []interface{}{},
+		Uncles:        []common.Hash{},
+	}
+
+	for i, txHash := range block.TxHashes {
+		if !fullTx {
+			res.Transactions = append(res.Transactions, txHash)
+			continue
+		}
+
+		tx, err := m.state.GetTransaction(txHash)
+		if err != nil {
+			return nil, err
+		}
+
+		txLookup := &state.TxLookupEntry{
+			BlockHash:   res.Hash,
+			BlockNumber: block.Number,
+			Index:       uint64(i),
+		}
+
+		rpcTx, err := newJSONRPCTransaction(tx, txLookup, m.state.GetSigner())
+		if err != nil {
+			return nil, err
+		}
+
+		res.Transactions = append(res.Transactions, rpcTx)
+	}
+
+	return res, nil
+}
+
+func newJSONRPCTransaction(tx *ethTypes.Transaction, txLookup *state.TxLookupEntry, signer ethTypes.Signer) (*JsonRPCTransaction, error) {
+	from, err := ethTypes.Sender(signer, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	v, r, s := tx.RawSignatureValues()
+
+	return &JsonRPCTransaction{
+		BlockHash:        txLookup.BlockHash,
+		BlockNumber:      hexutil.Uint64(txLookup.BlockNumber),
+		TransactionIndex: hexutil.Uint(txLookup.Index),
+		Hash:             tx.Hash(),
+		Nonce:            hexutil.Uint64(tx.Nonce()),
+		From:             from,
+		To:               tx.To(),
+		Value:            (*hexutil.Big)(tx.Value()),
+		Gas:              hexutil.Uint64(tx.Gas()),
+		GasPrice:         (*hexutil.Big)(tx.GasPrice()),
+		Input:            hexutil.Bytes(tx.Data()),
+		V:                (*hexutil.Big)(v),
+		R:                (*hexutil.Big)(r),
+		S:                (*hexutil.Big)(s),
+	}, nil
+}
+
+func newJSONRPCReceipt(tx *ethTypes.Transaction, txLookup *state.TxLookupEntry, receipt *ethTypes.Receipt, signer ethTypes.Signer) (*JsonRPCReceipt, error) {
+	from, err := ethTypes.Sender(signer, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &JsonRPCReceipt{
+		BlockHash:         txLookup.BlockHash,
+		BlockNumber:       hexutil.Uint64(txLookup.BlockNumber),
+		TransactionHash:   tx.Hash(),
+		TransactionIndex:  hexutil.Uint(txLookup.Index),
+		From:              from,
+		To:                tx.To(),
+		GasUsed:           hexutil.Uint64(receipt.GasUsed),
+		CumulativeGasUsed: hexutil.Uint64(receipt.CumulativeGasUsed),
+		Logs:              receipt.Logs,
+		LogsBloom:         receipt.Bloom,
+	}
+
+	if res.Logs == nil {
+		res.Logs = []*ethTypes.Log{}
+	}
+
+	// Receipts carry either an intermediate state root (pre-Byzantium) or a
+	// status code, never both.
+	if len(receipt.PostState) > 0 {
+		res.Root = hexutil.Bytes(receipt.PostState)
+	} else {
+		status := hexutil.Uint(receipt.Status)
+		res.Status = &status
+	}
+
+	if receipt.ContractAddress != (common.Address{}) {
+		res.ContractAddress = &receipt.ContractAddress
+	}
+
+	return res, nil
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+)
+
+// filterTimeout is how long an installed filter survives without being polled
+const filterTimeout = 5 * time.Minute
+
+// installedFilter is a filter created with eth_newFilter or
+// eth_newBlockFilter. It remembers the last block whose changes were returned
+// to the client.
+type installedFilter struct {
+	blocks    bool
+	criteria  FilterCriteria
+	lastBlock uint64
+	deadline  time.Time
+}
+
+func ethGetLogs(m *Service, params json.RawMessage) (interface{}, error) {
+	var criteria FilterCriteria
+	if err := parseParams(params, 1, &criteria); err != nil {
+		return nil, err
+	}
+	return m.getLogs(criteria)
+}
+
+func ethNewFilter(m *Service, params json.RawMessage) (interface{}, error) {
+	var criteria FilterCriteria
+	if err := parseParams(params, 1, &criteria); err != nil {
+		return nil, err
+	}
+	// Validate the block range now rather than on the first poll
+	if _, _, err := m.resolveLogRange(criteria); err != nil {
+		return nil, err
+	}
+	return m.installFilter(&installedFilter{criteria: criteria})
+}
+
+func ethNewBlockFilter(m *Service, params json.RawMessage) (interface{}, error) {
+	if err := parseParams(params, 0); err != nil {
+		return nil, err
+	}
+	return m.installFilter(&installedFilter{blocks: true})
+}
+
+func ethGetFilterChanges(m *Service, params json.RawMessage) (interface{}, error) {
+	f, err := m.getFilter(params)
+	if err != nil {
+		return nil, err
+	}
+
+	head := m.state.GetHeadBlock().Number
+
+	m.filtersLock.Lock()
+	from := f.lastBlock + 1
+	f.lastBlock = head
+	m.filtersLock.Unlock()
+
+	if f.blocks {
+		hashes := []common.Hash{}
+		for number := from; number <= head; number++ {
+			block, err := m.state.GetBlockByNumber(number)
+			if err != nil {
+				return nil, err
+			}
+			hashes = append(hashes, block.Hash())
+		}
+		return hashes, nil
+	}
+
+	start, end, err := m.resolveLogRange(f.criteria)
+	if err != nil {
+		return nil, err
+	}
+	if start > from {
+		from = start
+	}
+	if end > head {
+		end = head
+	}
+	if from > end {
+		return []*ethTypes.Log{}, nil
+	}
+
+	return m.state.GetLogs(from, end, f.criteria.LogFilter)
+}
+
+func ethGetFilterLogs(m *Service, params json.RawMessage) (interface{}, error) {
+	f, err := m.getFilter(params)
+	if err != nil {
+		return nil, err
+	}
+	if f.blocks {
+		return nil, invalidParams("filter is not a log filter")
+	}
+	return m.getLogs(f.criteria)
+}
+
+func ethUninstallFilter(m *Service, params json.RawMessage) (interface{}, error) {
+	var id string
+	if err := parseParams(params, 1, &id); err != nil {
+		return nil, err
+	}
+
+	m.filtersLock.Lock()
+	defer m.filtersLock.Unlock()
+
+	_, ok := m.filters[id]
+	delete(m.filters, id)
+
+	return ok, nil
+}
+
+//------------------------------------------------------------------------------
+
+// getLogs returns the logs that satisfy the criteria
+func (m *Service) getLogs(criteria FilterCriteria) ([]*ethTypes.Log, error) {
+	if criteria.BlockHash != nil {
+		block, err := m.state.GetBlockByHash(*criteria.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		logs, err := m.state.GetBlockLogs(block)
+		if err != nil {
+			return nil, err
+		}
+		return criteria.Filter(logs), nil
+	}
+
+	from, to, err := m.resolveLogRange(criteria)
+	if err != nil {
+		return nil, err
+	}
+	if head := m.state.GetHeadBlock().Number; to > head {
+		to = head
+	}
+	if from > to {
+		return []*ethTypes.Log{}, nil
+	}
+
+	return m.state.GetLogs(from, to, criteria.LogFilter)
+}
+
+// resolveLogRange converts the block range of the criteria to block numbers.
+// Both ends default to the latest block.
+func (m *Service) resolveLogRange(criteria FilterCriteria) (uint64, uint64, error) {
+	from, err := parseBlockNumber(m, criteria.FromBlock)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// An open-ended filter follows the head of the chain
+	to := ^uint64(0)
+	switch criteria.ToBlock {
+	case "", "latest", "pending":
+	default:
+		if to, err = parseBlockNumber(m, criteria.ToBlock); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return from, to, nil
+}
+
+func (m *Service) installFilter(f *installedFilter) (string, error) {
+	m.filtersLock.Lock()
+	defer m.filtersLock.Unlock()
+
+	m.pruneFilters()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	f.lastBlock = m.state.GetHeadBlock().Number
+	f.deadline = time.Now().Add(filterTimeout)
+
+	m.filters[hexutil.Encode(id)] = f
+
+	return hexutil.Encode(id), nil
+}
+
+func (m *Service) getFilter(params json.RawMessage) (*installedFilter, error) {
+	var id string
+	if err := parseParams(params, 1, &id); err != nil {
+		return nil, err
+	}
+
+	m.filtersLock.Lock()
+	defer m.filtersLock.Unlock()
+
+	m.pruneFilters()
+
+	f, ok := m.filters[id]
+	if !ok {
+		return nil, &jsonrpcError{Code: errCodeServer, Message: "filter not found"}
+	}
+	f.deadline = time.Now().Add(filterTimeout)
+
+	return f, nil
+}
+
+// pruneFilters uninstalls the filters that have not been polled in time. The
+// caller holds the filtersLock.
+func (m *Service) pruneFilters() {
+	now := time.Now()
+	for id, f := range m.filters {
+		if now.After(f.deadline) {
+			delete(m.filters, id)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// postRPC posts a JSON-RPC body to the server and returns the status code and
+// the response body
+func postRPC(t *testing.T, server *httptest.Server, body string) (int, []byte) {
+	resp, err := http.Post(server.URL+"/rpc", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, data
+}
+
+// callRPC posts a single JSON-RPC request and decodes its response
+func callRPC(t *testing.T, server *httptest.Server, method string, params ...interface{}) *jsonrpcResponse {
+	if params == nil {
+		params = []interface{}{}
+	}
+	js, err := json.Marshal(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, data := postRPC(t, server, fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":%s}`, method, js))
+
+	var resp jsonrpcResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatalf("%s: decoding %s: %v", method, data, err)
+	}
+	return &resp
+}
+
+func TestJSONRPCHandler(t *testing.T) {
+	test := NewTest(t)
+	defer test.Close()
+
+	m := NewService("", "", "", test.state, make(chan []byte), bcommon.NewTestLogger(t))
+
+	server := httptest.NewServer(m.newRouter())
+	defer server.Close()
+
+	test.commit(t, test.newTx(t, 0))
+
+	resp := callRPC(t, server, "eth_blockNumber")
+	if resp.Error != nil || string(resp.Result) != `"0x1"` || string(resp.ID) != "1" {
+		t.Fatalf("eth_blockNumber should return 0x1, got %+v", resp)
+	}
+
+	// The responses of a batch are in the order of its requests, and the
+	// notification is not answered
+	code, data := postRPC(t, server, `[
+		{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","id":"two","method":"eth_unknown"},
+		{"jsonrpc":"2.0","id":3,"method":"eth_getBalance","params":[]},
+		{"jsonrpc":"1.0","id":4,"method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","id":5,"method":"eth_getBalance","params":"0x1"},
+		42
+	]`)
+	if code != http.StatusOK {
+		t.Fatalf("A batch should return %d, not %d", http.StatusOK, code)
+	}
+
+	var batch []jsonrpcResponse
+	if err := json.Unmarshal(data, &batch); err != nil {
+		t.Fatalf("decoding %s: %v", data, err)
+	}
+
+	expected := []struct {
+		id   string
+		code int
+	}{
+		{"1", 0},
+		{`"two"`, errCodeMethodNotFound},
+		{"3", errCodeInvalidParams},
+		{"4", errCodeInvalidRequest},
+		{"5", errCodeInvalidParams},
+		{"null", errCodeInvalidRequest},
+	}
+	if len(batch) != len(expected) {
+		t.Fatalf("The batch should have %d responses, got %s", len(expected), data)
+	}
+	for i, e := range expected {
+		resp := batch[i]
+		if string(resp.ID) != e.id {
+			t.Fatalf("Response %d should have id %s, got %s", i, e.id, resp.ID)
+		}
+		if e.code == 0 {
+			if resp.Error != nil || string(resp.Result) != `"0x1"` {
+				t.Fatalf("Response %d should succeed, got %+v", i, resp)
+			}
+			continue
+		}
+		if resp.Error == nil || resp.Error.Code != e.code {
+			t.Fatalf("Response %d should have error code %d, got %+v", i, e.code, resp.Error)
+		}
+	}
+
+	// Requests made only of notifications get an empty response
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"eth_blockNumber"}`,
+		`[{"jsonrpc":"2.0","method":"eth_blockNumber"},{"jsonrpc":"2.0","method":"eth_unknown"}]`,
+	} {
+		code, data := postRPC(t, server, body)
+		if code != http.StatusOK || len(data) != 0 {
+			t.Fatalf("Notifications should get an empty response, got %d %s", code, data)
+		}
+	}
+
+	for body, code := range map[string]int{
+		`{"jsonrpc":"2.0","id":1,`: errCodeParse,
+		`[{"jsonrpc":"2.0"`:        errCodeParse,
+		`[]`:                       errCodeInvalidRequest,
+		`{"jsonrpc":"2.0","id":1}`: errCodeInvalidRequest,
+	} {
+		_, data := postRPC(t, server, body)
+		var resp jsonrpcResponse
+		if err := json.Unmarshal(data, &resp); err != nil {
+			t.Fatalf("%s: decoding %s: %v", body, data, err)
+		}
+		if resp.Error == nil || resp.Error.Code != code {
+			t.Fatalf("%s should fail with error code %d, got %s", body, code, data)
+		}
+	}
+
+	// The errors of the methods themselves use the server error code
+	resp = callRPC(t, server, "eth_getTransactionCount", test.from, "0x10")
+	if resp.Error == nil || resp.Error.Code != errCodeServer {
+		t.Fatalf("A future block should fail with error code %d, got %+v", errCodeServer, resp.Error)
+	}
+}
+
+func TestJSONRPCEstimateGas(t *testing.T) {
+	test := NewTest(t)
+	defer test.Close()
+
+	m := NewService("", "", "", test.state, make(chan []byte), bcommon.NewTestLogger(t))
+
+	server := httptest.NewServer(m.newRouter())
+	defer server.Close()
+
+	test.commit(t, test.newTx(t, 0))
+
+	genesis, err := test.state.GetBlockByNumber(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := test.state.GetHeadBlock()
+
+	transfer := map[string]interface{}{
+		"from":  test.from,
+		"to":    common.Address{2},
+		"value": "0x1",
+	}
+
+	for _, block := range []interface{}{
+		nil,
+		"latest",
+		"0x1",
+		map[string]interface{}{"blockNumber": "0x1"},
+		map[string]interface{}{"blockHash": head.Hash()},
+	} {
+		params := []interface{}{transfer}
+		if block != nil {
+			params = append(params, block)
+		}
+		resp := callRPC(t, server, "eth_estimateGas", params...)
+		if resp.Error != nil || string(resp.Result) != `"0x5208"` {
+			t.Fatalf("Estimating a transfer at %v should return 0x5208, got %s %+v", block, resp.Result, resp.Error)
+		}
+	}
+
+	// Without archive mode, past states are not available
+	resp := callRPC(t, server, "eth_estimateGas", transfer, map[string]interface{}{"blockHash": genesis.Hash()})
+	if resp.Error == nil || resp.Error.Code != errCodeServer {
+		t.Fatalf("Estimating at the genesis block should fail, got %s", resp.Result)
+	}
+}
+
+func TestJSONRPCBlockFilter(t *testing.T) {
+	test := NewTest(t)
+	defer test.Close()
+
+	m := NewService("", "", "", test.state, make(chan []byte), bcommon.NewTestLogger(t))
+
+	server := httptest.NewServer(m.newRouter())
+	defer server.Close()
+
+	resp := callRPC(t, server, "eth_newBlockFilter")
+	if resp.Error != nil {
+		t.Fatal(resp.Error)
+	}
+	var id string
+	if err := json.Unmarshal(resp.Result, &id); err != nil {
+		t.Fatal(err)
+	}
+
+	test.commit(t, test.newTx(t, 0))
+	test.commit(t, test.newTx(t, 1))
+
+	changes := func() []common.Hash {
+		resp := callRPC(t, server, "eth_getFilterChanges", id)
+		if resp.Error != nil {
+			t.Fatal(resp.Error)
+		}
+		var hashes []common.Hash
+		if err := json.Unmarshal(resp.Result, &hashes); err != nil {
+			t.Fatal(err)
+		}
+		return hashes
+	}
+
+	hashes := changes()
+	if len(hashes) != 2 {
+		t.Fatalf("The filter should return 2 blocks, got %v", hashes)
+	}
+	for i, hash := range hashes {
+		block, err := test.state.GetBlockByNumber(uint64(i + 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != block.Hash() {
+			t.Fatalf("Hash %d should be the hash of block %d", i, i+1)
+		}
+	}
+
+	if hashes := changes(); len(hashes) != 0 {
+		t.Fatalf("The filter should not return blocks twice, got %v", hashes)
+	}
+
+	resp = callRPC(t, server, "eth_uninstallFilter", id)
+	if resp.Error != nil || string(resp.Result) != "true" {
+		t.Fatalf("Uninstalling the filter should return true, got %s %+v", resp.Result, resp.Error)
+	}
+	resp = callRPC(t, server, "eth_getFilterChanges", id)
+	if resp.Error == nil {
+		t.Fatal("An uninstalled filter should not be found")
+	}
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Membership is implemented by the consensus systems whose set of nodes can
+// be changed at runtime. The changes can be requested on any member of the
+// cluster; they are carried out by the leader.
+type Membership interface {
+	// Servers returns the current members of the cluster
+	Servers() ([]JsonServer, error)
+
+	// AddVoter adds a server that takes part in elections and commitment
+	AddVoter(id, address string) error
+
+	// AddNonvoter adds a server that receives the log but does not vote
+	AddNonvoter(id, address string) error
+
+	// RemoveServer removes a server from the cluster
+	RemoveServer(id string) error
+
+	// TransferLeadership makes the leader step down in favour of the given
+	// server, or of the most up-to-date follower if id is empty.
+	TransferLeadership(id, address string) error
+}
+
+// SetMembership enables the membership endpoints
+func (m *Service) SetMembership(membership Membership) {
+	m.membership = membership
+}
+
+/*
+GET /membership
+returns: JSON []JsonServer
+
+Lists the members of the cluster. Only available with consensus systems that
+support dynamic membership (Raft).
+*/
+func membershipHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("GET membership")
+
+	if m.membership == nil {
+		http.Error(w, "membership changes not supported", http.StatusNotImplemented)
+		return
+	}
+
+	writeServers(w, m)
+}
+
+/*
+POST /membership/voter
+POST /membership/nonvoter
+data: JSON JsonServerArgs
+returns: JSON []JsonServer
+
+Adds a server to the cluster, as a voter or as a nonvoter. With Raft, the new
+server must have been started without a peers.json file so that it waits to be
+added instead of bootstrapping its own cluster.
+*/
+func addVoterHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("POST membership/voter")
+	changeMembership(w, r, m, func(args JsonServerArgs) error {
+		return m.membership.AddVoter(args.ID, args.Address)
+	})
+}
+
+func addNonvoterHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("POST membership/nonvoter")
+	changeMembership(w, r, m, func(args JsonServerArgs) error {
+		return m.membership.AddNonvoter(args.ID, args.Address)
+	})
+}
+
+/*
+POST /membership/leader
+data: JSON JsonServerArgs (optional)
+returns: JSON []JsonServer
+
+Transfers the leadership to the given server, or to any up-to-date follower if
+no server is specified.
+*/
+func transferLeadershipHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("POST membership/leader")
+	changeMembership(w, r, m, func(args JsonServerArgs) error {
+		return m.membership.TransferLeadership(args.ID, args.Address)
+	})
+}
+
+/*
+DELETE /membership/{id}
+returns: JSON []JsonServer
+
+Removes a server from the cluster.
+*/
+func removeServerHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	id := mux.Vars(r)["id"]
+	m.logger.WithField("id", id).Debug("DELETE membership")
+
+	if m.membership == nil {
+		http.Error(w, "membership changes not supported", http.StatusNotImplemented)
+		return
+	}
+
+	if err := m.membership.RemoveServer(id); err != nil {
+		m.logger.WithError(err).Error("Removing server")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeServers(w, m)
+}
+
+// changeMembership decodes the JsonServerArgs in the request body, if any,
+// passes them to change, and responds with the resulting list of servers.
+func changeMembership(w http.ResponseWriter, r *http.Request, m *Service, change func(JsonServerArgs) error) {
+	if m.membership == nil {
+		http.Error(w, "membership changes not supported", http.StatusNotImplemented)
+		return
+	}
+
+	var args JsonServerArgs
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			m.logger.WithError(err).Error("Decoding JSON server args")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	defer r.Body.Close()
+
+	if err := change(args); err != nil {
+		m.logger.WithError(err).Error("Changing membership")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeServers(w, m)
+}
+
+func writeServers(w http.ResponseWriter, m *Service) {
+	servers, err := m.membership.Servers()
+	if err != nil {
+		m.logger.WithError(err).Error("Getting servers")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js, err := json.Marshal(servers)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
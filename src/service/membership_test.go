@@ -0,0 +1,126 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+)
+
+// fakeMembership keeps the cluster configuration in memory
+type fakeMembership struct {
+	servers []JsonServer
+}
+
+func (f *fakeMembership) Servers() ([]JsonServer, error) {
+	return f.servers, nil
+}
+
+func (f *fakeMembership) AddVoter(id, address string) error {
+	return f.add(id, address, "Voter")
+}
+
+func (f *fakeMembership) AddNonvoter(id, address string) error {
+	return f.add(id, address, "Nonvoter")
+}
+
+func (f *fakeMembership) add(id, address, suffrage string) error {
+	if id == "" {
+		return errors.New("server id required")
+	}
+	f.servers = append(f.servers, JsonServer{ID: id, Address: address, Suffrage: suffrage})
+	return nil
+}
+
+func (f *fakeMembership) RemoveServer(id string) error {
+	for i, s := range f.servers {
+		if s.ID == id {
+			f.servers = append(f.servers[:i], f.servers[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("unknown server " + id)
+}
+
+func (f *fakeMembership) TransferLeadership(id, address string) error {
+	return nil
+}
+
+func TestMembershipHandlers(t *testing.T) {
+	m := &Service{logger: bcommon.NewTestLogger(t)}
+
+	server := httptest.NewServer(m.newRouter())
+	defer server.Close()
+
+	do := func(method, path, body string) (int, []JsonServer) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var servers []JsonServer
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, servers
+	}
+
+	// without a Membership, the endpoints are not available
+	if code, _ := do("GET", "/membership", ""); code != http.StatusNotImplemented {
+		t.Fatalf("GET /membership should return %d, not %d", http.StatusNotImplemented, code)
+	}
+
+	m.SetMembership(&fakeMembership{
+		servers: []JsonServer{{ID: "node1", Address: "127.0.0.1:1337", Suffrage: "Voter", Leader: true}},
+	})
+
+	code, servers := do("POST", "/membership/voter", `{"id":"node2","address":"127.0.0.1:1338"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Adding a voter should succeed, got %d", code)
+	}
+	if len(servers) != 2 || servers[1].ID != "node2" || servers[1].Address != "127.0.0.1:1338" || servers[1].Suffrage != "Voter" {
+		t.Fatalf("node2 should be a voter, got %+v", servers)
+	}
+
+	code, servers = do("POST", "/membership/nonvoter", `{"id":"node3","address":"127.0.0.1:1339"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Adding a nonvoter should succeed, got %d", code)
+	}
+	if len(servers) != 3 || servers[2].ID != "node3" || servers[2].Suffrage != "Nonvoter" {
+		t.Fatalf("node3 should be a nonvoter, got %+v", servers)
+	}
+
+	code, servers = do("DELETE", "/membership/node2", "")
+	if code != http.StatusOK {
+		t.Fatalf("Removing a server should succeed, got %d", code)
+	}
+	if len(servers) != 2 || servers[0].ID != "node1" || servers[1].ID != "node3" {
+		t.Fatalf("node2 should be removed, got %+v", servers)
+	}
+
+	_, servers = do("GET", "/membership", "")
+	if len(servers) != 2 {
+		t.Fatalf("GET /membership should list 2 servers, got %+v", servers)
+	}
+
+	if code, _ := do("DELETE", "/membership/node2", ""); code != http.StatusInternalServerError {
+		t.Fatalf("Removing an unknown server should return %d, not %d", http.StatusInternalServerError, code)
+	}
+	if code, _ := do("POST", "/membership/voter", `{"address":`); code != http.StatusBadRequest {
+		t.Fatalf("Malformed arguments should return %d, not %d", http.StatusBadRequest, code)
+	}
+	if code, _ := do("POST", "/membership/voter", `{"address":"127.0.0.1:1340"}`); code != http.StatusInternalServerError {
+		t.Fatalf("A missing id should return %d, not %d", http.StatusInternalServerError, code)
+	}
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/gorilla/mux"
+)
+
+/*
+GET /account/{address}/storage
+ex: /account/0x50bd8a037442af4cdf631495bcaa5443de19685d/storage?key=0x0&key=0x1
+returns: JSON JsonStorageList
+
+This endpoint returns the raw value of the storage slots of an account selected
+by the key query parameters. Like /account/{address}, the optional block or
+root query parameter selects a past state, in archive mode.
+*/
+func storageHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	address := common.HexToAddress(mux.Vars(r)["address"])
+	m.logger.WithField("address", address.Hex()).Debug("GET storage")
+
+	st, err := queryState(r, m)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting State")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	storage := JsonStorageList{Storage: []JsonStorage{}}
+	for _, key := range queryStorageKeys(r) {
+		storage.Storage = append(storage.Storage, JsonStorage{
+			Key:   key,
+			Value: st.GetStorageAt(address, key),
+		})
+	}
+
+	js, err := json.Marshal(storage)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+/*
+GET /account/{address}/storage/proof
+ex: /account/0x50bd8a037442af4cdf631495bcaa5443de19685d/storage/proof?key=0x0
+returns: JSON JsonAccountProof
+
+This endpoint returns the Merkle proof of an account, and of the storage slots
+selected by the key query parameters, against the state root, as per EIP-1186.
+A third party that trusts the state root can check the balance, nonce, code
+hash, and storage values without trusting this node. The optional block or
+root query parameter selects a past state, in archive mode.
+*/
+func storageProofHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	address := common.HexToAddress(mux.Vars(r)["address"])
+	m.logger.WithField("address", address.Hex()).Debug("GET storage proof")
+
+	st, err := queryState(r, m)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting State")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	proof, err := st.GetProof(address, queryStorageKeys(r))
+	if err != nil {
+		m.logger.WithError(err).Error("Getting Proof")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonProof := JsonAccountProof{
+		Address:      proof.Address,
+		Root:         proof.Root,
+		Balance:      proof.Balance,
+		Nonce:        proof.Nonce,
+		CodeHash:     proof.CodeHash,
+		StorageHash:  proof.StorageHash,
+		AccountProof: common.ToHexArray(proof.AccountProof),
+		StorageProof: make([]JsonStorageProof, len(proof.StorageProof)),
+	}
+	for i, storageProof := range proof.StorageProof {
+		jsonProof.StorageProof[i] = JsonStorageProof{
+			Key:   storageProof.Key,
+			Value: storageProof.Value,
+			Proof: common.ToHexArray(storageProof.Proof),
+		}
+	}
+
+	js, err := json.Marshal(jsonProof)
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func ethGetStorageAt(m *Service, params json.RawMessage) (interface{}, error) {
+	var address common.Address
+	var key string
+	var block blockParam
+	if err := parseParams(params, 2, &address, &key, &block); err != nil {
+		return nil, err
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+	value := st.GetStorageAt(address, common.HexToHash(key))
+	return hexutil.Bytes(value.Bytes()), nil
+}
+
+func ethGetProof(m *Service, params json.RawMessage) (interface{}, error) {
+	var address common.Address
+	var keys []string
+	var block blockParam
+	if err := parseParams(params, 2, &address, &keys, &block); err != nil {
+		return nil, err
+	}
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]common.Hash, len(keys))
+	for i, key := range keys {
+		hashes[i] = common.HexToHash(key)
+	}
+
+	proof, err := st.GetProof(address, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return newJSONRPCAccountProof(proof, keys), nil
+}
+
+//------------------------------------------------------------------------------
+
+// queryStorageKeys reads the storage slots from the key query parameters
+func queryStorageKeys(r *http.Request) []common.Hash {
+	keys := []common.Hash{}
+	for _, key := range r.URL.Query()["key"] {
+		keys = append(keys, common.HexToHash(key))
+	}
+	return keys
+}
+
+// newJSONRPCAccountProof converts a proof to the format of go-ethereum's
+// eth_getProof, where the storage keys are echoed as they were requested
+func newJSONRPCAccountProof(proof *state.AccountProof, keys []string) *JsonRPCAccountProof {
+	res := &JsonRPCAccountProof{
+		Address:      proof.Address,
+		AccountProof: common.ToHexArray(proof.AccountProof),
+		Balance:      (*hexutil.Big)(proof.Balance),
+		CodeHash:     proof.CodeHash,
+		Nonce:        hexutil.Uint64(proof.Nonce),
+		StorageHash:  proof.StorageHash,
+		StorageProof: make([]JsonRPCStorageProof, len(proof.StorageProof)),
+	}
+	for i, storageProof := range proof.StorageProof {
+		res.StorageProof[i] = JsonRPCStorageProof{
+			Key:   keys[i],
+			Value: (*hexutil.Big)(storageProof.Value.Big()),
+			Proof: common.ToHexArray(storageProof.Proof),
+		}
+	}
+	return res
+}
@@ -1,6 +1,7 @@
 package service
 
 import (
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -8,17 +9,24 @@ import (
 	"sync"
 
 	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/gorilla/mux"
 	"github.com/abassian/shuffle/src/state"
 	"github.com/sirupsen/logrus"
 )
 
-var defaultGas = uint64(90000)
-
 type infoCallback func() (map[string]string, error)
 
+// submitCallback hands a transaction over to the consensus system and returns
+// once it has been accepted, or with an error if it could not be.
+type submitCallback func(tx []byte) error
+
+// Service serves the HTTP, JSON-RPC, and WebSocket APIs. Requests are handled
+// in parallel: the State is safe for concurrent use, and the Service only
+// locks what it owns.
 type Service struct {
-	sync.Mutex
 	state       *state.State
 	submitCh    chan []byte
 	keystoreDir string
@@ -26,20 +34,36 @@ type Service struct {
 	keyStore    *keystore.KeyStore
 	pwdFile     string
 	getInfo     infoCallback
+	submit      submitCallback
+	membership  Membership
 	logger      *logrus.Logger
+
+	// submitLock orders the transactions handed over to the consensus system,
+	// and the nonces assigned to the transactions of the keystore accounts
+	submitLock sync.Mutex
+
+	// filtersLock protects the filters and their progress
+	filters     map[string]*installedFilter
+	filtersLock sync.Mutex
 }
 
 func NewService(keystoreDir, apiAddr, pwdFile string,
 	state *state.State,
 	submitCh chan []byte,
 	logger *logrus.Logger) *Service {
-	return &Service{
+	m := &Service{
 		keystoreDir: keystoreDir,
 		apiAddr:     apiAddr,
 		pwdFile:     pwdFile,
 		state:       state,
 		submitCh:    submitCh,
+		filters:     make(map[string]*installedFilter),
 		logger:      logger}
+
+	// Subscribe now, so that no promotion is missed before Run
+	m.subscribePromotedTxs()
+
+	return m
 }
 
 func (m *Service) Run() {
@@ -59,6 +83,14 @@ func (m *Service) SetInfoCallback(f infoCallback) {
 	m.getInfo = f
 }
 
+// SetSubmitCallback makes the Service hand transactions over to the consensus
+// system synchronously, through f, instead of pushing them to the submitCh. It
+// is meant for consensus systems that can report whether a transaction was
+// accepted.
+func (m *Service) SetSubmitCallback(f submitCallback) {
+	m.submit = f
+}
+
 func (m *Service) makeKeyStore() error {
 
 	scryptN := keystore.StandardScryptN
@@ -95,26 +127,49 @@ func (m *Service) unlockAccounts() error {
 }
 
 func (m *Service) serveAPI() {
+	m.logger.WithField("apiAddr", m.apiAddr).Debug("Shuffle Service serving")
+	http.ListenAndServe(m.apiAddr, m.newRouter())
+}
+
+// newRouter returns the handler of every endpoint of the API
+func (m *Service) newRouter() http.Handler {
 
 	serverMuxEVM := http.NewServeMux()
 
 	r := mux.NewRouter()
 	r.HandleFunc("/account/{address}", m.makeHandler(accountHandler)).Methods("GET")
+	r.HandleFunc("/account/{address}/storage", m.makeHandler(storageHandler)).Methods("GET")
+	r.HandleFunc("/account/{address}/storage/proof", m.makeHandler(storageProofHandler)).Methods("GET")
 	r.HandleFunc("/accounts", m.makeHandler(accountsHandler)).Methods("GET")
 	r.HandleFunc("/call", m.makeHandler(callHandler)).Methods("POST")
+	r.HandleFunc("/estimate", m.makeHandler(estimateHandler)).Methods("POST")
 	r.HandleFunc("/tx", m.makeHandler(transactionHandler)).Methods("POST")
 	r.HandleFunc("/rawtx", m.makeHandler(rawTransactionHandler)).Methods("POST")
 	r.HandleFunc("/tx/{tx_hash}", m.makeHandler(transactionReceiptHandler)).Methods("GET")
+	r.HandleFunc("/block/{id}", m.makeHandler(blockHandler)).Methods("GET")
+	r.HandleFunc("/trace/call", m.makeHandler(traceCallHandler)).Methods("POST")
+	r.HandleFunc("/trace/{tx_hash}", m.makeHandler(traceTransactionHandler)).Methods("GET")
+	r.HandleFunc("/logs", m.makeHandler(logsHandler)).Methods("GET")
 	r.HandleFunc("/info", m.makeHandler(infoHandler)).Methods("GET")
 	r.HandleFunc("/html/info", m.makeHandler(htmlInfoHandler)).Methods("GET")
 	r.HandleFunc("/contract", m.makeHandler(contractHandler)).Methods("GET")
 	r.HandleFunc("/poa", m.makeHandler(poaHandler)).Methods("GET")
 	r.HandleFunc("/genesis", m.makeHandler(genesisHandler)).Methods("GET")
+	r.HandleFunc("/membership", m.makeHandler(membershipHandler)).Methods("GET")
+	r.HandleFunc("/membership/voter", m.makeHandler(addVoterHandler)).Methods("POST")
+	r.HandleFunc("/membership/nonvoter", m.makeHandler(addNonvoterHandler)).Methods("POST")
+	r.HandleFunc("/membership/leader", m.makeHandler(transferLeadershipHandler)).Methods("POST")
+	r.HandleFunc("/membership/{id}", m.makeHandler(removeServerHandler)).Methods("DELETE")
+	r.HandleFunc("/rpc", m.makeHandler(jsonrpcHandler)).Methods("POST")
+	r.HandleFunc("/", m.makeHandler(jsonrpcHandler)).Methods("POST")
+
+	r.HandleFunc("/ws", func(w http.ResponseWriter, req *http.Request) {
+		wsHandler(w, req, m)
+	}).Methods("GET")
 
 	serverMuxEVM.Handle("/", &CORSServer{r})
 
-	m.logger.WithField("apiAddr", m.apiAddr).Debug("Shuffle Service serving")
-	http.ListenAndServe(m.apiAddr, serverMuxEVM)
+	return serverMuxEVM
 }
 
 type CORSServer struct {
@@ -138,9 +193,129 @@ func (s *CORSServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 func (m *Service) makeHandler(fn func(http.ResponseWriter, *http.Request, *Service)) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		m.Lock()
 		fn(w, r, m)
-		m.Unlock()
+	}
+}
+
+// sendTx signs a transaction from an account of the keystore, with the next
+// nonce of the account in the TxPool, and submits it. cf. submitTx
+func (m *Service) sendTx(args SendTxArgs) (*ethTypes.Transaction, error) {
+	m.submitLock.Lock()
+	defer m.submitLock.Unlock()
+
+	tx, err := prepareTransaction(args, m.state, m.keyStore)
+	if err != nil {
+		m.logger.WithError(err).Error("Preparing Transaction")
+		return nil, err
+	}
+
+	m.logger.WithFields(logrus.Fields{
+		"hash":     tx.Hash().Hex(),
+		"to":       tx.To(),
+		"payload":  fmt.Sprintf("%x", tx.Data()),
+		"gas":      tx.Gas(),
+		"gasPrice": tx.GasPrice(),
+		"nonce":    tx.Nonce(),
+		"value":    tx.Value(),
+	}).Debug("Service decoded tx")
+
+	if err := m.checkTx(tx); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// submitTx adds a transaction to the TxPool and forwards the transactions
+// that became pending to the consensus system. A transaction with a nonce gap
+// is only queued.
+func (m *Service) submitTx(tx *ethTypes.Transaction) error {
+	m.submitLock.Lock()
+	defer m.submitLock.Unlock()
+
+	return m.checkTx(tx)
+}
+
+// checkTx does the work of submitTx. The caller holds the submitLock.
+func (m *Service) checkTx(tx *ethTypes.Transaction) error {
+	pending, err := m.state.CheckTx(tx)
+	if err != nil {
+		m.logger.WithError(err).Error("Checking Transaction")
+		return err
+	}
+
+	for _, tx := range pending {
+		if err := m.forwardTx(tx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forwardTx hands a pending transaction over to the consensus system
+func (m *Service) forwardTx(tx *ethTypes.Transaction) error {
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		m.logger.WithError(err).Error("Encoding Transaction")
+		return err
+	}
+
+	m.logger.WithField("hash", tx.Hash().Hex()).Debug("submitting tx")
+	if m.submit != nil {
+		if err := m.submit(data); err != nil {
+			m.logger.WithError(err).Error("Submitting Transaction")
+			return err
+		}
+	} else {
+		m.submitCh <- data
+	}
+	m.logger.Debug("submitted tx")
+
+	return nil
+}
+
+// subscribePromotedTxs starts forwarding the transactions that the State
+// promotes
+func (m *Service) subscribePromotedTxs() {
+	ch := make(chan state.PromotedTxsEvent)
+	go m.forwardPromotedTxs(ch, m.state.SubscribePromotedTxs(ch))
+}
+
+// forwardPromotedTxs forwards the queued transactions that the State promotes
+// after a commit to the consensus system. They are taken from the State, and
+// forwarded, under the submitLock, like the transactions returned by CheckTx,
+// so that a transaction submitted meanwhile does not overtake them. Commit
+// sends the events while the transactions are forwarded, so they only wake the
+// forwarder up, rather than wait for it.
+func (m *Service) forwardPromotedTxs(ch chan state.PromotedTxsEvent, sub event.Subscription) {
+	defer sub.Unsubscribe()
+
+	wake := make(chan struct{}, 1)
+	defer close(wake)
+
+	go func() {
+		for range wake {
+			m.submitLock.Lock()
+			for _, tx := range m.state.TakePromotedTxs() {
+				if err := m.forwardTx(tx); err != nil {
+					m.logger.WithError(err).WithField("hash", tx.Hash().Hex()).Error("Forwarding promoted transaction")
+				}
+			}
+			m.submitLock.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case <-ch:
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		case <-sub.Err():
+			return
+		}
 	}
 }
 
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/abassian/shuffle/src/database"
+	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Test holds a State whose genesis funds the account of key
+type Test struct {
+	dir   string
+	key   *ecdsa.PrivateKey
+	from  common.Address
+	state *state.State
+}
+
+func NewTest(t *testing.T) *Test {
+	dir, err := ioutil.TempDir("", "shuffle-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	genesis := fmt.Sprintf(`{"alloc":{"%s":{"balance":"1337000000000000000000"}}}`, from.Hex())
+	genesisFile := filepath.Join(dir, "genesis.json")
+	if err := ioutil.WriteFile(genesisFile, []byte(genesis), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := state.NewState(bcommon.NewTestLogger(t),
+		database.Memory,
+		filepath.Join(dir, "chaindata"),
+		16,
+		genesisFile,
+		false,
+		128)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Test{
+		dir:   dir,
+		key:   key,
+		from:  from,
+		state: st,
+	}
+}
+
+func (test *Test) Close() {
+	test.state.Close()
+	os.RemoveAll(test.dir)
+}
+
+// newTx returns a transfer signed by the funded account
+func (test *Test) newTx(t *testing.T, nonce uint64) *ethTypes.Transaction {
+	tx := ethTypes.NewTransaction(nonce, common.Address{1}, big.NewInt(1), 21000, big.NewInt(0), nil)
+	signed, err := ethTypes.SignTx(tx, test.state.GetSigner(), test.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// commit commits a block with the given transactions, as if they had been
+// submitted through another node
+func (test *Test) commit(t *testing.T, txs ...*ethTypes.Transaction) {
+	for _, tx := range txs {
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := test.state.Commit(state.BlockInfo{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPromotedTxsOrder(t *testing.T) {
+	test := NewTest(t)
+	defer test.Close()
+
+	m := NewService("", "", "", test.state, make(chan []byte), bcommon.NewTestLogger(t))
+
+	var mu sync.Mutex
+	var forwarded []common.Hash
+	m.SetSubmitCallback(func(data []byte) error {
+		var tx ethTypes.Transaction
+		if err := rlp.DecodeBytes(data, &tx); err != nil {
+			return err
+		}
+		mu.Lock()
+		forwarded = append(forwarded, tx.Hash())
+		mu.Unlock()
+		return nil
+	})
+
+	tx0, tx1, tx2 := test.newTx(t, 0), test.newTx(t, 1), test.newTx(t, 2)
+
+	// tx1 has a nonce gap, it is queued
+	if err := m.submitTx(tx1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once tx0 is committed, tx1 is promoted, and it goes before tx2, which
+	// is submitted right away
+	test.commit(t, tx0)
+	if err := m.submitTx(tx2); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(forwarded)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("2 transactions should be forwarded, not %d", n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(forwarded) != 2 || forwarded[0] != tx1.Hash() || forwarded[1] != tx2.Hash() {
+		t.Fatalf("tx1 and tx2 should be forwarded in order, got %v", forwarded)
+	}
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/gorilla/mux"
+)
+
+/*
+GET /trace/{tx_hash}
+ex: /trace/0xbfe1aa80eb704d6342c553ac9f423024f448f7c74b3e38559429d4b7c98ffb99
+ex: /trace/0xbfe1aa80eb704d6342c553ac9f423024f448f7c74b3e38559429d4b7c98ffb99?tracer=callTracer
+returns: JSON JsonExecutionResult, or the result of the tracer
+
+This endpoint executes a committed transaction again, and returns every EVM
+step that it went through. The tracer query parameter selects a JavaScript
+tracer instead, either a built-in one like callTracer (the tree of calls) and
+prestateTracer (the accounts and storage touched), or custom code. Steps
+recorded by the default tracer can be trimmed with the disableStack,
+disableMemory and disableStorage parameters.
+
+The state that preceded the transaction must still be available, which is only
+guaranteed in archive mode.
+*/
+func traceTransactionHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	param := mux.Vars(r)["tx_hash"]
+	m.logger.WithField("tx_hash", param).Debug("GET trace")
+	txHash := common.HexToHash(param)
+
+	config, err := queryTraceConfig(r)
+	if err != nil {
+		m.logger.WithError(err).Error("Parsing trace config")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := m.state.TraceTransaction(txHash, config)
+	if err != nil {
+		m.logger.WithError(err).Error("Tracing Transaction")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeTrace(w, m, res)
+}
+
+/*
+POST /trace/call
+data: JSON SendTxArgs
+returns: JSON JsonExecutionResult, or the result of the tracer
+
+This endpoint traces a call, like /call, with the same query parameters as
+/trace/{tx_hash}. The block or root query parameter selects a past state, in
+archive mode.
+*/
+func traceCallHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.WithField("request", r).Debug("POST trace/call")
+
+	var txArgs SendTxArgs
+	if err := json.NewDecoder(r.Body).Decode(&txArgs); err != nil {
+		m.logger.WithError(err).Error("Decoding JSON txArgs")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	config, err := queryTraceConfig(r)
+	if err != nil {
+		m.logger.WithError(err).Error("Parsing trace config")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	callMessage, err := prepareCallMessage(txArgs, m.keyStore)
+	if err != nil {
+		m.logger.WithError(err).Error("Converting to CallMessage")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	st, err := queryState(r, m)
+	if err != nil {
+		m.logger.WithError(err).Error("Getting State")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := st.TraceCall(*callMessage, config)
+	if err != nil {
+		m.logger.WithError(err).Error("Tracing Call")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeTrace(w, m, res)
+}
+
+func debugTraceTransaction(m *Service, params json.RawMessage) (interface{}, error) {
+	var txHash common.Hash
+	var config state.TraceConfig
+	if err := parseParams(params, 1, &txHash, &config); err != nil {
+		return nil, err
+	}
+
+	res, err := m.state.TraceTransaction(txHash, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return formatTrace(res), nil
+}
+
+func debugTraceCall(m *Service, params json.RawMessage) (interface{}, error) {
+	var args JsonRPCTxArgs
+	var block blockParam
+	var config state.TraceConfig
+	if err := parseParams(params, 1, &args, &block, &config); err != nil {
+		return nil, err
+	}
+
+	st, err := m.stateAt(block)
+	if err != nil {
+		return nil, err
+	}
+
+	txArgs := args.toSendTxArgs()
+	if txArgs.Gas == 0 {
+		txArgs.Gas = m.state.GetGasLimit()
+	}
+
+	callMessage, err := prepareCallMessage(txArgs, m.keyStore)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := st.TraceCall(*callMessage, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	return formatTrace(res), nil
+}
+
+//------------------------------------------------------------------------------
+
+// queryTraceConfig reads the trace config from the query parameters
+func queryTraceConfig(r *http.Request) (*state.TraceConfig, error) {
+	query := r.URL.Query()
+
+	config := &state.TraceConfig{
+		LogConfig: &vm.LogConfig{},
+		Tracer:    query.Get("tracer"),
+		Timeout:   query.Get("timeout"),
+	}
+
+	flags := map[string]*bool{
+		"disableStack":   &config.DisableStack,
+		"disableMemory":  &config.DisableMemory,
+		"disableStorage": &config.DisableStorage,
+	}
+	for name, flag := range flags {
+		if param := query.Get(name); param != "" {
+			value, err := strconv.ParseBool(param)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+			*flag = value
+		}
+	}
+
+	return config, nil
+}
+
+// formatTrace returns the result of a JavaScript tracer as is, or converts the
+// steps recorded by the struct logger to their JSON representation
+func formatTrace(res *state.TraceResult) interface{} {
+	if res.Result != nil {
+		return json.RawMessage(res.Result)
+	}
+
+	jsonRes := JsonExecutionResult{
+		Gas:         res.Gas,
+		Failed:      res.Failed,
+		ReturnValue: fmt.Sprintf("%x", res.ReturnValue),
+		StructLogs:  make([]JsonStructLog, len(res.StructLogs)),
+	}
+
+	for i, log := range res.StructLogs {
+		jsonLog := JsonStructLog{
+			Pc:      log.Pc,
+			Op:      log.Op.String(),
+			Gas:     log.Gas,
+			GasCost: log.GasCost,
+			Depth:   log.Depth,
+		}
+		if log.Err != nil {
+			jsonLog.Error = log.Err.Error()
+		}
+		if log.Stack != nil {
+			stack := make([]string, len(log.Stack))
+			for j, value := range log.Stack {
+				stack[j] = fmt.Sprintf("%x", math.PaddedBigBytes(value, 32))
+			}
+			jsonLog.Stack = &stack
+		}
+		if log.Memory != nil {
+			memory := make([]string, 0, (len(log.Memory)+31)/32)
+			for j := 0; j+32 <= len(log.Memory); j += 32 {
+				memory = append(memory, fmt.Sprintf("%x", log.Memory[j:j+32]))
+			}
+			jsonLog.Memory = &memory
+		}
+		if log.Storage != nil {
+			storage := make(map[string]string)
+			for key, value := range log.Storage {
+				storage[fmt.Sprintf("%x", key)] = fmt.Sprintf("%x", value)
+			}
+			jsonLog.Storage = &storage
+		}
+		jsonRes.StructLogs[i] = jsonLog
+	}
+
+	return jsonRes
+}
+
+func writeTrace(w http.ResponseWriter, m *Service, res *state.TraceResult) {
+	js, err := json.Marshal(formatTrace(res))
+	if err != nil {
+		m.logger.WithError(err).Error("Marshaling JSON response")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -4,6 +4,7 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
 )
 
@@ -18,6 +19,34 @@ type JsonAccountList struct {
 	Accounts []JsonAccount `json:"accounts"`
 }
 
+type JsonStorage struct {
+	Key   common.Hash `json:"key"`
+	Value common.Hash `json:"value"`
+}
+
+type JsonStorageList struct {
+	Storage []JsonStorage `json:"storage"`
+}
+
+// JsonAccountProof is the proof of an account against the state root, and of
+// some of its storage slots against the storage hash
+type JsonAccountProof struct {
+	Address      common.Address     `json:"address"`
+	Root         common.Hash        `json:"root"`
+	Balance      *big.Int           `json:"balance"`
+	Nonce        uint64             `json:"nonce"`
+	CodeHash     common.Hash        `json:"codeHash"`
+	StorageHash  common.Hash        `json:"storageHash"`
+	AccountProof []string           `json:"accountProof"`
+	StorageProof []JsonStorageProof `json:"storageProof"`
+}
+
+type JsonStorageProof struct {
+	Key   common.Hash `json:"key"`
+	Value common.Hash `json:"value"`
+	Proof []string    `json:"proof"`
+}
+
 // SendTxArgs represents the arguments to sumbit a new transaction into the transaction pool.
 type SendTxArgs struct {
 	From     common.Address  `json:"from"`
@@ -33,12 +62,19 @@ type JsonCallRes struct {
 	Data string `json:"data"`
 }
 
+type JsonEstimateRes struct {
+	Gas uint64 `json:"gas"`
+}
+
 type JsonTxRes struct {
 	TxHash string `json:"txHash"`
 }
 
 type JsonReceipt struct {
 	Root              common.Hash     `json:"root"`
+	BlockHash         common.Hash     `json:"blockHash"`
+	BlockNumber       uint64          `json:"blockNumber"`
+	TransactionIndex  uint64          `json:"transactionIndex"`
 	TransactionHash   common.Hash     `json:"transactionHash"`
 	From              common.Address  `json:"from"`
 	To                *common.Address `json:"to"`
@@ -48,6 +84,23 @@ type JsonReceipt struct {
 	Logs              []*ethTypes.Log `json:"logs"`
 	LogsBloom         ethTypes.Bloom  `json:"logsBloom"`
 	Status            uint64          `json:"status"`
+	Error             string          `json:"error,omitempty"`
+}
+
+type JsonBlock struct {
+	Number         uint64         `json:"number"`
+	Hash           common.Hash    `json:"hash"`
+	ParentHash     common.Hash    `json:"parentHash"`
+	StateRoot      common.Hash    `json:"stateRoot"`
+	ReceiptsRoot   common.Hash    `json:"receiptsRoot"`
+	LogsBloom      ethTypes.Bloom `json:"logsBloom"`
+	GasUsed        uint64         `json:"gasUsed"`
+	Coinbase       common.Address `json:"coinbase"`
+	Timestamp      uint64         `json:"timestamp"`
+	Transactions   []common.Hash  `json:"transactions"`
+	Consensus      string         `json:"consensus"`
+	ConsensusIndex uint64         `json:"consensusIndex"`
+	ConsensusHash  hexutil.Bytes  `json:"consensusHash"`
 }
 
 type JsonContract struct {
@@ -58,3 +111,166 @@ type JsonContract struct {
 type JsonContractList struct {
 	Contracts []JsonContract `json:"contracts"`
 }
+
+// JsonServer is a member of the consensus cluster
+type JsonServer struct {
+	ID       string `json:"id"`
+	Address  string `json:"address"`
+	Suffrage string `json:"suffrage"`
+	Leader   bool   `json:"leader"`
+}
+
+// JsonServerArgs identifies the server targeted by a membership change
+type JsonServerArgs struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+//------------------------------------------------------------------------------
+// JSON-RPC types use the hex encodings expected by Ethereum clients
+
+// JsonRPCTxArgs represents the transaction object accepted by eth_call,
+// eth_estimateGas and eth_sendTransaction.
+type JsonRPCTxArgs struct {
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      *hexutil.Uint64 `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Nonce    *hexutil.Uint64 `json:"nonce"`
+	// Data and Input are synonyms; Input is preferred by newer clients.
+	Data  *hexutil.Bytes `json:"data"`
+	Input *hexutil.Bytes `json:"input"`
+}
+
+func (args JsonRPCTxArgs) toSendTxArgs() SendTxArgs {
+	res := SendTxArgs{
+		From:     args.From,
+		To:       args.To,
+		GasPrice: (*big.Int)(args.GasPrice),
+		Value:    (*big.Int)(args.Value),
+		Nonce:    (*uint64)(args.Nonce),
+	}
+	if args.Gas != nil {
+		res.Gas = uint64(*args.Gas)
+	}
+	if args.Input != nil {
+		res.Data = args.Input.String()
+	} else if args.Data != nil {
+		res.Data = args.Data.String()
+	}
+	return res
+}
+
+type JsonRPCTransaction struct {
+	BlockHash        common.Hash     `json:"blockHash"`
+	BlockNumber      hexutil.Uint64  `json:"blockNumber"`
+	TransactionIndex hexutil.Uint    `json:"transactionIndex"`
+	Hash             common.Hash     `json:"hash"`
+	Nonce            hexutil.Uint64  `json:"nonce"`
+	From             common.Address  `json:"from"`
+	To               *common.Address `json:"to"`
+	Value            *hexutil.Big    `json:"value"`
+	Gas              hexutil.Uint64  `json:"gas"`
+	GasPrice         *hexutil.Big    `json:"gasPrice"`
+	Input            hexutil.Bytes   `json:"input"`
+	V                *hexutil.Big    `json:"v"`
+	R                *hexutil.Big    `json:"r"`
+	S                *hexutil.Big    `json:"s"`
+}
+
+// JsonRPCHeader mimics the block header returned by Ethereum nodes. Fields that
+// do not apply to shuffle (mining, uncles, etc.) are set to empty values.
+type JsonRPCHeader struct {
+	Number          hexutil.Uint64 `json:"number"`
+	Hash            common.Hash    `json:"hash"`
+	ParentHash      common.Hash    `json:"parentHash"`
+	Nonce           hexutil.Bytes  `json:"nonce"`
+	Sha3Uncles      common.Hash    `json:"sha3Uncles"`
+	LogsBloom       ethTypes.Bloom `json:"logsBloom"`
+	StateRoot       common.Hash    `json:"stateRoot"`
+	ReceiptsRoot    common.Hash    `json:"receiptsRoot"`
+	Miner           common.Address `json:"miner"`
+	Difficulty      *hexutil.Big   `json:"difficulty"`
+	TotalDifficulty *hexutil.Big   `json:"totalDifficulty"`
+	ExtraData       hexutil.Bytes  `json:"extraData"`
+	GasLimit        hexutil.Uint64 `json:"gasLimit"`
+	GasUsed         hexutil.Uint64 `json:"gasUsed"`
+	Timestamp       hexutil.Uint64 `json:"timestamp"`
+}
+
+// JsonRPCBlock mimics the block object returned by Ethereum nodes
+type JsonRPCBlock struct {
+	JsonRPCHeader
+	Transactions []interface{} `json:"transactions"`
+	Uncles       []common.Hash `json:"uncles"`
+}
+
+type JsonRPCReceipt struct {
+	BlockHash         common.Hash     `json:"blockHash"`
+	BlockNumber       hexutil.Uint64  `json:"blockNumber"`
+	TransactionHash   common.Hash     `json:"transactionHash"`
+	TransactionIndex  hexutil.Uint    `json:"transactionIndex"`
+	From              common.Address  `json:"from"`
+	To                *common.Address `json:"to"`
+	GasUsed           hexutil.Uint64  `json:"gasUsed"`
+	CumulativeGasUsed hexutil.Uint64  `json:"cumulativeGasUsed"`
+	ContractAddress   *common.Address `json:"contractAddress"`
+	Logs              []*ethTypes.Log `json:"logs"`
+	LogsBloom         ethTypes.Bloom  `json:"logsBloom"`
+	Root              hexutil.Bytes   `json:"root,omitempty"`
+	Status            *hexutil.Uint   `json:"status,omitempty"`
+}
+
+// JsonRPCTxPoolStatus counts the transactions of the TxPool. Pending ones
+// were submitted to consensus, queued ones wait for a nonce gap to be filled.
+type JsonRPCTxPoolStatus struct {
+	Pending hexutil.Uint `json:"pending"`
+	Queued  hexutil.Uint `json:"queued"`
+}
+
+// JsonRPCAccountProof is the result of eth_getProof, as per EIP-1186
+type JsonRPCAccountProof struct {
+	Address      common.Address        `json:"address"`
+	AccountProof []string              `json:"accountProof"`
+	Balance      *hexutil.Big          `json:"balance"`
+	CodeHash     common.Hash           `json:"codeHash"`
+	Nonce        hexutil.Uint64        `json:"nonce"`
+	StorageHash  common.Hash           `json:"storageHash"`
+	StorageProof []JsonRPCStorageProof `json:"storageProof"`
+}
+
+type JsonRPCStorageProof struct {
+	Key   string       `json:"key"`
+	Value *hexutil.Big `json:"value"`
+	Proof []string     `json:"proof"`
+}
+
+// JsonDroppedTx is the notification of the droppedTransactions subscription
+type JsonDroppedTx struct {
+	Hash   common.Hash `json:"hash"`
+	Reason string      `json:"reason"`
+}
+
+// JsonExecutionResult is the result of a transaction traced with the struct
+// logger, in the format of go-ethereum's debug API
+type JsonExecutionResult struct {
+	Gas         uint64          `json:"gas"`
+	Failed      bool            `json:"failed"`
+	ReturnValue string          `json:"returnValue"`
+	StructLogs  []JsonStructLog `json:"structLogs"`
+}
+
+// JsonStructLog is an EVM step. Stack, memory, and storage words are hex
+// encoded without prefix.
+type JsonStructLog struct {
+	Pc      uint64             `json:"pc"`
+	Op      string             `json:"op"`
+	Gas     uint64             `json:"gas"`
+	GasCost uint64             `json:"gasCost"`
+	Depth   int                `json:"depth"`
+	Error   string             `json:"error,omitempty"`
+	Stack   *[]string          `json:"stack,omitempty"`
+	Memory  *[]string          `json:"memory,omitempty"`
+	Storage *map[string]string `json:"storage,omitempty"`
+}
@@ -0,0 +1,378 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abassian/shuffle/src/state"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsSendQueue is the number of outgoing messages that can be queued for a
+	// WebSocket client. A client that falls further behind is disconnected,
+	// so that it never slows down the State.
+	wsSendQueue = 256
+
+	// wsEventBuffer is the size of the channels that receive State events
+	wsEventBuffer = 128
+
+	wsWriteTimeout = 10 * time.Second
+)
+
+// Origins are not restricted, consistently with the CORS policy of the HTTP
+// API.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+type jsonrpcNotification struct {
+	Version string             `json:"jsonrpc"`
+	Method  string             `json:"method"`
+	Params  subscriptionResult `json:"params"`
+}
+
+type subscriptionResult struct {
+	ID     string      `json:"subscription"`
+	Result interface{} `json:"result"`
+}
+
+/*
+GET /ws
+upgrades to a WebSocket carrying JSON-RPC 2.0 messages
+
+All the methods of the POST /rpc endpoint are available, as well as
+eth_subscribe and eth_unsubscribe. The supported subscriptions are:
+
+	["newHeads"]                             a header for every new block
+	["logs", {"address": ..., "topics": ...}] every new log matching the filter
+	["newPendingTransactions"]               the hash of every submitted tx
+	["droppedTransactions"]                  the hash of every tx dropped from
+	                                         the pool, and the reason
+
+Notifications are sent as eth_subscription messages, as with go-ethereum.
+*/
+func wsHandler(w http.ResponseWriter, r *http.Request, m *Service) {
+	m.logger.Debug("GET ws")
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		m.logger.WithError(err).Error("Upgrading to WebSocket")
+		return
+	}
+
+	c := &wsConn{
+		service: m,
+		conn:    conn,
+		sendCh:  make(chan interface{}, wsSendQueue),
+		closeCh: make(chan struct{}),
+		subs:    make(map[string]event.Subscription),
+	}
+
+	go c.writeLoop()
+	c.readLoop()
+}
+
+// wsConn is a WebSocket client and its subscriptions
+type wsConn struct {
+	service *Service
+	conn    *websocket.Conn
+
+	sendCh    chan interface{}
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	subsLock sync.Mutex
+	subs     map[string]event.Subscription
+}
+
+func (c *wsConn) readLoop() {
+	defer c.close()
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.service.logger.WithError(err).Debug("WebSocket closed")
+			return
+		}
+
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '[' {
+			var batch []json.RawMessage
+			if err := json.Unmarshal(data, &batch); err != nil {
+				c.send(newJSONRPCErrorResponse(nil, errCodeParse, err.Error()))
+				continue
+			}
+			if len(batch) == 0 {
+				c.send(newJSONRPCErrorResponse(nil, errCodeInvalidRequest, "empty batch"))
+				continue
+			}
+			responses := []*jsonrpcResponse{}
+			for _, raw := range batch {
+				if resp := c.handleMessage(raw); resp != nil {
+					responses = append(responses, resp)
+				}
+			}
+			if len(responses) > 0 {
+				c.send(responses)
+			}
+			continue
+		}
+
+		if resp := c.handleMessage(data); resp != nil {
+			c.send(resp)
+		}
+	}
+}
+
+func (c *wsConn) writeLoop() {
+	for {
+		select {
+		case msg := <-c.sendCh:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.service.logger.WithError(err).Debug("Writing to WebSocket")
+				c.close()
+				return
+			}
+		case <-c.closeCh:
+			return
+		}
+	}
+}
+
+// send queues a message for the client without blocking
+func (c *wsConn) send(msg interface{}) {
+	select {
+	case c.sendCh <- msg:
+	case <-c.closeCh:
+	default:
+		c.service.logger.Warn("WebSocket client too slow, closing connection")
+		c.close()
+	}
+}
+
+func (c *wsConn) notify(id string, result interface{}) {
+	c.send(&jsonrpcNotification{
+		Version: jsonrpcVersion,
+		Method:  "eth_subscription",
+		Params: subscriptionResult{
+			ID:     id,
+			Result: result,
+		},
+	})
+}
+
+func (c *wsConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		c.conn.Close()
+
+		c.subsLock.Lock()
+		for id, sub := range c.subs {
+			sub.Unsubscribe()
+			delete(c.subs, id)
+		}
+		c.subsLock.Unlock()
+	})
+}
+
+// handleMessage executes a single JSON-RPC request. Subscriptions are bound
+// to the connection, so they are handled here; the other methods are
+// delegated to the Service.
+func (c *wsConn) handleMessage(raw json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(raw, &req); err == nil && req.Version == jsonrpcVersion {
+		switch req.Method {
+		case "eth_subscribe":
+			result, err := c.subscribe(req.Params)
+			return c.respond(req.ID, result, err)
+		case "eth_unsubscribe":
+			result, err := c.unsubscribe(req.Params)
+			return c.respond(req.ID, result, err)
+		}
+	}
+
+	return c.service.handleJSONRPCMessage(raw)
+}
+
+func (c *wsConn) respond(id json.RawMessage, result interface{}, err error) *jsonrpcResponse {
+	if id == nil {
+		return nil
+	}
+
+	if err != nil {
+		if rpcErr, ok := err.(*jsonrpcError); ok {
+			return newJSONRPCErrorResponse(id, rpcErr.Code, rpcErr.Message)
+		}
+		return newJSONRPCErrorResponse(id, errCodeServer, err.Error())
+	}
+
+	js, err := json.Marshal(result)
+	if err != nil {
+		return newJSONRPCErrorResponse(id, errCodeInternal, err.Error())
+	}
+
+	return &jsonrpcResponse{
+		Version: jsonrpcVersion,
+		ID:      id,
+		Result:  js,
+	}
+}
+
+//------------------------------------------------------------------------------
+
+func (c *wsConn) subscribe(params json.RawMessage) (interface{}, error) {
+	var kind string
+	var criteria FilterCriteria
+	if err := parseParams(params, 1, &kind, &criteria); err != nil {
+		return nil, err
+	}
+
+	id, err := newSubscriptionID()
+	if err != nil {
+		return nil, err
+	}
+
+	var sub event.Subscription
+	switch kind {
+	case "newHeads":
+		sub = c.subscribeNewHeads(id)
+	case "logs":
+		sub = c.subscribeLogs(id, criteria)
+	case "newPendingTransactions":
+		sub = c.subscribePendingTxs(id)
+	case "droppedTransactions":
+		sub = c.subscribeDroppedTxs(id)
+	default:
+		return nil, invalidParams("unsupported subscription %q", kind)
+	}
+
+	// The connection may have been closed in the meantime, in which case the
+	// subscription would never be released
+	c.subsLock.Lock()
+	defer c.subsLock.Unlock()
+	select {
+	case <-c.closeCh:
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("connection closed")
+	default:
+	}
+	c.subs[id] = sub
+
+	c.service.logger.WithField("kind", kind).WithField("id", id).Debug("Subscribed")
+
+	return id, nil
+}
+
+func (c *wsConn) unsubscribe(params json.RawMessage) (interface{}, error) {
+	var id string
+	if err := parseParams(params, 1, &id); err != nil {
+		return nil, err
+	}
+
+	c.subsLock.Lock()
+	sub, ok := c.subs[id]
+	delete(c.subs, id)
+	c.subsLock.Unlock()
+
+	if ok {
+		sub.Unsubscribe()
+	}
+
+	return ok, nil
+}
+
+func (c *wsConn) subscribeNewHeads(id string) event.Subscription {
+	ch := make(chan state.NewBlockEvent, wsEventBuffer)
+	sub := c.service.state.SubscribeNewBlocks(ch)
+
+	go func() {
+		for {
+			select {
+			case ev := <-ch:
+				c.notify(id, newJSONRPCHeader(c.service, ev.Block))
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+
+	return sub
+}
+
+func (c *wsConn) subscribeLogs(id string, criteria FilterCriteria) event.Subscription {
+	ch := make(chan state.NewBlockEvent, wsEventBuffer)
+	sub := c.service.state.SubscribeNewBlocks(ch)
+
+	go func() {
+		for {
+			select {
+			case ev := <-ch:
+				for _, log := range criteria.Filter(ev.Logs) {
+					c.notify(id, log)
+				}
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+
+	return sub
+}
+
+func (c *wsConn) subscribePendingTxs(id string) event.Subscription {
+	ch := make(chan state.NewTxEvent, wsEventBuffer)
+	sub := c.service.state.SubscribeNewTxs(ch)
+
+	go func() {
+		for {
+			select {
+			case ev := <-ch:
+				c.notify(id, ev.Tx.Hash())
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+
+	return sub
+}
+
+func (c *wsConn) subscribeDroppedTxs(id string) event.Subscription {
+	ch := make(chan state.DroppedTxEvent, wsEventBuffer)
+	sub := c.service.state.SubscribeDroppedTxs(ch)
+
+	go func() {
+		for {
+			select {
+			case ev := <-ch:
+				c.notify(id, JsonDroppedTx{
+					Hash:   ev.Tx.Hash(),
+					Reason: ev.Reason.Error(),
+				})
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+
+	return sub
+}
+
+func newSubscriptionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hexutil.Encode(id), nil
+}
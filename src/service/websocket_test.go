@@ -0,0 +1,220 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/gorilla/websocket"
+)
+
+// wsMessage is either a response or a subscription notification
+type wsMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *jsonrpcError   `json:"error"`
+	Method string          `json:"method"`
+	Params struct {
+		ID     string          `json:"subscription"`
+		Result json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+func dialWS(t *testing.T, server *httptest.Server) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func readWS(t *testing.T, conn *websocket.Conn, v interface{}) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// callWS sends a request and returns its response, which must be the next
+// message
+func callWS(t *testing.T, conn *websocket.Conn, req string) *wsMessage {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	var msg wsMessage
+	readWS(t, conn, &msg)
+	if msg.Method != "" {
+		t.Fatalf("%s should be answered, got a %s notification", req, msg.Method)
+	}
+	return &msg
+}
+
+func subscribeWS(t *testing.T, conn *websocket.Conn, params string) string {
+	msg := callWS(t, conn, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":`+params+`}`)
+	if msg.Error != nil {
+		t.Fatalf("Subscribing to %s: %v", params, msg.Error)
+	}
+	var id string
+	if err := json.Unmarshal(msg.Result, &id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestWebSocketSubscriptions(t *testing.T) {
+	test := NewTest(t)
+	defer test.Close()
+
+	m := NewService("", "", "", test.state, make(chan []byte), bcommon.NewTestLogger(t))
+
+	server := httptest.NewServer(m.newRouter())
+	defer server.Close()
+
+	conn := dialWS(t, server)
+	defer conn.Close()
+
+	headsID := subscribeWS(t, conn, `["newHeads"]`)
+	txsID := subscribeWS(t, conn, `["newPendingTransactions"]`)
+
+	if msg := callWS(t, conn, `{"jsonrpc":"2.0","id":1,"method":"eth_subscribe","params":["syncing"]}`); msg.Error == nil || msg.Error.Code != errCodeInvalidParams {
+		t.Fatalf("An unsupported subscription should fail with error code %d, got %+v", errCodeInvalidParams, msg.Error)
+	}
+
+	// The other methods are available, in batches too
+	var batch []wsMessage
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`[
+		{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","method":"eth_blockNumber"},
+		{"jsonrpc":"2.0","id":2,"method":"eth_unknown"}
+	]`)); err != nil {
+		t.Fatal(err)
+	}
+	readWS(t, conn, &batch)
+	if len(batch) != 2 || string(batch[0].Result) != `"0x0"` || batch[1].Error == nil || batch[1].Error.Code != errCodeMethodNotFound {
+		t.Fatalf("The batch should get 2 responses, got %+v", batch)
+	}
+
+	tx := test.newTx(t, 0)
+	if _, err := test.state.CheckTx(tx); err != nil {
+		t.Fatal(err)
+	}
+	test.commit(t, tx)
+
+	// The notifications of different subscriptions are not ordered
+	var gotTx, gotHead bool
+	for !gotTx || !gotHead {
+		var msg wsMessage
+		readWS(t, conn, &msg)
+		if msg.Method != "eth_subscription" {
+			t.Fatalf("Expected a notification, got %+v", msg)
+		}
+
+		switch msg.Params.ID {
+		case txsID:
+			var hash common.Hash
+			if err := json.Unmarshal(msg.Params.Result, &hash); err != nil {
+				t.Fatal(err)
+			}
+			if gotTx || hash != tx.Hash() {
+				t.Fatalf("The transaction should be notified once, got %s", msg.Params.Result)
+			}
+			gotTx = true
+		case headsID:
+			var header JsonRPCHeader
+			if err := json.Unmarshal(msg.Params.Result, &header); err != nil {
+				t.Fatal(err)
+			}
+			if gotHead || header.Number != hexutil.Uint64(1) || header.Hash != test.state.GetHeadBlock().Hash() {
+				t.Fatalf("Block 1 should be notified once, got %s", msg.Params.Result)
+			}
+			gotHead = true
+		default:
+			t.Fatalf("Unknown subscription %s", msg.Params.ID)
+		}
+	}
+
+	if msg := callWS(t, conn, `{"jsonrpc":"2.0","id":1,"method":"eth_unsubscribe","params":["`+headsID+`"]}`); string(msg.Result) != "true" {
+		t.Fatalf("Unsubscribing should return true, got %s %+v", msg.Result, msg.Error)
+	}
+	if msg := callWS(t, conn, `{"jsonrpc":"2.0","id":1,"method":"eth_unsubscribe","params":["`+headsID+`"]}`); string(msg.Result) != "false" {
+		t.Fatalf("Unsubscribing twice should return false, got %s %+v", msg.Result, msg.Error)
+	}
+
+	// Without the newHeads subscription, the next message is the response
+	test.commit(t, test.newTx(t, 1))
+	if msg := callWS(t, conn, `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber"}`); string(msg.Result) != `"0x2"` {
+		t.Fatalf("eth_blockNumber should return 0x2, got %s %+v", msg.Result, msg.Error)
+	}
+}
+
+func TestWebSocketSlowClient(t *testing.T) {
+	test := NewTest(t)
+	defer test.Close()
+
+	m := NewService("", "", "", test.state, make(chan []byte), bcommon.NewTestLogger(t))
+
+	// The writeLoop is not started, as if the client had stopped reading and
+	// the writes were blocked
+	conns := make(chan *wsConn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- &wsConn{
+			service: m,
+			conn:    conn,
+			sendCh:  make(chan interface{}, wsSendQueue),
+			closeCh: make(chan struct{}),
+			subs:    make(map[string]event.Subscription),
+		}
+	}))
+	defer server.Close()
+
+	client := dialWS(t, server)
+	defer client.Close()
+	c := <-conns
+
+	if _, err := c.subscribe(json.RawMessage(`["newHeads"]`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < wsSendQueue; i++ {
+		c.send(i)
+	}
+	select {
+	case <-c.closeCh:
+		t.Fatal("The connection should stay open while the queue is not full")
+	default:
+	}
+
+	c.send(wsSendQueue)
+	select {
+	case <-c.closeCh:
+	default:
+		t.Fatal("The connection should be closed once the queue overflows")
+	}
+
+	c.subsLock.Lock()
+	subs := len(c.subs)
+	c.subsLock.Unlock()
+	if subs != 0 {
+		t.Fatalf("The subscriptions should be released, %d are left", subs)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := client.ReadMessage()
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Fatalf("The client should be disconnected, got %v", err)
+	}
+}
@@ -0,0 +1,365 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+
+	"github.com/abassian/shuffle/src/database"
+)
+
+var (
+	blockPrefix       = []byte("block-")    // blockPrefix + hash -> block
+	blockNumberPrefix = []byte("blocknum-") // blockNumberPrefix + num (uint64 big endian) -> hash
+	headBlockKey      = []byte("head-block")
+	genesisHashKey    = []byte("genesis-hash")
+	restoringKey      = []byte("restoring") // present while a snapshot is restored
+	rejectedTxPrefix  = []byte("rejected-") // rejectedTxPrefix + tx hash -> RejectedTx
+)
+
+// ReceiptStatusRejected is the status of the receipt of a rejected
+// transaction, next to go-ethereum's ReceiptStatusFailed and
+// ReceiptStatusSuccessful.
+const ReceiptStatusRejected = uint64(2)
+
+// BlockInfo contains the information that the consensus system attaches to a
+// block when it is committed.
+type BlockInfo struct {
+	// Timestamp is the time of the block, in seconds, as agreed by the
+	// consensus system. It is left to zero by consensus systems that do not
+	// have a common notion of time.
+	Timestamp uint64
+
+	// Consensus is the name of the consensus system that produced the block
+	Consensus string
+
+	// ConsensusIndex is the position of the block in the consensus system (Raft
+	// log index, Huron block index, etc.)
+	ConsensusIndex uint64
+
+	// ConsensusHash is the hash of the block in the consensus system, if any
+	ConsensusHash []byte
+}
+
+// Block is a batch of transactions committed together to the state. Each call
+// to State.Commit produces a new Block, regardless of the consensus system, so
+// block numbers are monotonic and contiguous starting at 0 (genesis).
+type Block struct {
+	Number       uint64
+	ParentHash   common.Hash
+	StateRoot    common.Hash
+	ReceiptsRoot common.Hash
+	LogsBloom    ethTypes.Bloom
+	GasUsed      uint64
+	Coinbase     common.Address // zero if the fees were burnt
+	TxHashes     []common.Hash
+
+	BlockInfo
+}
+
+// Hash returns the Keccak256 hash of the RLP encoding of the block
+func (b *Block) Hash() common.Hash {
+	data, _ := rlp.EncodeToBytes(b)
+	return crypto.Keccak256Hash(data)
+}
+
+// TxLookupEntry is stored alongside each transaction to locate it in the
+// chain of blocks.
+type TxLookupEntry struct {
+	BlockHash   common.Hash
+	BlockNumber uint64
+	Index       uint64
+}
+
+// RejectedTx records a transaction that the consensus system ordered, but that
+// could not be applied to the state, like one with a wrong nonce or from an
+// account without enough funds. It is not part of any block, and did not
+// change the state; BlockNumber is that of the block it was ordered in.
+type RejectedTx struct {
+	Tx          *ethTypes.Transaction
+	BlockHash   common.Hash
+	BlockNumber uint64
+	Reason      string
+}
+
+// storedReceipt is the encoding of a receipt in the database, which is that of
+// go-ethereum 1.8. Unlike the ReceiptForStorage of later versions, it keeps
+// the fields that are derived from the block, so that a receipt, and its logs,
+// can be read without the block and its other receipts.
+type storedReceipt struct {
+	PostStateOrStatus []byte
+	CumulativeGasUsed uint64
+	Bloom             ethTypes.Bloom
+	TxHash            common.Hash
+	ContractAddress   common.Address
+	Logs              []*storedLog
+	GasUsed           uint64
+}
+
+// storedLog is the encoding of a log in a storedReceipt
+type storedLog struct {
+	Address     common.Address
+	Topics      []common.Hash
+	Data        []byte
+	BlockNumber uint64
+	TxHash      common.Hash
+	TxIndex     uint
+	BlockHash   common.Hash
+	Index       uint
+}
+
+//------------------------------------------------------------------------------
+
+func blockKey(hash common.Hash) []byte {
+	return append(append([]byte{}, blockPrefix...), hash.Bytes()...)
+}
+
+func blockNumberKey(number uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, number)
+	return append(append([]byte{}, blockNumberPrefix...), enc...)
+}
+
+func txLookupKey(hash common.Hash) []byte {
+	return append(hash.Bytes(), txMetaSuffix...)
+}
+
+func receiptKey(hash common.Hash) []byte {
+	return append(append([]byte{}, receiptsPrefix...), hash.Bytes()...)
+}
+
+func rejectedTxKey(hash common.Hash) []byte {
+	return append(append([]byte{}, rejectedTxPrefix...), hash.Bytes()...)
+}
+
+// writeBlock stores a block and indexes it by number. It also moves the head
+// pointer to the block.
+func writeBlock(db DatabasePutter, block *Block) error {
+	data, err := rlp.EncodeToBytes(block)
+	if err != nil {
+		return err
+	}
+
+	hash := block.Hash()
+
+	if err := db.Put(blockKey(hash), data); err != nil {
+		return err
+	}
+	if err := db.Put(blockNumberKey(block.Number), hash.Bytes()); err != nil {
+		return err
+	}
+	return db.Put(headBlockKey, hash.Bytes())
+}
+
+func readBlock(db DatabaseReader, hash common.Hash) (*Block, error) {
+	data, err := db.Get(blockKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	block := new(Block)
+	if err := rlp.DecodeBytes(data, block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+func readBlockHash(db DatabaseReader, number uint64) (common.Hash, error) {
+	data, err := db.Get(blockNumberKey(number))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return common.BytesToHash(data), nil
+}
+
+// readHeadBlock returns the last committed block, or nil if no block was ever
+// committed.
+func readHeadBlock(db DatabaseReader) (*Block, error) {
+	if ok, err := db.Has(headBlockKey); err != nil || !ok {
+		return nil, err
+	}
+	data, err := db.Get(headBlockKey)
+	if err != nil {
+		return nil, err
+	}
+	return readBlock(db, common.BytesToHash(data))
+}
+
+// readGenesisHash returns the hash of the genesis file that the database was
+// created from, or nil if it was not recorded
+func readGenesisHash(db DatabaseReader) (*common.Hash, error) {
+	if ok, err := db.Has(genesisHashKey); err != nil || !ok {
+		return nil, err
+	}
+	data, err := db.Get(genesisHashKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := common.BytesToHash(data)
+	return &hash, nil
+}
+
+func writeGenesisHash(db DatabasePutter, hash common.Hash) error {
+	return db.Put(genesisHashKey, hash.Bytes())
+}
+
+func writeTxLookupEntry(db DatabasePutter, txHash common.Hash, entry TxLookupEntry) error {
+	data, err := rlp.EncodeToBytes(entry)
+	if err != nil {
+		return err
+	}
+	return db.Put(txLookupKey(txHash), data)
+}
+
+func readTxLookupEntry(db DatabaseReader, txHash common.Hash) (*TxLookupEntry, error) {
+	data, err := db.Get(txLookupKey(txHash))
+	if err != nil {
+		return nil, err
+	}
+	entry := new(TxLookupEntry)
+	if err := rlp.DecodeBytes(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func writeReceipt(db DatabasePutter, receipt *ethTypes.Receipt) error {
+	data, err := encodeReceipt(receipt)
+	if err != nil {
+		return err
+	}
+	return db.Put(receiptKey(receipt.TxHash), data)
+}
+
+func readReceipt(db DatabaseReader, txHash common.Hash) (*ethTypes.Receipt, error) {
+	data, err := db.Get(receiptKey(txHash))
+	if err != nil {
+		return nil, err
+	}
+	return decodeReceipt(data)
+}
+
+// encodeReceipt returns the storedReceipt encoding of a receipt
+func encodeReceipt(receipt *ethTypes.Receipt) ([]byte, error) {
+	stored := storedReceipt{
+		PostStateOrStatus: receipt.PostState,
+		CumulativeGasUsed: receipt.CumulativeGasUsed,
+		Bloom:             receipt.Bloom,
+		TxHash:            receipt.TxHash,
+		ContractAddress:   receipt.ContractAddress,
+		Logs:              make([]*storedLog, len(receipt.Logs)),
+		GasUsed:           receipt.GasUsed,
+	}
+	if len(receipt.PostState) == 0 && receipt.Status == ethTypes.ReceiptStatusSuccessful {
+		stored.PostStateOrStatus = []byte{0x01}
+	}
+	for i, log := range receipt.Logs {
+		stored.Logs[i] = &storedLog{
+			Address:     log.Address,
+			Topics:      log.Topics,
+			Data:        log.Data,
+			BlockNumber: log.BlockNumber,
+			TxHash:      log.TxHash,
+			TxIndex:     log.TxIndex,
+			BlockHash:   log.BlockHash,
+			Index:       log.Index,
+		}
+	}
+
+	return rlp.EncodeToBytes(stored)
+}
+
+// decodeReceipt decodes a receipt from its storedReceipt encoding
+func decodeReceipt(data []byte) (*ethTypes.Receipt, error) {
+	var stored storedReceipt
+	if err := rlp.DecodeBytes(data, &stored); err != nil {
+		return nil, err
+	}
+
+	receipt := &ethTypes.Receipt{
+		CumulativeGasUsed: stored.CumulativeGasUsed,
+		Bloom:             stored.Bloom,
+		TxHash:            stored.TxHash,
+		ContractAddress:   stored.ContractAddress,
+		Logs:              make([]*ethTypes.Log, len(stored.Logs)),
+		GasUsed:           stored.GasUsed,
+	}
+	switch {
+	case bytes.Equal(stored.PostStateOrStatus, []byte{0x01}):
+		receipt.Status = ethTypes.ReceiptStatusSuccessful
+	case len(stored.PostStateOrStatus) == 0:
+		receipt.Status = ethTypes.ReceiptStatusFailed
+	case len(stored.PostStateOrStatus) == len(common.Hash{}):
+		receipt.PostState = stored.PostStateOrStatus
+	default:
+		return nil, fmt.Errorf("invalid receipt status %x", stored.PostStateOrStatus)
+	}
+	for i, log := range stored.Logs {
+		receipt.Logs[i] = &ethTypes.Log{
+			Address:     log.Address,
+			Topics:      log.Topics,
+			Data:        log.Data,
+			BlockNumber: log.BlockNumber,
+			TxHash:      log.TxHash,
+			TxIndex:     log.TxIndex,
+			BlockHash:   log.BlockHash,
+			Index:       log.Index,
+		}
+	}
+
+	return receipt, nil
+}
+
+func writeRejectedTx(db DatabasePutter, rejected *RejectedTx) error {
+	data, err := rlp.EncodeToBytes(rejected)
+	if err != nil {
+		return err
+	}
+	return db.Put(rejectedTxKey(rejected.Tx.Hash()), data)
+}
+
+func readRejectedTx(db DatabaseReader, txHash common.Hash) (*RejectedTx, error) {
+	data, err := db.Get(rejectedTxKey(txHash))
+	if err != nil {
+		return nil, err
+	}
+	rejected := new(RejectedTx)
+	if err := rlp.DecodeBytes(data, rejected); err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// deleteRejectedTxs deletes the records of the transactions rejected in the
+// blocks after number. They are not listed in their block, so they are looked
+// up in db.
+func deleteRejectedTxs(db database.Database, deleter DatabaseDeleter, number uint64) error {
+	it := db.NewIterator()
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if bytes.Compare(key, rejectedTxPrefix) < 0 {
+			continue
+		}
+		if !bytes.HasPrefix(key, rejectedTxPrefix) {
+			break
+		}
+
+		rejected := new(RejectedTx)
+		if err := rlp.DecodeBytes(it.Value(), rejected); err != nil {
+			return err
+		}
+		if rejected.BlockNumber > number {
+			if err := deleter.Delete(common.CopyBytes(key)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return it.Error()
+}
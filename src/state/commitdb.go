@@ -0,0 +1,220 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+
+	"github.com/abassian/shuffle/src/database"
+)
+
+// commitDB is the database that the WAS and the trie.Database write to. Its
+// writes are not sent to disk one by one, but collected until Write, which
+// stores them in a single atomic batch: everything that a call to Commit
+// writes, from the trie nodes to the head pointer, is on disk, or none of it
+// is. The pending writes are visible to the reads of the commitDB, which the
+// StateDBs go through, so trie nodes remain available while they are moved
+// from the trie.Database to disk.
+type commitDB struct {
+	database.Database
+
+	mu      sync.RWMutex
+	pending map[string]pendingWrite
+}
+
+// pendingWrite is a write of a commitDB that is not yet on disk
+type pendingWrite struct {
+	value   []byte
+	deleted bool
+}
+
+func newCommitDB(db database.Database) *commitDB {
+	return &commitDB{
+		Database: db,
+		pending:  make(map[string]pendingWrite),
+	}
+}
+
+func (db *commitDB) Put(key []byte, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.put(key, value)
+}
+
+func (db *commitDB) put(key []byte, value []byte) error {
+	db.pending[string(key)] = pendingWrite{value: common.CopyBytes(value)}
+	return nil
+}
+
+func (db *commitDB) Delete(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.delete(key)
+}
+
+func (db *commitDB) delete(key []byte) error {
+	db.pending[string(key)] = pendingWrite{deleted: true}
+	return nil
+}
+
+func (db *commitDB) Has(key []byte) (bool, error) {
+	db.mu.RLock()
+	w, ok := db.pending[string(key)]
+	db.mu.RUnlock()
+
+	if ok {
+		return !w.deleted, nil
+	}
+	return db.Database.Has(key)
+}
+
+func (db *commitDB) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+	w, ok := db.pending[string(key)]
+	db.mu.RUnlock()
+
+	if ok {
+		if w.deleted {
+			return nil, database.ErrNotFound
+		}
+		return w.value, nil
+	}
+	return db.Database.Get(key)
+}
+
+// NewBatch returns a batch that adds its writes to the pending ones when it is
+// written. The trie.Database flushes its batches whenever they grow past
+// ethdb.IdealBatchSize, which no longer splits a commit.
+func (db *commitDB) NewBatch() ethdb.Batch {
+	return db.newBatch()
+}
+
+func (db *commitDB) newBatch() *commitBatch {
+	return &commitBatch{db: db}
+}
+
+// Write stores the pending writes on disk, atomically. If it fails, they stay
+// pending.
+func (db *commitDB) Write() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(db.pending) == 0 {
+		return nil
+	}
+
+	batch := db.Database.NewBatch()
+	for key, w := range db.pending {
+		var err error
+		if w.deleted {
+			err = batch.Delete([]byte(key))
+		} else {
+			err = batch.Put([]byte(key), w.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	db.pending = make(map[string]pendingWrite)
+
+	return nil
+}
+
+// Discard drops the pending writes
+func (db *commitDB) Discard() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.pending = make(map[string]pendingWrite)
+}
+
+// Drop removes the writes of a batch from the pending ones. The other pending
+// writes, such as the trie nodes that the trie.Database no longer holds, are
+// kept.
+func (db *commitDB) Drop(b *commitBatch) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, op := range b.ops {
+		delete(db.pending, string(op.key))
+	}
+}
+
+// commitBatch is a batch of a commitDB
+type commitBatch struct {
+	db   *commitDB
+	ops  []pendingOp
+	size int
+}
+
+// pendingOp is a write recorded in a commitBatch
+type pendingOp struct {
+	key []byte
+	pendingWrite
+}
+
+func (b *commitBatch) Put(key, value []byte) error {
+	b.ops = append(b.ops, pendingOp{
+		key:          common.CopyBytes(key),
+		pendingWrite: pendingWrite{value: common.CopyBytes(value)},
+	})
+	b.size += len(value)
+	return nil
+}
+
+func (b *commitBatch) Delete(key []byte) error {
+	b.ops = append(b.ops, pendingOp{
+		key:          common.CopyBytes(key),
+		pendingWrite: pendingWrite{deleted: true},
+	})
+	b.size++
+	return nil
+}
+
+func (b *commitBatch) ValueSize() int {
+	return b.size
+}
+
+func (b *commitBatch) Write() error {
+	b.db.mu.Lock()
+	defer b.db.mu.Unlock()
+
+	for _, op := range b.ops {
+		var err error
+		if op.deleted {
+			err = b.db.delete(op.key)
+		} else {
+			err = b.db.put(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *commitBatch) Reset() {
+	b.ops = nil
+	b.size = 0
+}
+
+func (b *commitBatch) Replay(w ethdb.KeyValueWriter) error {
+	for _, op := range b.ops {
+		var err error
+		if op.deleted {
+			err = w.Delete(op.key)
+		} else {
+			err = w.Put(op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,37 +1,88 @@
 package state
 
 import (
+	"errors"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
+
+	bcommon "github.com/abassian/shuffle/src/common"
 )
 
 var (
-	//CustomChainConfig accounts for the fact that Shuffle doesn't really have
-	//a concetp of Chain, or Blocks (being consensus-agnostic). The EVM is
-	//tightly coupled with this ChainConfig object (cf interpreter.go), so this
-	//is a workaround that treats all blocks the same.
+	//CustomChainConfig is used when the genesis file does not define a chain
+	//config. It is the config of the chains created by earlier versions of
+	//Shuffle, which treated all blocks the same, so it must not change: every
+	//block follows the Constantinople rules and the chain ID is 1, like the
+	//Ethereum mainnet.
 	CustomChainConfig = params.ChainConfig{
 		ChainID:             big.NewInt(1),
 		ConstantinopleBlock: big.NewInt(0),
 	}
 )
 
-func NewContext(origin common.Address, gasLimit uint64, gasPrice *big.Int) vm.Context {
+// NewChainConfig converts the chain config of a genesis file to the config of
+// the EVM.
+func NewChainConfig(config *bcommon.ChainConfig) (params.ChainConfig, error) {
+	if config == nil {
+		return CustomChainConfig, nil
+	}
+
+	if config.ChainID == nil || config.ChainID.Sign() <= 0 {
+		return params.ChainConfig{}, errors.New("genesis config: chainId must be positive")
+	}
+
+	return params.ChainConfig{
+		ChainID:             config.ChainID,
+		HomesteadBlock:      config.HomesteadBlock,
+		EIP150Block:         config.EIP150Block,
+		EIP155Block:         config.EIP155Block,
+		EIP158Block:         config.EIP158Block,
+		ByzantiumBlock:      config.ByzantiumBlock,
+		ConstantinopleBlock: config.ConstantinopleBlock,
+		PetersburgBlock:     config.PetersburgBlock,
+		IstanbulBlock:       config.IstanbulBlock,
+	}, nil
+}
+
+// NewContext returns the context of a transaction included in the block with
+// the given number and timestamp. The block number selects the fork rules of
+// the EVM. getHash returns the hashes of previous blocks, for the BLOCKHASH
+// opcode; the EVM only asks for the last 256.
+func NewContext(origin common.Address,
+	gasLimit uint64,
+	gasPrice *big.Int,
+	blockNumber uint64,
+	timestamp uint64,
+	getHash vm.GetHashFunc) vm.Context {
+
 	context := vm.Context{
 		CanTransfer: core.CanTransfer,
 		Transfer:    core.Transfer,
-		GetHash:     func(uint64) common.Hash { return common.Hash{} },
+		GetHash:     getHash,
 		// Message information
 		Origin:   origin,
 		GasLimit: gasLimit,
 		GasPrice: gasPrice,
-		//The vm has a dependency on this
-		//Anything greate than ConstantinopleBlock will do here.
-		BlockNumber: CustomChainConfig.ConstantinopleBlock,
+		// Block information
+		BlockNumber: new(big.Int).SetUint64(blockNumber),
+		Time:        new(big.Int).SetUint64(timestamp),
+		Difficulty:  new(big.Int),
 	}
 	return context
 }
+
+// getHashFn returns a GetHashFunc that reads the hashes of committed blocks
+// from the DB. The hash of a block that is not found is the zero hash.
+func getHashFn(db DatabaseReader) vm.GetHashFunc {
+	return func(number uint64) common.Hash {
+		hash, err := readBlockHash(db, number)
+		if err != nil {
+			return common.Hash{}
+		}
+		return hash
+	}
+}
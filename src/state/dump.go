@@ -0,0 +1,236 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// emptyCodeHash is the code hash of accounts without code
+var emptyCodeHash = crypto.Keccak256Hash(nil)
+
+// Dump is the world state at a given root, as written by DumpState
+type Dump struct {
+	Root     common.Hash                    `json:"root"`
+	Accounts map[common.Address]DumpAccount `json:"accounts"`
+}
+
+// DumpAccount is an account of a Dump. The balance is a decimal string.
+type DumpAccount struct {
+	Balance string                      `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// StateRoot returns the state root of the block with the given number, or of
+// the head block if number is nil
+func StateRoot(db DatabaseReader, number *uint64) (common.Hash, error) {
+	if number == nil {
+		head, err := readHeadBlock(db)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if head == nil {
+			return common.Hash{}, fmt.Errorf("no committed block")
+		}
+		return head.StateRoot, nil
+	}
+
+	hash, err := readBlockHash(db, *number)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("block %d not found: %v", *number, err)
+	}
+	block, err := readBlock(db, hash)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return block.StateRoot, nil
+}
+
+// DumpState writes every account of the state with the given root to w, as a
+// JSON Dump. Accounts are written one at a time, in the order of the trie, so
+// the state never needs to fit in memory. The addresses and storage keys are
+// recovered from the preimages that were stored along with the tries; the
+// dump fails if one is missing, rather than be incomplete.
+func DumpState(db ethdb.KeyValueStore, root common.Hash, w io.Writer) error {
+	stateDB := ethState.NewDatabase(rawdb.NewDatabase(db))
+
+	accountTrie, err := stateDB.OpenTrie(root)
+	if err != nil {
+		return fmt.Errorf("state %s is not available: %v", root.Hex(), err)
+	}
+
+	if _, err := fmt.Fprintf(w, "{\n\"root\": %q,\n\"accounts\": {", root.Hex()); err != nil {
+		return err
+	}
+
+	it := trie.NewIterator(accountTrie.NodeIterator(nil))
+	for first := true; it.Next(); first = false {
+		preimage := accountTrie.GetKey(it.Key)
+		if preimage == nil {
+			return fmt.Errorf("missing preimage of account %x", it.Key)
+		}
+		addr := common.BytesToAddress(preimage)
+
+		var data ethState.Account
+		if err := rlp.DecodeBytes(it.Value, &data); err != nil {
+			return err
+		}
+
+		account, err := dumpAccount(stateDB, common.BytesToHash(it.Key), data)
+		if err != nil {
+			return fmt.Errorf("dumping account %s: %v", addr.Hex(), err)
+		}
+
+		js, err := json.Marshal(account)
+		if err != nil {
+			return err
+		}
+
+		sep := ","
+		if first {
+			sep = ""
+		}
+		if _, err := fmt.Fprintf(w, "%s\n%q: %s", sep, strings.ToLower(addr.Hex()), js); err != nil {
+			return err
+		}
+	}
+	if it.Err != nil {
+		return it.Err
+	}
+
+	_, err = fmt.Fprintf(w, "\n}\n}\n")
+	return err
+}
+
+// dumpAccount reads the code and storage of an account
+func dumpAccount(stateDB ethState.Database, addrHash common.Hash, data ethState.Account) (*DumpAccount, error) {
+	account := &DumpAccount{
+		Balance: data.Balance.String(),
+		Nonce:   data.Nonce,
+	}
+
+	if codeHash := common.BytesToHash(data.CodeHash); codeHash != emptyCodeHash {
+		code, err := stateDB.ContractCode(addrHash, codeHash)
+		if err != nil {
+			return nil, err
+		}
+		account.Code = code
+	}
+
+	storageTrie, err := stateDB.OpenStorageTrie(addrHash, data.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	it := trie.NewIterator(storageTrie.NodeIterator(nil))
+	for it.Next() {
+		key := storageTrie.GetKey(it.Key)
+		if key == nil {
+			return nil, fmt.Errorf("missing preimage of storage key %x", it.Key)
+		}
+
+		// Values are stored as RLP strings, without leading zeros
+		_, content, _, err := rlp.Split(it.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		if account.Storage == nil {
+			account.Storage = make(map[common.Hash]common.Hash)
+		}
+		account.Storage[common.BytesToHash(key)] = common.BytesToHash(content)
+	}
+
+	return account, it.Err
+}
+
+// ReadDump decodes a Dump written by DumpState
+func ReadDump(r io.Reader) (*Dump, error) {
+	dump := new(Dump)
+	if err := json.NewDecoder(r).Decode(dump); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// GenesisFromDump turns a Dump into a genesis, to start a new network from
+// the exported state. The chain config, fee policy, and POA contract address
+// and ABI are taken from base, which is usually the genesis of the exported
+// network, and can be edited afterwards. The account of the POA contract,
+// with its whitelist, goes to the POA section, the others to the alloc
+// section, where they keep the authorising flag that they have in base.
+func GenesisFromDump(dump *Dump, base bcommon.Genesis) bcommon.Genesis {
+	genesis := bcommon.Genesis{
+		Config: base.Config,
+		Fees:   base.Fees,
+		Alloc:  make(bcommon.AccountMap),
+	}
+
+	var poa common.Address
+	if base.Poa.Address != "" {
+		poa = common.HexToAddress(base.Poa.Address)
+		genesis.Poa = bcommon.PoaMap{
+			Address: base.Poa.Address,
+			Abi:     base.Poa.Abi,
+		}
+	}
+
+	for addr, account := range dump.Accounts {
+		code := common.Bytes2Hex(account.Code)
+		storage := dumpStorage(account.Storage)
+
+		if base.Poa.Address != "" && addr == poa {
+			genesis.Poa.Balance = account.Balance
+			genesis.Poa.Nonce = account.Nonce
+			genesis.Poa.Code = code
+			genesis.Poa.Storage = storage
+			continue
+		}
+
+		entry := genesis.Alloc[strings.ToLower(addr.Hex())]
+		entry.Balance = account.Balance
+		entry.Nonce = account.Nonce
+		entry.Code = code
+		entry.Storage = storage
+		entry.Authorising = authorising(base.Alloc, addr)
+		genesis.Alloc[strings.ToLower(addr.Hex())] = entry
+	}
+
+	return genesis
+}
+
+// dumpStorage converts storage to the hex strings of the genesis
+func dumpStorage(storage map[common.Hash]common.Hash) map[string]string {
+	if len(storage) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(storage))
+	for key, value := range storage {
+		res[key.Hex()] = value.Hex()
+	}
+	return res
+}
+
+// authorising returns the authorising flag of an account of alloc, whose keys
+// may be written in any case
+func authorising(alloc bcommon.AccountMap, addr common.Address) bool {
+	for key, account := range alloc {
+		if common.HexToAddress(key) == addr {
+			return account.Authorising
+		}
+	}
+	return false
+}
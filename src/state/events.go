@@ -0,0 +1,62 @@
+package state
+
+import (
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/event"
+)
+
+// NewBlockEvent is sent to subscribers when a block is committed
+type NewBlockEvent struct {
+	Block *Block
+	Logs  []*ethTypes.Log
+}
+
+// NewTxEvent is sent to subscribers when a transaction becomes pending in the
+// TxPool, and is therefore about to be submitted to the consensus system.
+type NewTxEvent struct {
+	Tx *ethTypes.Transaction
+}
+
+// PromotedTxsEvent is sent to subscribers when queued transactions become
+// pending after a commit. They must be submitted to the consensus system, in
+// order, once taken with TakePromotedTxs.
+type PromotedTxsEvent struct {
+	Txs []*ethTypes.Transaction
+}
+
+// DroppedTxEvent is sent to subscribers when a transaction is dropped from the
+// TxPool after a commit, because it cannot be applied anymore or because it
+// expired. If it was pending, it may still be committed, but it will most
+// likely fail.
+type DroppedTxEvent struct {
+	Tx     *ethTypes.Transaction
+	Reason error
+}
+
+// SubscribeNewBlocks registers a channel to receive a NewBlockEvent for every
+// committed block. Commit blocks until the event is delivered, so the channel
+// should be buffered and drained promptly.
+func (s *State) SubscribeNewBlocks(ch chan<- NewBlockEvent) event.Subscription {
+	return s.blockFeed.Subscribe(ch)
+}
+
+// SubscribeNewTxs registers a channel to receive a NewTxEvent for every
+// transaction that becomes pending. CheckTx and Commit block until the event is
+// delivered, so the channel should be buffered and drained promptly.
+func (s *State) SubscribeNewTxs(ch chan<- NewTxEvent) event.Subscription {
+	return s.txFeed.Subscribe(ch)
+}
+
+// SubscribePromotedTxs registers a channel to receive a PromotedTxsEvent when
+// Commit promotes queued transactions. Commit blocks until the event is
+// delivered, so the channel should be buffered and drained promptly.
+func (s *State) SubscribePromotedTxs(ch chan<- PromotedTxsEvent) event.Subscription {
+	return s.promotedFeed.Subscribe(ch)
+}
+
+// SubscribeDroppedTxs registers a channel to receive a DroppedTxEvent for every
+// transaction dropped from the TxPool. Commit blocks until the event is
+// delivered, so the channel should be buffered and drained promptly.
+func (s *State) SubscribeDroppedTxs(ch chan<- DroppedTxEvent) event.Subscription {
+	return s.droppedFeed.Subscribe(ch)
+}
@@ -0,0 +1,78 @@
+package state
+
+import (
+	"fmt"
+	"math/big"
+
+	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// feePolicy decides who receives the transaction fees of a block. It is part
+// of the consensus rules, so every node must use the same.
+type feePolicy struct {
+	recipient *common.Address
+	burn      bool
+
+	// burnZero burns the fees that would be paid to the zero address. The
+	// chains whose genesis file sets no fee policy predate it, and keep paying
+	// them to the zero address, so that their blocks replay to the same state.
+	burnZero bool
+}
+
+// newFeePolicy returns the fee policy set by the genesis file. Without one,
+// fees are paid to the proposer of each block, or to the zero address if it is
+// not known.
+func newFeePolicy(config *bcommon.FeeConfig) (feePolicy, error) {
+	if config == nil {
+		return feePolicy{}, nil
+	}
+
+	policy := feePolicy{burn: config.Burn, burnZero: true}
+
+	if config.Recipient != "" {
+		if !common.IsHexAddress(config.Recipient) {
+			return feePolicy{}, fmt.Errorf("invalid fee recipient %q", config.Recipient)
+		}
+		if config.Burn {
+			return feePolicy{}, fmt.Errorf("fees cannot be both burnt and paid to %s", config.Recipient)
+		}
+		recipient := common.HexToAddress(config.Recipient)
+		policy.recipient = &recipient
+	}
+
+	return policy, nil
+}
+
+// coinbase returns the address that is paid the fees of a block proposed by
+// the given node. The zero address stands for no one, and it is also what
+// blocks without a known proposer get.
+func (p feePolicy) coinbase(proposer common.Address) common.Address {
+	switch {
+	case p.burn:
+		return common.Address{}
+	case p.recipient != nil:
+		return *p.recipient
+	default:
+		return proposer
+	}
+}
+
+// applyMessage applies a message like core.ApplyMessage, which pays the fees
+// to the coinbase of the EVM context. When the coinbase is the zero address,
+// and the policy burns its fees, they are taken back.
+func (p feePolicy) applyMessage(evm *vm.EVM, msg core.Message, gp *core.GasPool) ([]byte, uint64, bool, error) {
+	ret, gas, failed, err := core.ApplyMessage(evm, msg, gp)
+	if err != nil {
+		return ret, gas, failed, err
+	}
+
+	if p.burnZero && evm.Coinbase == (common.Address{}) {
+		fee := new(big.Int).Mul(new(big.Int).SetUint64(gas), msg.GasPrice())
+		evm.StateDB.SubBalance(common.Address{}, fee)
+	}
+
+	return ret, gas, failed, nil
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// ErrNotArchive is returned when querying a past state on a node that is not
+// running in archive mode
+var ErrNotArchive = errors.New("historical state is only available in archive mode")
+
+// ErrNoBlock is returned when querying a past state before any block was
+// committed
+var ErrNoBlock = errors.New("no committed block")
+
+// HistoricalState is a read-only view of the state at a past block, or at any
+// state root still present in the DB. Calls executed on it never modify the
+// DB.
+type HistoricalState struct {
+	ethState *ethState.StateDB
+	root     common.Hash
+	block    *Block // the context of calls
+	state    *State
+}
+
+// StateAtBlock returns the state resulting from the given block
+func (s *State) StateAtBlock(number uint64) (*HistoricalState, error) {
+	block, err := s.GetBlockByNumber(number)
+	if err != nil {
+		return nil, err
+	}
+	return s.stateAt(block.StateRoot, block)
+}
+
+// StateAtRoot returns the state with the given root. Calls are executed in the
+// context of the head block, because a root does not identify a block.
+func (s *State) StateAtRoot(root common.Hash) (*HistoricalState, error) {
+	return s.stateAt(root, s.GetHeadBlock())
+}
+
+func (s *State) stateAt(root common.Hash, block *Block) (*HistoricalState, error) {
+	head := s.GetHeadBlock()
+	if head == nil || block == nil {
+		return nil, ErrNoBlock
+	}
+
+	// Without archive mode, the states of past blocks are not guaranteed to be
+	// kept, so only the latest one is served.
+	if !s.archive && root != head.StateRoot {
+		return nil, ErrNotArchive
+	}
+
+	// Each view has its own StateDB, so that no object is shared with the main
+	// ethState or the WAS. The trie nodes are shared, as some of them may not
+	// be on disk yet.
+	statedb, err := s.openState(root)
+	if err != nil {
+		s.logger.WithError(err).Error("Opening historical state")
+		return nil, err
+	}
+
+	return &HistoricalState{
+		ethState: statedb,
+		root:     root,
+		block:    block,
+		state:    s,
+	}, nil
+}
+
+// GetBalance returns an account's balance
+func (h *HistoricalState) GetBalance(addr common.Address) *big.Int {
+	return h.ethState.GetBalance(addr)
+}
+
+// GetNonce returns an account's nonce
+func (h *HistoricalState) GetNonce(addr common.Address) uint64 {
+	return h.ethState.GetNonce(addr)
+}
+
+// GetCode returns an account's bytecode
+func (h *HistoricalState) GetCode(addr common.Address) []byte {
+	return h.ethState.GetCode(addr)
+}
+
+// Call executes a readonly transaction on a copy of the historical state
+func (h *HistoricalState) Call(callMsg ethTypes.Message) ([]byte, error) {
+	return h.state.call(callMsg, h.ethState.Copy(), h.block)
+}
+
+// EstimateGas returns the gas needed to execute a message on the historical
+// state, in the context of its block. cf. TxPool.EstimateGas
+func (h *HistoricalState) EstimateGas(msg ethTypes.Message) (uint64, error) {
+	s := h.state
+	return estimateGas(msg, h.ethState, s.gasLimit, func(attempt ethTypes.Message, statedb *ethState.StateDB) *vm.EVM {
+		context := NewContext(attempt.From(), attempt.Gas(), attempt.GasPrice(), h.block.Number, h.block.Timestamp, getHashFn(s.db))
+		return vm.NewEVM(context, statedb, &s.chainConfig, s.vmConfig)
+	})
+}
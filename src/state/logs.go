@@ -0,0 +1,313 @@
+package state
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// The MIP-map bloom index aggregates the logs bloom of every block into the
+// sections of each level of MIPMapLevels. A section's bloom is the union of
+// the blooms of its blocks, so a section that does not match a filter can be
+// skipped entirely, and so can all its sub-sections.
+var mipmapPrefix = []byte("mipmap-log-bloom-") // mipmapPrefix + level + section (uint64 big endian) -> bloom
+
+// LogFilter selects logs by emitting contract and by topics. An empty list of
+// addresses matches any contract. Topics are positional: an empty entry
+// matches any topic in that position, otherwise one of the listed topics must
+// match.
+type LogFilter struct {
+	Addresses []common.Address
+	Topics    [][]common.Hash
+}
+
+// Match returns true if the log satisfies the filter
+func (f *LogFilter) Match(log *ethTypes.Log) bool {
+	if len(f.Addresses) > 0 && !containsAddress(f.Addresses, log.Address) {
+		return false
+	}
+
+	// A log with fewer topics than the filter cannot match
+	if len(f.Topics) > len(log.Topics) {
+		return false
+	}
+	for i, topics := range f.Topics {
+		if len(topics) > 0 && !containsHash(topics, log.Topics[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Filter returns the logs that satisfy the filter
+func (f *LogFilter) Filter(logs []*ethTypes.Log) []*ethTypes.Log {
+	res := []*ethTypes.Log{}
+	for _, log := range logs {
+		if f.Match(log) {
+			res = append(res, log)
+		}
+	}
+	return res
+}
+
+// MatchBloom returns false if the bloom proves that none of the logs it
+// summarizes satisfy the filter. An empty bloom never matches.
+func (f *LogFilter) MatchBloom(bloom ethTypes.Bloom) bool {
+	if bloom == (ethTypes.Bloom{}) {
+		return false
+	}
+
+	if len(f.Addresses) > 0 {
+		included := false
+		for _, addr := range f.Addresses {
+			if ethTypes.BloomLookup(bloom, addr) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, topics := range f.Topics {
+		included := len(topics) == 0
+		for _, topic := range topics {
+			if ethTypes.BloomLookup(bloom, topic) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetLogs returns the logs of the blocks between from and to (inclusive) that
+// satisfy the filter.
+func (s *State) GetLogs(from, to uint64, filter LogFilter) ([]*ethTypes.Log, error) {
+	logs := []*ethTypes.Log{}
+
+	level := MIPMapLevels[0]
+	for section := from / level * level; section <= to; section += level {
+		sectionLogs, err := s.getSectionLogs(section, 0, from, to, filter)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, sectionLogs...)
+	}
+
+	return logs, nil
+}
+
+// GetBlockLogs returns all the logs of a block
+func (s *State) GetBlockLogs(block *Block) ([]*ethTypes.Log, error) {
+	logs := []*ethTypes.Log{}
+	for _, txHash := range block.TxHashes {
+		receipt, err := s.GetReceipt(txHash)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, receipt.Logs...)
+	}
+	return logs, nil
+}
+
+// getSectionLogs walks down the MIP-map from a section of the given depth. The
+// blocks are only read at the lowest level, in the sections whose bloom
+// matches.
+func (s *State) getSectionLogs(section uint64, depth int, from, to uint64, filter LogFilter) ([]*ethTypes.Log, error) {
+	level := MIPMapLevels[depth]
+
+	bloom, err := readMipmapBloom(s.db, level, section)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.MatchBloom(bloom) {
+		return nil, nil
+	}
+
+	logs := []*ethTypes.Log{}
+
+	if depth == len(MIPMapLevels)-1 {
+		start := section
+		if start < from {
+			start = from
+		}
+		for number := start; number < section+level && number <= to; number++ {
+			blockLogs, err := s.getMatchingBlockLogs(number, filter)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, blockLogs...)
+		}
+		return logs, nil
+	}
+
+	next := MIPMapLevels[depth+1]
+	for sub := section; sub < section+level && sub <= to; sub += next {
+		if sub+next <= from {
+			continue
+		}
+		subLogs, err := s.getSectionLogs(sub, depth+1, from, to, filter)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, subLogs...)
+	}
+
+	return logs, nil
+}
+
+func (s *State) getMatchingBlockLogs(number uint64, filter LogFilter) ([]*ethTypes.Log, error) {
+	hash, err := readBlockHash(s.db, number)
+	if err != nil {
+		// Past the head block
+		return nil, nil
+	}
+	block, err := readBlock(s.db, hash)
+	if err != nil {
+		return nil, err
+	}
+	if !filter.MatchBloom(block.LogsBloom) {
+		return nil, nil
+	}
+
+	logs, err := s.GetBlockLogs(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return filter.Filter(logs), nil
+}
+
+//------------------------------------------------------------------------------
+
+func mipmapKey(level, number uint64) []byte {
+	enc := make([]byte, 16)
+	binary.BigEndian.PutUint64(enc, level)
+	binary.BigEndian.PutUint64(enc[8:], number/level*level)
+	return append(append([]byte{}, mipmapPrefix...), enc...)
+}
+
+func readMipmapBloom(db DatabaseReader, level, number uint64) (ethTypes.Bloom, error) {
+	key := mipmapKey(level, number)
+	if ok, err := db.Has(key); err != nil || !ok {
+		return ethTypes.Bloom{}, err
+	}
+	data, err := db.Get(key)
+	if err != nil {
+		return ethTypes.Bloom{}, err
+	}
+	return ethTypes.BytesToBloom(data), nil
+}
+
+// writeMipmapBloom adds the bloom of a block to the sections of db that
+// contain it, in batch
+func writeMipmapBloom(db DatabaseReader, batch DatabasePutter, number uint64, bloom ethTypes.Bloom) error {
+	if bloom == (ethTypes.Bloom{}) {
+		return nil
+	}
+
+	for _, level := range MIPMapLevels {
+		existing, err := readMipmapBloom(db, level, number)
+		if err != nil {
+			return err
+		}
+		merged := ethTypes.BytesToBloom(new(big.Int).Or(existing.Big(), bloom.Big()).Bytes())
+		if err := batch.Put(mipmapKey(level, number), merged.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewindMipmapBlooms removes the blooms of the blocks after number, up to head,
+// from the MIP-map index. The sections that start after number are deleted.
+// The section of each level that contains number is rebuilt: the smallest one
+// from its blocks, and each larger one from the sub-sections it is made of.
+func rewindMipmapBlooms(db ethdb.KeyValueStore, number, head uint64) error {
+	for _, level := range MIPMapLevels {
+		for section := (number/level + 1) * level; section <= head; section += level {
+			if err := db.Delete(mipmapKey(level, section)); err != nil {
+				return err
+			}
+		}
+	}
+
+	smallest := MIPMapLevels[len(MIPMapLevels)-1]
+
+	var bloom ethTypes.Bloom
+	for n := number / smallest * smallest; n <= number; n++ {
+		hash, err := readBlockHash(db, n)
+		if err != nil {
+			return err
+		}
+		block, err := readBlock(db, hash)
+		if err != nil {
+			return err
+		}
+		bloom = orBloom(bloom, block.LogsBloom)
+	}
+	if err := putMipmapBloom(db, smallest, number, bloom); err != nil {
+		return err
+	}
+
+	for i := len(MIPMapLevels) - 2; i >= 0; i-- {
+		level, sub := MIPMapLevels[i], MIPMapLevels[i+1]
+		for section := number / level * level; section < number/sub*sub; section += sub {
+			subBloom, err := readMipmapBloom(db, sub, section)
+			if err != nil {
+				return err
+			}
+			bloom = orBloom(bloom, subBloom)
+		}
+		if err := putMipmapBloom(db, level, number, bloom); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// putMipmapBloom sets the bloom of the section of a level that contains number.
+// Sections without logs are not stored.
+func putMipmapBloom(db ethdb.KeyValueStore, level, number uint64, bloom ethTypes.Bloom) error {
+	if bloom == (ethTypes.Bloom{}) {
+		return db.Delete(mipmapKey(level, number))
+	}
+	return db.Put(mipmapKey(level, number), bloom.Bytes())
+}
+
+func orBloom(a, b ethTypes.Bloom) ethTypes.Bloom {
+	for i := range a {
+		a[i] |= b[i]
+	}
+	return a
+}
+
+func containsAddress(addresses []common.Address, address common.Address) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHash(hashes []common.Hash, hash common.Hash) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// AccountProof is the Merkle proof of an account, and of some of its storage
+// slots, against a state root, as per EIP-1186. The AccountProof nodes lead
+// from the Root to the account, the nodes of each StorageProof from the
+// StorageHash to the slot.
+type AccountProof struct {
+	Address      common.Address
+	Root         common.Hash
+	Balance      *big.Int
+	Nonce        uint64
+	CodeHash     common.Hash
+	StorageHash  common.Hash
+	AccountProof [][]byte
+	StorageProof []StorageProof
+}
+
+// StorageProof is the Merkle proof of a storage slot against the storage root
+// of its account
+type StorageProof struct {
+	Key   common.Hash
+	Value common.Hash
+	Proof [][]byte
+}
+
+// GetStorageAt returns the value of a storage slot from the main ethState
+func (s *State) GetStorageAt(addr common.Address, key common.Hash) common.Hash {
+	statedb, _ := s.headState()
+	return statedb.GetState(addr, key)
+}
+
+// GetProof returns the proof of an account and of the given storage slots
+// against the state root of the head block
+func (s *State) GetProof(addr common.Address, keys []common.Hash) (*AccountProof, error) {
+	statedb, head := s.headState()
+	return getProof(statedb, head.StateRoot, addr, keys)
+}
+
+// GetStorageAt returns the value of a storage slot
+func (h *HistoricalState) GetStorageAt(addr common.Address, key common.Hash) common.Hash {
+	return h.ethState.GetState(addr, key)
+}
+
+// GetProof returns the proof of an account and of the given storage slots
+// against the root of the historical state
+func (h *HistoricalState) GetProof(addr common.Address, keys []common.Hash) (*AccountProof, error) {
+	return getProof(h.ethState, h.root, addr, keys)
+}
+
+// getProof builds the proofs from a statedb without pending changes, whose
+// trie has the given root. A missing account is proven by the nodes that show
+// its absence, and its storage slots are all empty.
+func getProof(statedb *ethState.StateDB, root common.Hash, addr common.Address, keys []common.Hash) (*AccountProof, error) {
+	accountProof, err := statedb.GetProof(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := &AccountProof{
+		Address:      addr,
+		Root:         root,
+		Balance:      statedb.GetBalance(addr),
+		Nonce:        statedb.GetNonce(addr),
+		CodeHash:     crypto.Keccak256Hash(nil),
+		StorageHash:  ethTypes.EmptyRootHash,
+		AccountProof: accountProof,
+		StorageProof: make([]StorageProof, len(keys)),
+	}
+
+	storageTrie := statedb.StorageTrie(addr)
+	if storageTrie != nil {
+		proof.CodeHash = statedb.GetCodeHash(addr)
+		proof.StorageHash = storageTrie.Hash()
+	}
+
+	for i, key := range keys {
+		proof.StorageProof[i] = StorageProof{Key: key, Proof: [][]byte{}}
+		if storageTrie == nil {
+			continue
+		}
+		storageProof, err := statedb.GetStorageProof(addr, key)
+		if err != nil {
+			return nil, err
+		}
+		proof.StorageProof[i].Value = statedb.GetState(addr, key)
+		proof.StorageProof[i].Proof = storageProof
+	}
+
+	return proof, nil
+}
@@ -0,0 +1,137 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/sirupsen/logrus"
+
+	"github.com/abassian/shuffle/src/database"
+)
+
+// Prune deletes the trie nodes and contract code that cannot be reached from
+// the states of the last retention blocks, and compacts the database. The
+// states that were not written to disk are skipped, but the head block's
+// must be there, which is the case after a clean shutdown. Prune must not be
+// used on a database that is open in a State. It returns the number of entries
+// deleted.
+func Prune(db database.Database, retention uint64, logger *logrus.Logger) (int, error) {
+	head, err := readHeadBlock(db)
+	if err != nil {
+		return 0, err
+	}
+	if head == nil {
+		return 0, fmt.Errorf("no committed block")
+	}
+	if ok, _ := db.Has(head.StateRoot.Bytes()); !ok {
+		return 0, fmt.Errorf("state of head block %d is missing", head.Number)
+	}
+
+	// Mark
+	reachable := make(map[common.Hash]struct{})
+	for i := uint64(0); i < retention && i <= head.Number; i++ {
+		number := head.Number - i
+
+		// A node restored from a state snapshot has no blocks before its
+		// history
+		hash, err := readBlockHash(db, number)
+		if err == database.ErrNotFound {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		block, err := readBlock(db, hash)
+		if err != nil {
+			return 0, err
+		}
+		if ok, _ := db.Has(block.StateRoot.Bytes()); !ok {
+			continue
+		}
+
+		if err := markState(db, block.StateRoot, reachable); err != nil {
+			return 0, fmt.Errorf("reading state of block %d: %v", number, err)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"number":    number,
+			"root":      block.StateRoot.Hex(),
+			"reachable": len(reachable),
+		}).Debug("Marked state")
+	}
+
+	// Sweep
+	deleted, err := sweepState(db, reachable)
+	if err != nil {
+		return deleted, err
+	}
+
+	logger.WithField("deleted", deleted).Debug("Compacting database")
+
+	return deleted, db.Compact(nil, nil)
+}
+
+// markState adds the hashes of the trie nodes and contract code of the state
+// with the given root to reachable. The subtries that are already marked are
+// still walked, as the NodeIterator cannot skip them.
+func markState(db ethdb.KeyValueStore, root common.Hash, reachable map[common.Hash]struct{}) error {
+	stateDB, err := ethState.New(root, ethState.NewDatabase(rawdb.NewDatabase(db)))
+	if err != nil {
+		return err
+	}
+
+	it := ethState.NewNodeIterator(stateDB)
+	for it.Next() {
+		// Nodes that are embedded in their parent have no hash
+		if it.Hash != (common.Hash{}) {
+			reachable[it.Hash] = struct{}{}
+		}
+	}
+
+	return it.Error
+}
+
+// sweepState deletes the trie nodes and contract code that are not reachable.
+// They are the entries whose key is the Keccak256 hash of their value.
+// Transactions are stored the same way, so they are told apart by their
+// lookup entry.
+func sweepState(db database.Database, reachable map[common.Hash]struct{}) (int, error) {
+	it := db.NewIterator()
+	defer it.Release()
+
+	batch := db.NewBatch()
+	deleted := 0
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != common.HashLength {
+			continue
+		}
+		if _, ok := reachable[common.BytesToHash(key)]; ok {
+			continue
+		}
+		if !bytes.Equal(crypto.Keccak256(it.Value()), key) {
+			continue
+		}
+		if ok, _ := db.Has(txLookupKey(common.BytesToHash(key))); ok {
+			continue
+		}
+
+		if err := batch.Delete(common.CopyBytes(key)); err != nil {
+			return deleted, err
+		}
+		if err := flushBatch(batch); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	if err := it.Error(); err != nil {
+		return deleted, err
+	}
+
+	return deleted, batch.Write()
+}
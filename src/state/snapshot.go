@@ -0,0 +1,580 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/sirupsen/logrus"
+
+	"github.com/abassian/shuffle/src/database"
+)
+
+const snapshotVersion = 1
+
+// ErrRestoreInterrupted is returned when the State is opened on a database
+// whose restore from a snapshot did not complete
+var ErrRestoreInterrupted = errors.New("the database is incomplete, as the restore of a snapshot was interrupted: start with a new database")
+
+// snapshotHeader is the first item of a snapshot stream. It is followed by any
+// number of snapshotEntry items.
+type snapshotHeader struct {
+	Version uint64
+	Root    common.Hash
+	Head    common.Hash
+}
+
+// snapshotEntry is a raw key-value pair from the database
+type snapshotEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Snapshot is a consistent, read-only view of the entire database at a given
+// block. It contains the state trie, contract code, blocks, transactions and
+// receipts, so that it can be used to rebuild the State from scratch. A
+// Snapshot holds database resources until it is released.
+type Snapshot struct {
+	Root common.Hash
+	Head common.Hash
+
+	snap database.Snapshot
+}
+
+// Snapshot captures the current committed state. Uncommitted changes in the
+// WAS are not included.
+func (s *State) Snapshot() (*Snapshot, error) {
+	head := s.GetHeadBlock()
+	if head == nil {
+		return nil, fmt.Errorf("no committed block")
+	}
+
+	// The state trie of the head block may only be in memory
+	if err := s.was.flush(); err != nil {
+		return nil, err
+	}
+
+	snap, err := s.db.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Snapshot{
+		Root: head.StateRoot,
+		Head: head.Hash(),
+		snap: snap,
+	}, nil
+}
+
+// WriteTo streams the content of the snapshot to w. It can be called
+// concurrently with other State operations.
+func (sn *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+
+	header := snapshotHeader{
+		Version: snapshotVersion,
+		Root:    sn.Root,
+		Head:    sn.Head,
+	}
+	if err := rlp.Encode(cw, header); err != nil {
+		return cw.n, err
+	}
+
+	it := sn.snap.NewIterator()
+	defer it.Release()
+
+	for it.Next() {
+		entry := snapshotEntry{
+			Key:   it.Key(),
+			Value: it.Value(),
+		}
+		if err := rlp.Encode(cw, entry); err != nil {
+			return cw.n, err
+		}
+	}
+	if err := it.Error(); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, cw.w.Flush()
+}
+
+// Release frees the database resources held by the snapshot
+func (sn *Snapshot) Release() {
+	sn.snap.Release()
+}
+
+// Restore replaces the entire content of the database with a snapshot stream
+// produced by Snapshot.WriteTo, and resets the State to the snapshot's head
+// block. It must not be called concurrently with other State operations. The
+// database is too large to be replaced in a single batch, so it is marked as
+// being restored until the last one is written, and the state of the head
+// block is verified. If the restore fails, the State must not be used
+// anymore, and cannot be opened on the database again.
+func (s *State) Restore(r io.Reader) error {
+	stream := rlp.NewStream(bufio.NewReader(r), 0)
+
+	var header snapshotHeader
+	if err := stream.Decode(&header); err != nil {
+		return fmt.Errorf("reading snapshot header: %v", err)
+	}
+	if header.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	s.logger.WithField("root", header.Root.Hex()).Debug("Restoring snapshot")
+
+	if err := s.db.Put(restoringKey, []byte{1}); err != nil {
+		return err
+	}
+
+	// Wipe the database, except for the marker
+	batch := s.db.NewBatch()
+	if err := wipe(s.db, batch); err != nil {
+		return err
+	}
+
+	// Copy the snapshot entries
+	for {
+		var entry snapshotEntry
+		err := stream.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading snapshot entry: %v", err)
+		}
+		if err := batch.Put(entry.Key, entry.Value); err != nil {
+			return err
+		}
+		if err := flushBatch(batch); err != nil {
+			return err
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+
+	// The database is only marked as complete once it holds the whole state
+	// of the snapshot's head block
+	block, err := readBlock(s.db, header.Head)
+	if err != nil {
+		return fmt.Errorf("reading snapshot head block: %v", err)
+	}
+	if block.StateRoot != header.Root {
+		return fmt.Errorf("head block root %v does not match snapshot root %v",
+			block.StateRoot.Hex(), header.Root.Hex())
+	}
+	if err := verifyState(s.db, header.Root); err != nil {
+		return fmt.Errorf("verifying snapshot: %v", err)
+	}
+	if err := s.db.Delete(restoringKey); err != nil {
+		return err
+	}
+
+	return s.resetHead(header.Head, header.Root)
+}
+
+// resetHead points the main ethState, the WAS, and the TxPool to the given
+// block, discarding any uncommitted changes.
+func (s *State) resetHead(head common.Hash, root common.Hash) error {
+	block, err := readBlock(s.db, head)
+	if err != nil {
+		return err
+	}
+	if block.StateRoot != root {
+		return fmt.Errorf("head block root %v does not match snapshot root %v",
+			block.StateRoot.Hex(), root.Hex())
+	}
+
+	// The trie nodes cached in memory belong to the previous content of the
+	// DB, so all the StateDBs are recreated with a new cache
+	stateCache := ethState.NewDatabase(rawdb.NewDatabase(s.commitDB))
+
+	mainState, err := ethState.New(root, stateCache)
+	if err != nil {
+		return err
+	}
+	wasState, err := ethState.New(root, stateCache)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.stateCache = stateCache
+	s.ethState = mainState
+	s.head = block
+	s.mu.Unlock()
+
+	s.txPool.setStateDB(mainState.Copy())
+
+	s.was.ethState = wasState
+	s.was.recentRoots = nil
+	if err := s.was.Reset(root); err != nil {
+		return err
+	}
+	s.was.head = block
+	if err := s.resetTxPool(root, block.Number+1); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// snapshotHistory is the number of blocks in a state snapshot: the BLOCKHASH
+// opcode reads the hashes of the last 256 blocks
+const snapshotHistory = 256
+
+// stateSnapshot is a self-contained copy of the state at a given block. Nodes
+// contains the trie nodes and contract code that make up the state, each of
+// which is stored under its Keccak256 hash. History contains the block and
+// the ones before it, up to snapshotHistory of them, from the most recent, so
+// that the restored node can serve them and run BLOCKHASH.
+type stateSnapshot struct {
+	Block   *Block
+	Nodes   [][]byte
+	History []*historyBlock
+}
+
+// historyBlock is a block of a stateSnapshot, with its transactions and the
+// storedReceipt encoding of their receipts
+type historyBlock struct {
+	Block    *Block
+	Txs      [][]byte
+	Receipts [][]byte
+}
+
+// GetStateSnapshot returns the state at the block that the given consensus
+// system committed with the given index, RLP encoded. It is meant for
+// consensus systems that sync new nodes from a recent state rather than by
+// replaying all the transactions.
+func (s *State) GetStateSnapshot(consensus string, consensusIndex uint64) ([]byte, error) {
+	block, err := s.findConsensusBlock(consensus, consensusIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	stateDB, err := s.openState(block.StateRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := stateSnapshot{Block: block}
+	triedb := stateDB.Database().TrieDB()
+
+	it := ethState.NewNodeIterator(stateDB)
+	for it.Next() {
+		// Nodes that are embedded in their parent have no hash
+		if it.Hash == (common.Hash{}) {
+			continue
+		}
+		node, err := triedb.Node(it.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("reading node %v: %v", it.Hash.Hex(), err)
+		}
+		snap.Nodes = append(snap.Nodes, node)
+	}
+	if it.Error != nil {
+		return nil, it.Error
+	}
+
+	// The history stops at genesis, or where the node's own history starts
+	// if it was restored from a snapshot
+	for b := block; len(snap.History) < snapshotHistory; {
+		hb, err := s.readHistoryBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		snap.History = append(snap.History, hb)
+
+		if b.Number == 0 {
+			break
+		}
+		if b, err = readBlock(s.db, b.ParentHash); err == database.ErrNotFound {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"number":  block.Number,
+		"root":    block.StateRoot.Hex(),
+		"nodes":   len(snap.Nodes),
+		"history": len(snap.History),
+	}).Debug("State snapshot")
+
+	return rlp.EncodeToBytes(snap)
+}
+
+// readHistoryBlock reads the transactions and receipts of a block
+func (s *State) readHistoryBlock(block *Block) (*historyBlock, error) {
+	hb := &historyBlock{Block: block}
+	for _, hash := range block.TxHashes {
+		tx, err := s.db.Get(hash.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("reading transaction %v: %v", hash.Hex(), err)
+		}
+		receipt, err := s.db.Get(receiptKey(hash))
+		if err != nil {
+			return nil, fmt.Errorf("reading receipt %v: %v", hash.Hex(), err)
+		}
+		hb.Txs = append(hb.Txs, tx)
+		hb.Receipts = append(hb.Receipts, receipt)
+	}
+	return hb, nil
+}
+
+// RestoreStateSnapshot resets the State to the block of a snapshot produced
+// by GetStateSnapshot. The snapshot is verified before anything is written:
+// every node is stored under its own hash, the state trie must be complete,
+// and the blocks of the history must form a chain, with their transactions
+// and receipts. The blocks, transactions, and receipts that the node already
+// has are kept: it must be behind the snapshot's block, on the same chain.
+// The snapshot is then written atomically.
+func (s *State) RestoreStateSnapshot(data []byte) error {
+	var snap stateSnapshot
+	if err := rlp.DecodeBytes(data, &snap); err != nil {
+		return fmt.Errorf("decoding state snapshot: %v", err)
+	}
+	if snap.Block == nil {
+		return fmt.Errorf("state snapshot has no block")
+	}
+
+	root := snap.Block.StateRoot
+
+	if head := s.GetHeadBlock(); head != nil && head.Number >= snap.Block.Number {
+		return fmt.Errorf("state snapshot of block %d is not ahead of head block %d",
+			snap.Block.Number, head.Number)
+	}
+
+	// Load the nodes in memory and check that they form the whole state
+	memDB := memorydb.New()
+	for _, node := range snap.Nodes {
+		if err := memDB.Put(crypto.Keccak256(node), node); err != nil {
+			return err
+		}
+	}
+	if err := verifyState(memDB, root); err != nil {
+		return fmt.Errorf("verifying state snapshot: %v", err)
+	}
+	if err := s.verifyHistory(&snap); err != nil {
+		return fmt.Errorf("verifying state snapshot: %v", err)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"number":  snap.Block.Number,
+		"root":    root.Hex(),
+		"nodes":   len(snap.Nodes),
+		"history": len(snap.History),
+	}).Debug("Restoring state snapshot")
+
+	it := memDB.NewIterator()
+	defer it.Release()
+	for it.Next() {
+		if err := s.commitDB.Put(it.Key(), it.Value()); err != nil {
+			s.commitDB.Discard()
+			return err
+		}
+	}
+
+	// From the oldest block, as writeBlock moves the head pointer
+	for i := len(snap.History) - 1; i >= 0; i-- {
+		if err := s.writeHistoryBlock(snap.History[i]); err != nil {
+			s.commitDB.Discard()
+			return err
+		}
+	}
+
+	if err := s.commitDB.Write(); err != nil {
+		s.commitDB.Discard()
+		return err
+	}
+
+	return s.resetHead(snap.Block.Hash(), root)
+}
+
+// verifyHistory checks that the history of a snapshot is a chain of blocks
+// that ends with the snapshot's block, and that the transactions and
+// receipts are those of the blocks. The blocks that the node already has must
+// be the same.
+func (s *State) verifyHistory(snap *stateSnapshot) error {
+	if len(snap.History) == 0 || snap.History[0].Block.Hash() != snap.Block.Hash() {
+		return fmt.Errorf("history does not start with block %d", snap.Block.Number)
+	}
+
+	for i, hb := range snap.History {
+		block := hb.Block
+		if i > 0 && block.Hash() != snap.History[i-1].Block.ParentHash {
+			return fmt.Errorf("block %d is not the parent of block %d", block.Number, snap.History[i-1].Block.Number)
+		}
+
+		if hash, err := readBlockHash(s.db, block.Number); err == nil && hash != block.Hash() {
+			return fmt.Errorf("block %d does not match the local chain", block.Number)
+		}
+
+		if len(hb.Txs) != len(block.TxHashes) || len(hb.Receipts) != len(block.TxHashes) {
+			return fmt.Errorf("block %d should have %d transactions and receipts", block.Number, len(block.TxHashes))
+		}
+		receipts := make(ethTypes.Receipts, len(hb.Receipts))
+		for j, hash := range block.TxHashes {
+			if crypto.Keccak256Hash(hb.Txs[j]) != hash {
+				return fmt.Errorf("transaction %d of block %d should be %v", j, block.Number, hash.Hex())
+			}
+			receipt, err := decodeReceipt(hb.Receipts[j])
+			if err != nil {
+				return fmt.Errorf("decoding receipt %v: %v", hash.Hex(), err)
+			}
+			if receipt.TxHash != hash {
+				return fmt.Errorf("receipt %d of block %d should be for transaction %v", j, block.Number, hash.Hex())
+			}
+			receipts[j] = receipt
+		}
+		if ethTypes.DeriveSha(receipts) != block.ReceiptsRoot {
+			return fmt.Errorf("receipts of block %d do not match its receipts root", block.Number)
+		}
+	}
+
+	return nil
+}
+
+// writeHistoryBlock writes a block of a snapshot to the commitDB, with its
+// transactions and receipts, and indexes it, as the WAS does when it commits
+// a block
+func (s *State) writeHistoryBlock(hb *historyBlock) error {
+	block := hb.Block
+	blockHash := block.Hash()
+
+	if err := writeBlock(s.commitDB, block); err != nil {
+		return err
+	}
+	for i, hash := range block.TxHashes {
+		if err := s.commitDB.Put(hash.Bytes(), hb.Txs[i]); err != nil {
+			return err
+		}
+		entry := TxLookupEntry{
+			BlockHash:   blockHash,
+			BlockNumber: block.Number,
+			Index:       uint64(i),
+		}
+		if err := writeTxLookupEntry(s.commitDB, hash, entry); err != nil {
+			return err
+		}
+		if err := s.commitDB.Put(receiptKey(hash), hb.Receipts[i]); err != nil {
+			return err
+		}
+	}
+
+	// The blooms are merged, so the blocks that the node already has are not
+	// counted twice
+	return writeMipmapBloom(s.commitDB, s.commitDB, block.Number, block.LogsBloom)
+}
+
+// findConsensusBlock walks back from the head block to find the block that the
+// given consensus system committed with the given index.
+func (s *State) findConsensusBlock(consensus string, consensusIndex uint64) (*Block, error) {
+	block := s.GetHeadBlock()
+	for block != nil {
+		if block.Consensus == consensus && block.ConsensusIndex == consensusIndex {
+			return block, nil
+		}
+		if block.Number == 0 ||
+			(block.Consensus == consensus && block.ConsensusIndex < consensusIndex) {
+			break
+		}
+
+		var err error
+		if block, err = readBlock(s.db, block.ParentHash); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no %s block with index %d", consensus, consensusIndex)
+}
+
+// verifyState checks that db contains all the trie nodes and contract code of
+// the state with the given root, each stored under its own hash.
+func verifyState(db ethdb.KeyValueStore, root common.Hash) error {
+	stateDB, err := ethState.New(root, ethState.NewDatabase(rawdb.NewDatabase(db)))
+	if err != nil {
+		return err
+	}
+
+	it := ethState.NewNodeIterator(stateDB)
+	for it.Next() {
+		// Nodes that are embedded in their parent have no hash
+		if it.Hash == (common.Hash{}) {
+			continue
+		}
+		node, err := db.Get(it.Hash.Bytes())
+		if err != nil {
+			return err
+		}
+		if crypto.Keccak256Hash(node) != it.Hash {
+			return fmt.Errorf("node %v does not match its hash", it.Hash.Hex())
+		}
+	}
+
+	return it.Error
+}
+
+//------------------------------------------------------------------------------
+
+// wipe adds the deletion of every key in the database but the restore marker
+// to batch. The batch is written whenever it grows past ethdb.IdealBatchSize,
+// so the deletion is not atomic.
+func wipe(db database.Database, batch ethdb.Batch) error {
+	it := db.NewIterator()
+	defer it.Release()
+
+	for it.Next() {
+		if bytes.Equal(it.Key(), restoringKey) {
+			continue
+		}
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+		if err := flushBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	return it.Error()
+}
+
+// flushBatch writes and resets the batch if it has grown past
+// ethdb.IdealBatchSize
+func flushBatch(batch ethdb.Batch) error {
+	if batch.ValueSize() < ethdb.IdealBatchSize {
+		return nil
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	batch.Reset()
+	return nil
+}
+
+// countingWriter counts the number of bytes written to the underlying writer
+type countingWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -4,23 +4,28 @@ import (
 	"bytes"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
-	"syscall"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	ethState "github.com/ethereum/go-ethereum/core/state"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
-	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/sirupsen/logrus"
 
 	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/abassian/shuffle/src/database"
 )
 
 var (
@@ -28,46 +33,93 @@ var (
 	txMetaSuffix   = []byte{0x01}
 	receiptsPrefix = []byte("receipts-")
 	MIPMapLevels   = []uint64{1000000, 500000, 100000, 50000, 1000}
+
+	// trieDirtyLimit is the amount of memory that the state tries of recent
+	// blocks can use before they are flushed to disk, when not in archive mode
+	trieDirtyLimit = common.StorageSize(256 * 1024 * 1024)
 )
 
 type State struct {
-	db       ethdb.Database
-	ethState *ethState.StateDB
-	was      *WriteAheadState
-	txPool   *TxPool
+	db database.Database
+
+	// commitDB collects the writes of a Commit, which it stores atomically.
+	// The StateDBs and the WAS go through it, the other reads use db.
+	commitDB *commitDB
+
+	// mu protects the head block, the main ethState, and the stateCache,
+	// which are replaced by Commit and Restore while the Service reads them.
+	// The main ethState holds the state of the head block, and is never read
+	// directly: every read works on a copy, cf. headState.
+	mu   sync.RWMutex
+	head *Block
+
+	// stateCache holds the trie nodes that are not yet on disk. It is shared
+	// by all the StateDBs.
+	stateCache ethState.Database
+	ethState   *ethState.StateDB
+	was        *WriteAheadState
+	txPool     *TxPool
 
 	gasLimit uint64
 
 	signer      ethTypes.Signer
 	chainConfig params.ChainConfig //vm.env is still tightly coupled with chainConfig
-	vmConfig    vm.Config
+	vmConfig    vm.Config          // no tracer, executions are traced on demand
+	fees        feePolicy
+
+	// coinbase is this node's fee recipient, for the blocks it proposes
+	coinbase common.Address
 
 	genesisFile string
 
+	// archive is true if the states of all past blocks are kept. Otherwise,
+	// only the states of the last retention blocks are.
+	archive   bool
+	retention uint64
+
+	blockFeed    event.Feed
+	txFeed       event.Feed
+	promotedFeed event.Feed
+	droppedFeed  event.Feed
+
 	logger *logrus.Logger
 }
 
-func NewState(logger *logrus.Logger, dbFile string, dbCache int, genesisFile string) (*State, error) {
-	handles, err := getFdLimit()
-	if err != nil {
-		return nil, err
+// NewState opens the database with the given backend, cf. database.New, and
+// initializes the State from it
+func NewState(logger *logrus.Logger,
+	dbBackend string,
+	dbFile string,
+	dbCache int,
+	genesisFile string,
+	archive bool,
+	retention uint64) (*State, error) {
+
+	if !archive && retention == 0 {
+		return nil, fmt.Errorf("the state of at least one block must be retained")
 	}
 
-	db, err := ethdb.NewLDBDatabase(dbFile, dbCache, handles)
+	db, err := database.New(dbBackend, dbFile, dbCache)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &State{
 		db:          db,
-		signer:      ethTypes.NewEIP155Signer(CustomChainConfig.ChainID),
-		chainConfig: CustomChainConfig,
-		vmConfig:    vm.Config{Tracer: vm.NewStructLogger(nil)},
+		vmConfig:    vm.Config{},
 		genesisFile: genesisFile,
+		archive:     archive,
+		retention:   retention,
 		logger:      logger,
 	}
 
+	if err := s.initChainConfig(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	if err := s.InitState(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -76,27 +128,89 @@ func NewState(logger *logrus.Logger, dbFile string, dbCache int, genesisFile str
 
 //------------------------------------------------------------------------------
 
-// InitState initializes the statedb object, the write-ahead state, the
-// transaction-pool, and creates genesis accounts.
+// initChainConfig sets the chain config, the signer, and the fee policy from
+// the genesis file. The same signer is used by the TxPool, the WAS, and the
+// Service, so that all transactions are signed and verified with the chain ID
+// of the genesis file.
+func (s *State) initChainConfig() error {
+	var config *bcommon.ChainConfig
+	var fees *bcommon.FeeConfig
+
+	genesis, err := s.GetGenesis()
+	if err == nil {
+		config = genesis.Config
+		fees = genesis.Fees
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	s.chainConfig, err = NewChainConfig(config)
+	if err != nil {
+		return err
+	}
+	s.signer = ethTypes.NewEIP155Signer(s.chainConfig.ChainID)
+
+	s.fees, err = newFeePolicy(fees)
+	if err != nil {
+		return err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"chain_id": s.chainConfig.ChainID,
+		"config":   s.chainConfig.String(),
+	}).Debug("Chain config")
+
+	return nil
+}
+
+// InitState initializes the statedb object, the write-ahead state, and the
+// transaction-pool. A new database starts with the genesis block, created from
+// the genesis accounts; otherwise the State resumes from the last block whose
+// state is on disk, cf. recoverHead, and the genesis file must be the one that
+// the database was created from.
 func (s *State) InitState() error {
 
 	s.gasLimit = gasLimit
 
-	initState := common.Hash{}
+	s.commitDB = newCommitDB(s.db)
+	s.stateCache = ethState.NewDatabase(rawdb.NewDatabase(s.commitDB))
 
-	var err error
+	if restoring, err := s.db.Has(restoringKey); err != nil {
+		return err
+	} else if restoring {
+		return ErrRestoreInterrupted
+	}
+
+	if err := s.checkGenesis(); err != nil {
+		return err
+	}
+
+	head, err := s.recoverHead()
+	if err != nil {
+		return err
+	}
+
+	initState := common.Hash{}
+	if head != nil {
+		initState = head.StateRoot
+	}
 
-	s.ethState, err = ethState.New(initState, ethState.NewDatabase(s.db))
+	s.ethState, err = ethState.New(initState, s.stateCache)
 	if err != nil {
 		return err
 	}
+	s.head = head
 
-	s.was, err = NewWriteAheadState(s.db,
+	s.was, err = NewWriteAheadState(s.commitDB,
+		s.stateCache,
 		initState,
 		s.signer,
 		s.chainConfig,
 		s.vmConfig,
 		gasLimit,
+		s.fees,
+		s.archive,
+		s.retention,
 		s.logger)
 
 	if err != nil {
@@ -108,33 +222,183 @@ func (s *State) InitState() error {
 		s.chainConfig,
 		s.vmConfig,
 		s.gasLimit,
+		getHashFn(s.db),
 		s.logger)
 
+	if head != nil {
+		s.logger.WithFields(logrus.Fields{
+			"number": head.Number,
+			"root":   head.StateRoot.Hex(),
+		}).Info("Resuming from head block")
+
+		if err := s.resetTxPool(initState, head.Number+1); err != nil {
+			return err
+		}
+		return s.initPOA()
+	}
+
 	// Initialize genesis accounts with balance, code, and state
-	err = s.CreateGenesisAccounts()
+	return s.CreateGenesisAccounts()
+}
+
+// checkGenesis compares the hash of the genesis file with the one recorded in
+// the database, and records it if the database has none: it is new, or was
+// created before the hash was recorded.
+func (s *State) checkGenesis() error {
+	hash, err := s.genesisHash()
 	if err != nil {
 		return err
 	}
 
-	return err
+	recorded, err := readGenesisHash(s.db)
+	if err != nil {
+		return err
+	}
+	if recorded != nil {
+		if *recorded != hash {
+			return fmt.Errorf("genesis file %s does not match the database: hash is %s, not %s",
+				s.genesisFile, hash.Hex(), recorded.Hex())
+		}
+		return nil
+	}
+
+	if err := writeGenesisHash(s.commitDB, hash); err != nil {
+		return err
+	}
+	return s.commitDB.Write()
+}
+
+// genesisHash returns the Keccak256 hash of the genesis file in a canonical
+// form: the JSON document with the keys of its objects sorted, and without
+// whitespace. So the hash depends on all the content of the file, including
+// the fields that this version does not read, but not on its formatting.
+// Without a genesis file, it is the hash of an empty document.
+func (s *State) genesisHash() (common.Hash, error) {
+	data, err := ioutil.ReadFile(s.genesisFile)
+	if os.IsNotExist(err) {
+		data = []byte("{}")
+	} else if err != nil {
+		return common.Hash{}, err
+	}
+
+	// Numbers are kept as written, rather than converted to float64
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return common.Hash{}, fmt.Errorf("parsing genesis file %s: %v", s.genesisFile, err)
+	}
+
+	// Marshal sorts the keys of maps
+	canonical, err := json.Marshal(doc)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(canonical), nil
+}
+
+// recoverHead returns the block that the State resumes from, or nil if the
+// database is new. It is the head block, unless its state is not on disk:
+// outside of archive mode, the states of the recent blocks are only kept in
+// memory until Close, so after a crash the State goes back to the last block
+// whose state was written as a checkpoint. The blocks that follow it are
+// removed, so that the consensus system applies their transactions again.
+func (s *State) recoverHead() (*Block, error) {
+	head, err := readHeadBlock(s.db)
+	if err != nil || head == nil {
+		return nil, err
+	}
+
+	block := head
+	for {
+		if _, err := ethState.New(block.StateRoot, s.stateCache); err == nil {
+			break
+		}
+		if block.Number == 0 {
+			return nil, fmt.Errorf("state of genesis block is missing")
+		}
+		if block, err = readBlock(s.db, block.ParentHash); err != nil {
+			return nil, err
+		}
+	}
+
+	if block != head {
+		s.logger.WithFields(logrus.Fields{
+			"head":   head.Number,
+			"number": block.Number,
+		}).Warn("State of head block is missing, rewinding")
+
+		if err := s.rewindHead(head, block); err != nil {
+			return nil, err
+		}
+	}
+
+	return block, nil
 }
 
-// Commit persists all pending state changes (in the WAS) to the DB, and resets
-// the WAS and TxPool
-func (s *State) Commit() (common.Hash, error) {
+// rewindHead makes block the head block, and deletes the blocks that follow it
+// up to head, with their transactions, receipts, rejected transactions, and log
+// blooms, in a single batch.
+func (s *State) rewindHead(head *Block, block *Block) error {
+	for b := head; b.Number > block.Number; {
+		for _, hash := range b.TxHashes {
+			s.commitDB.Delete(hash.Bytes())
+			s.commitDB.Delete(txLookupKey(hash))
+			s.commitDB.Delete(receiptKey(hash))
+		}
+		s.commitDB.Delete(blockNumberKey(b.Number))
+		s.commitDB.Delete(blockKey(b.Hash()))
+
+		var err error
+		if b, err = readBlock(s.db, b.ParentHash); err != nil {
+			s.commitDB.Discard()
+			return err
+		}
+	}
+
+	if err := deleteRejectedTxs(s.db, s.commitDB, block.Number); err != nil {
+		s.commitDB.Discard()
+		return err
+	}
+	if err := rewindMipmapBlooms(s.commitDB, block.Number, head.Number); err != nil {
+		s.commitDB.Discard()
+		return err
+	}
+
+	if err := s.commitDB.Put(headBlockKey, block.Hash().Bytes()); err != nil {
+		s.commitDB.Discard()
+		return err
+	}
+	if err := s.commitDB.Write(); err != nil {
+		s.commitDB.Discard()
+		return err
+	}
+	return nil
+}
+
+// Commit persists all pending state changes (in the WAS) to the DB, as a new
+// block, and resets the WAS and TxPool. It returns the resulting state root.
+// It is called by the consensus system, and can run concurrently with the
+// reads of the Service, which see the new block once it is complete.
+func (s *State) Commit(info BlockInfo) (common.Hash, error) {
 	// commit all state changes to the database
-	root, err := s.was.Commit()
+	block, err := s.was.Commit(info)
 	if err != nil {
 		s.logger.WithError(err).Error("Committing WAS")
-		return root, err
+		return common.Hash{}, err
 	}
+	root := block.StateRoot
+	logs := s.was.logs()
 
-	// Reset main ethState
-	if err := s.ethState.Reset(root); err != nil {
+	// Reset main ethState, and make the block visible to readers
+	if err := s.setHead(block); err != nil {
 		s.logger.WithError(err).Error("Resetting main StateDB")
 		return root, err
 	}
-	s.logger.WithField("root", root.Hex()).Debug("Committed")
+	s.logger.WithFields(logrus.Fields{
+		"root":   root.Hex(),
+		"number": block.Number,
+	}).Debug("Committed")
 
 	// Reset WAS
 	if err := s.was.Reset(root); err != nil {
@@ -144,49 +408,167 @@ func (s *State) Commit() (common.Hash, error) {
 	s.logger.Debug("Reset WAS")
 
 	// Reset TxPool
-	if err := s.txPool.Reset(root); err != nil {
+	if err := s.resetTxPool(root, block.Number+1); err != nil {
 		s.logger.WithError(err).Error("Resetting TxPool")
 		return root, err
 	}
 	s.logger.Debug("Reset TxPool")
 
+	s.blockFeed.Send(NewBlockEvent{Block: block, Logs: logs})
+
 	return root, nil
 }
 
+// setHead points the main ethState to the state of a new head block
+func (s *State) setHead(block *Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ethState.Reset(block.StateRoot); err != nil {
+		return err
+	}
+	s.head = block
+
+	return nil
+}
+
+// headState returns a copy of the main ethState, along with the head block
+// whose state it holds. Reads are served from such copies, which no other
+// goroutine uses, so that they run in parallel with each other and with
+// Commit. Outside of archive mode, a read that outlives the following
+// retention blocks may find the trie nodes that it needs garbage collected.
+func (s *State) headState() (*ethState.StateDB, *Block) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ethState.Copy(), s.head
+}
+
+// openState returns a new StateDB on the given root, which shares the cached
+// trie nodes of the others
+func (s *State) openState(root common.Hash) (*ethState.StateDB, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return ethState.New(root, s.stateCache)
+}
+
+// resetTxPool resets the TxPool on top of the given root. The pending
+// transactions that became invalid are reported, and the queued ones that
+// follow the committed ones are promoted, to be submitted.
+func (s *State) resetTxPool(root common.Hash, blockNumber uint64) error {
+	dropped, err := s.txPool.Reset(root, blockNumber)
+	if err != nil {
+		return err
+	}
+
+	for _, ev := range dropped {
+		s.logger.WithError(ev.Reason).WithField("hash", ev.Tx.Hash().Hex()).Warn("Dropped transaction from TxPool")
+		s.droppedFeed.Send(ev)
+	}
+
+	if promoted := s.txPool.Promote(); len(promoted) > 0 {
+		for _, tx := range promoted {
+			s.txFeed.Send(NewTxEvent{Tx: tx})
+		}
+		s.promotedFeed.Send(PromotedTxsEvent{Txs: promoted})
+	}
+
+	return nil
+}
+
+// Close writes the state of the head block to disk, and closes the DB
+func (s *State) Close() error {
+	if err := s.was.flush(); err != nil {
+		s.logger.WithError(err).Error("Flushing state")
+		return err
+	}
+	s.db.Close()
+	return nil
+}
+
 //------------------------------------------------------------------------------
 
-// Call executes a readonly transaction on the statedb. It is called by the
-// service handlers
+// Call executes a readonly transaction on the state of the head block, in its
+// context. It is called by the service handlers
 func (s *State) Call(callMsg ethTypes.Message) ([]byte, error) {
 	s.logger.Debug("Call")
 
-	context := NewContext(callMsg.From(), 0, big.NewInt(0))
-
 	// We use a copy of the ethState because even call transactions increment
 	// the sender's nonce
-	vmenv := vm.NewEVM(context, s.was.ethState.Copy(), &s.chainConfig, s.vmConfig)
+	statedb, head := s.headState()
+	return s.call(callMsg, statedb, head)
+}
+
+// call executes a readonly transaction on the given statedb, in the context of
+// the given block
+func (s *State) call(callMsg ethTypes.Message, statedb *ethState.StateDB, block *Block) ([]byte, error) {
+	context := NewContext(callMsg.From(), 0, big.NewInt(0), block.Number, block.Timestamp, getHashFn(s.db))
+
+	vmenv := vm.NewEVM(context, statedb, &s.chainConfig, s.vmConfig)
 
 	// Apply the transaction to the current state (included in the env)
 	res, _, _, err := core.ApplyMessage(vmenv, callMsg, new(core.GasPool).AddGas(gasLimit))
 	if err != nil {
-		s.logger.WithError(err).Error("Executing Call on WAS")
+		s.logger.WithError(err).Error("Executing Call")
 		return nil, err
 	}
 
 	return res, err
 }
 
-// CheckTx attempt to apply a transaction to the TxPool's statedb. It is called
-// by the Service handlers to check if a transaction is valid before submitting
-// it to the consensus system. This also updates the sender's Nonce in the
-// TxPool's statedb.
-func (s *State) CheckTx(tx *ethTypes.Transaction) error {
-	return s.txPool.CheckTx(tx)
+// EstimateGas returns the gas needed to execute a message on top of the
+// TxPool's statedb. cf. TxPool.EstimateGas
+func (s *State) EstimateGas(msg ethTypes.Message) (uint64, error) {
+	return s.txPool.EstimateGas(msg)
+}
+
+// SetProposer sets the node that proposed the block being built, before its
+// transactions are applied. Its coinbase is paid the fees of the block, unless
+// the fee policy of the genesis file pays them to a fixed recipient or burns
+// them. Without a proposer, as in Huron blocks, the fees are burnt, or paid to
+// the zero address if the genesis file sets no fee policy. It is reset by
+// Commit.
+func (s *State) SetProposer(coinbase common.Address) {
+	s.was.proposer = coinbase
+}
+
+// CheckTx adds a transaction to the TxPool. It is called by the Service
+// handlers to check if a transaction is valid before submitting it to the
+// consensus system. It returns the transactions that the Service must submit,
+// in order: the transactions promoted after a commit that were not taken yet,
+// cf. TakePromotedTxs, as the transaction may follow one of them, then the
+// transaction itself, if it has the next nonce of its sender, and the queued
+// transactions that follow it. A transaction with a nonce gap is queued, and
+// nothing is returned.
+func (s *State) CheckTx(tx *ethTypes.Transaction) ([]*ethTypes.Transaction, error) {
+	promoted, pending, err := s.txPool.Add(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range pending {
+		s.txFeed.Send(NewTxEvent{Tx: tx})
+	}
+
+	return append(promoted, pending...), nil
+}
+
+// TakePromotedTxs returns the queued transactions that became pending after a
+// commit and were not taken yet, by a previous call or by CheckTx. The Service
+// must submit them in order, before the transactions that CheckTx returns
+// next.
+func (s *State) TakePromotedTxs() []*ethTypes.Transaction {
+	return s.txPool.TakePromoted()
 }
 
 // ApplyTransaction decodes a transaction and applies it to the WAS. It is meant
-// to be called by the consensus system to apply transactions sequentially.
-func (s *State) ApplyTransaction(txBytes []byte, txIndex int, blockHash common.Hash) error {
+// to be called by the consensus system to apply transactions sequentially. The
+// transactions applied between two calls to Commit form a block. The
+// timestamp, in seconds, is the time of that block, which the EVM exposes to
+// contracts; it must be agreed by all the nodes, and be passed to Commit too.
+// The number of the block is that of the head block plus one.
+func (s *State) ApplyTransaction(txBytes []byte, timestamp uint64) error {
 
 	var t ethTypes.Transaction
 	if err := rlp.Decode(bytes.NewReader(txBytes), &t); err != nil {
@@ -195,47 +577,52 @@ func (s *State) ApplyTransaction(txBytes []byte, txIndex int, blockHash common.H
 	}
 	s.logger.WithField("hash", t.Hash().Hex()).Debug("Decoded tx")
 
-	return s.was.ApplyTransaction(t, txIndex, blockHash)
+	return s.was.ApplyTransaction(t, timestamp)
 }
 
 // CreateGenesisAccounts reads the genesis.json file and creates the regular
-// pre-funded accounts, as well as the POA smart-contract account.
+// pre-funded accounts, as well as the POA smart-contract account, in the
+// genesis block. The genesis is only ever applied once, to a new database.
+// Without a genesis file, the genesis block is empty, so that there always is
+// a head block to execute calls in the context of.
 func (s *State) CreateGenesisAccounts() error {
 
+	if s.GetHeadBlock() != nil {
+		return fmt.Errorf("genesis block already created")
+	}
+
 	genesis, err := s.GetGenesis()
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
 	// Regular pre-funded accounts
 	for addr, account := range genesis.Alloc {
 		address := common.HexToAddress(addr)
-		if s.Empty(address) {
-			s.was.ethState.AddBalance(address, math.MustParseBig256(account.Balance))
-			s.was.ethState.SetCode(address, common.Hex2Bytes(account.Code))
-			for key, value := range account.Storage {
-				s.was.ethState.SetState(address, common.HexToHash(key), common.HexToHash(value))
-			}
-			s.logger.WithField("address", addr).Debug("Adding account")
+		s.was.ethState.AddBalance(address, math.MustParseBig256(account.Balance))
+		s.was.ethState.SetNonce(address, account.Nonce)
+		s.was.ethState.SetCode(address, common.Hex2Bytes(account.Code))
+		for key, value := range account.Storage {
+			s.was.ethState.SetState(address, common.HexToHash(key), common.HexToHash(value))
 		}
+		s.logger.WithField("address", addr).Debug("Adding account")
 	}
 
 	// POA smart-contract account
 	if string(genesis.Poa.Address) != "" {
 		address := common.HexToAddress(genesis.Poa.Address)
-		if s.Empty(address) {
-			s.was.ethState.AddBalance(address, math.MustParseBig256(genesis.Poa.Balance))
-			s.was.ethState.SetCode(address, common.Hex2Bytes(genesis.Poa.Code))
-			setPOAADDR(genesis.Poa.Address)
-			setPOAABI(genesis.Poa.Abi)
-			s.logger.WithField("address", genesis.Poa.Address).Debug("Adding POA smart-contract account")
+		s.was.ethState.AddBalance(address, math.MustParseBig256(genesis.Poa.Balance))
+		s.was.ethState.SetNonce(address, genesis.Poa.Nonce)
+		s.was.ethState.SetCode(address, common.Hex2Bytes(genesis.Poa.Code))
+		for key, value := range genesis.Poa.Storage {
+			s.was.ethState.SetState(address, common.HexToHash(key), common.HexToHash(value))
 		}
+		setPOAADDR(genesis.Poa.Address)
+		setPOAABI(genesis.Poa.Abi)
+		s.logger.WithField("address", genesis.Poa.Address).Debug("Adding POA smart-contract account")
 	}
 
-	if _, err = s.Commit(); err != nil {
+	if _, err = s.Commit(BlockInfo{Consensus: "genesis"}); err != nil {
 		return err
 	}
 
@@ -243,31 +630,61 @@ func (s *State) CreateGenesisAccounts() error {
 
 }
 
+// initPOA sets the address and ABI of the POA smart-contract from the genesis
+// file, when the State resumes from an existing database, where the genesis
+// accounts were already created
+func (s *State) initPOA() error {
+	genesis, err := s.GetGenesis()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if string(genesis.Poa.Address) != "" {
+		setPOAADDR(genesis.Poa.Address)
+		setPOAABI(genesis.Poa.Abi)
+	}
+
+	return nil
+}
+
 // Empty reports whether the account is non-existant or empty
 func (s *State) Empty(addr common.Address) bool {
-	res := s.ethState.Empty(addr)
+	statedb, _ := s.headState()
+	res := statedb.Empty(addr)
 	s.logger.Debugf("%s Empty? %v", addr.Hex(), res)
 	return res
 }
 
 // GetBalance returns an account's balance from the main ethState
 func (s *State) GetBalance(addr common.Address) *big.Int {
-	return s.ethState.GetBalance(addr)
+	statedb, _ := s.headState()
+	return statedb.GetBalance(addr)
 }
 
 // GetNonce returns an account's nonce from the main ethState
 func (s *State) GetNonce(addr common.Address) uint64 {
-	return s.ethState.GetNonce(addr)
+	statedb, _ := s.headState()
+	return statedb.GetNonce(addr)
 }
 
 // GetCode returns an account's bytecode from the main ethState
 func (s *State) GetCode(addr common.Address) []byte {
-	return s.ethState.GetCode(addr)
+	statedb, _ := s.headState()
+	return statedb.GetCode(addr)
 }
 
 // GetPoolNonce returns an account's nonce from the txpool's ethState
 func (s *State) GetPoolNonce(addr common.Address) uint64 {
-	return s.txPool.ethState.GetNonce(addr)
+	return s.txPool.GetNonce(addr)
+}
+
+// GetPoolStats returns the number of pending and queued transactions in the
+// TxPool
+func (s *State) GetPoolStats() (int, int) {
+	return s.txPool.Stats()
 }
 
 // GetTransaction fetches transactions by hash directly from the DB.
@@ -290,18 +707,62 @@ func (s *State) GetTransaction(hash common.Hash) (*ethTypes.Transaction, error)
 // GetReceipt fetches transaction receipts by transaction hash directly from the
 // DB
 func (s *State) GetReceipt(txHash common.Hash) (*ethTypes.Receipt, error) {
-	data, err := s.db.Get(append(receiptsPrefix, txHash.Bytes()...))
+	receipt, err := readReceipt(s.db, txHash)
 	if err != nil {
 		s.logger.WithError(err).Error("GetReceipt")
 		return nil, err
 	}
-	var receipt ethTypes.ReceiptForStorage
-	if err := rlp.DecodeBytes(data, &receipt); err != nil {
-		s.logger.WithError(err).Error("Decoding Receipt")
+	return receipt, nil
+}
+
+// GetRejectedTx fetches the record of a transaction that was rejected by the
+// WAS, by transaction hash, directly from the DB
+func (s *State) GetRejectedTx(txHash common.Hash) (*RejectedTx, error) {
+	rejected, err := readRejectedTx(s.db, txHash)
+	if err != nil {
+		s.logger.WithError(err).Debug("GetRejectedTx")
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// GetHeadBlock returns the last committed block
+func (s *State) GetHeadBlock() *Block {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.head
+}
+
+// GetBlockByNumber fetches a block by number directly from the DB
+func (s *State) GetBlockByNumber(number uint64) (*Block, error) {
+	hash, err := readBlockHash(s.db, number)
+	if err != nil {
+		s.logger.WithError(err).Error("GetBlockByNumber")
 		return nil, err
 	}
+	return s.GetBlockByHash(hash)
+}
 
-	return (*ethTypes.Receipt)(&receipt), nil
+// GetBlockByHash fetches a block by hash directly from the DB
+func (s *State) GetBlockByHash(hash common.Hash) (*Block, error) {
+	block, err := readBlock(s.db, hash)
+	if err != nil {
+		s.logger.WithError(err).Error("GetBlockByHash")
+		return nil, err
+	}
+	return block, nil
+}
+
+// GetTxLookupEntry returns the location of a committed transaction in the
+// chain of blocks
+func (s *State) GetTxLookupEntry(txHash common.Hash) (*TxLookupEntry, error) {
+	entry, err := readTxLookupEntry(s.db, txHash)
+	if err != nil {
+		s.logger.WithError(err).Error("GetTxLookupEntry")
+		return nil, err
+	}
+	return entry, nil
 }
 
 // GetGasLimit returns the gas limit set between commit calls
@@ -309,6 +770,54 @@ func (s *State) GetGasLimit() uint64 {
 	return s.gasLimit
 }
 
+// GetChainID returns the chain ID used to sign and verify transactions
+func (s *State) GetChainID() *big.Int {
+	return s.chainConfig.ChainID
+}
+
+// GetSigner returns the signer used to verify transactions
+func (s *State) GetSigner() ethTypes.Signer {
+	return s.signer
+}
+
+// SetReplayable tells the State whether the consensus system delivers the
+// blocks again when the node restarts after a crash, like Raft replays its
+// log. Only then are the state tries of the recent blocks kept in memory
+// between checkpoints, as the blocks committed after the last checkpoint are
+// rewound, and must be committed again. Otherwise, which is the default, the
+// state trie of every block is written to disk when it is committed.
+func (s *State) SetReplayable(replayable bool) {
+	s.was.replayable = replayable
+}
+
+// SetCoinbase sets this node's fee recipient, for the blocks it proposes
+func (s *State) SetCoinbase(coinbase common.Address) {
+	s.coinbase = coinbase
+}
+
+// GetCoinbase returns this node's fee recipient
+func (s *State) GetCoinbase() common.Address {
+	return s.coinbase
+}
+
+// SetMinGasPrice sets the lowest gas price of the transactions accepted by
+// CheckTx. It is a local policy, it does not affect the transactions that other
+// nodes submit to consensus.
+func (s *State) SetMinGasPrice(price *big.Int) {
+	s.txPool.SetMinGasPrice(price)
+}
+
+// GetMinGasPrice returns the lowest gas price accepted by CheckTx
+func (s *State) GetMinGasPrice() *big.Int {
+	return s.txPool.GetMinGasPrice()
+}
+
+// SetTxPoolLimits sets the number of transactions that the TxPool holds, and
+// the time after which they are dropped
+func (s *State) SetTxPoolLimits(size int, lifetime time.Duration) {
+	s.txPool.SetLimits(size, lifetime)
+}
+
 // GetAuthorisingAccount returns the address of the smart contract which handles
 // the list of authorized peers
 func (s *State) GetAuthorisingAccount() string {
@@ -383,15 +892,3 @@ func (s *State) CheckAuthorised(addr common.Address) (bool, error) {
 	return false, nil
 
 }
-
-//------------------------------------------------------------------------------
-
-// getFdLimit retrieves the number of file descriptors allowed to be opened by this
-// process.
-func getFdLimit() (int, error) {
-	var limit syscall.Rlimit
-	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
-		return 0, err
-	}
-	return int(limit.Cur), nil
-}
@@ -1,22 +1,36 @@
 package state
 
 import (
+	"bytes"
+	"errors"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	ethState "github.com/ethereum/go-ethereum/core/state"
 	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 	"github.com/sirupsen/logrus"
 
 	bcommon "github.com/abassian/shuffle/src/common"
+	"github.com/abassian/shuffle/src/database"
 )
 
 var (
@@ -37,12 +51,16 @@ type Test struct {
 }
 
 func NewTest(dataDir string, logger *logrus.Logger, t *testing.T) *Test {
+	return NewBackendTest(dataDir, database.LevelDB, false, logger, t)
+}
+
+func NewBackendTest(dataDir string, backend string, archive bool, logger *logrus.Logger, t *testing.T) *Test {
 	pwdFile := filepath.Join(dataDir, "pwd.txt")
 	dbFile := filepath.Join(dataDir, "chaindata")
 	genesisFile := filepath.Join(dataDir, "genesis.json")
 	cache := 128
 
-	state, err := NewState(logger, dbFile, cache, genesisFile)
+	state, err := NewState(logger, backend, dbFile, cache, genesisFile, archive, 128)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,7 +154,7 @@ func (test *Test) prepareTransaction(from, to *accounts.Account,
 			data)
 	}
 
-	signer := ethTypes.NewEIP155Signer(big.NewInt(1))
+	signer := test.state.GetSigner()
 
 	signature, err := test.keyStore.SignHash(*from, signer.Hash(tx).Bytes())
 	if err != nil {
@@ -171,11 +189,11 @@ func (test *Test) deployContract(from accounts.Account, contract *Contract, t *t
 	}
 
 	// Try to commit the transaction
-	err = test.state.ApplyTransaction(data, 0, common.Hash{})
+	err = test.state.ApplyTransaction(data, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = test.state.Commit()
+	_, err = test.state.Commit(BlockInfo{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -231,11 +249,11 @@ func TestTransfer(t *testing.T) {
 	}
 
 	// Try to process the block
-	err = test.state.ApplyTransaction(data, 0, common.Hash{})
+	err = test.state.ApplyTransaction(data, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = test.state.Commit()
+	_, err = test.state.Commit(BlockInfo{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -256,163 +274,2149 @@ func TestTransfer(t *testing.T) {
 	}
 }
 
-//------------------------------------------------------------------------------
-type Contract struct {
-	name    string
-	address common.Address
-	code    string
-	abi     string
-	jsonABI abi.ABI
-}
+func TestNoGenesis(t *testing.T) {
+	logger := bcommon.NewTestLogger(t)
 
-func (c *Contract) parseABI(t *testing.T) {
-	jABI, err := abi.JSON(strings.NewReader(c.abi))
+	state, err := NewState(logger, database.Memory, "", 128, "test_data/eth/missing.json", false, 128)
 	if err != nil {
 		t.Fatal(err)
 	}
-	c.jsonABI = jABI
+	defer state.Close()
+
+	// Without a genesis file, the genesis block is empty
+	genesis := state.GetHeadBlock()
+	if genesis == nil || genesis.Number != 0 {
+		t.Fatalf("Head block should be the genesis block, not %v", genesis)
+	}
+	if genesis.StateRoot != ethTypes.EmptyRootHash {
+		t.Fatalf("Genesis state should be empty, not %s", genesis.StateRoot.Hex())
+	}
+
+	// Calls run in the context of the genesis block. The code returns NUMBER.
+	code := common.FromHex("0x4360005260206000f3")
+	msg := ethTypes.NewMessage(common.Address{}, nil, 0, big.NewInt(0), 1000000, big.NewInt(0), code, false)
+	res, err := state.Call(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := new(big.Int).SetBytes(res); n.Sign() != 0 {
+		t.Fatalf("Call should run in block 0, not %v", n)
+	}
+
+	// Historical queries fail, rather than panic, on the blocks and roots that
+	// do not exist
+	if _, err := state.StateAtBlock(1); err == nil {
+		t.Fatal("State of block 1 should not exist")
+	}
+	if _, err := state.StateAtRoot(common.HexToHash("0x01")); err != ErrNotArchive {
+		t.Fatalf("State at an unknown root should return ErrNotArchive, not %v", err)
+	}
+
+	// Nor before the genesis block is committed
+	state.head = nil
+	if _, err := state.StateAtRoot(genesis.StateRoot); err != ErrNoBlock {
+		t.Fatalf("State without a head block should return ErrNoBlock, not %v", err)
+	}
 }
 
-/*
+func TestChainConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shuffle-chain-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
 
-pragma solidity 0.4.8;
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := crypto.PubkeyToAddress(key.PublicKey)
+
+	genesis := fmt.Sprintf(`{
+		"config": {
+			"chainId": 1337,
+			"homesteadBlock": 0,
+			"eip150Block": 0,
+			"eip155Block": 0,
+			"eip158Block": 0,
+			"byzantiumBlock": 0,
+			"constantinopleBlock": 0,
+			"petersburgBlock": 0,
+			"istanbulBlock": 2
+		},
+		"alloc": {"%s": {"balance": "1337000000000000000000"}}
+	}`, from.Hex())
+	genesisFile := filepath.Join(dir, "genesis.json")
+	if err := ioutil.WriteFile(genesisFile, []byte(genesis), 0600); err != nil {
+		t.Fatal(err)
+	}
 
-contract Test {
+	state, err := NewState(bcommon.NewTestLogger(t), database.Memory, "", 128, genesisFile, false, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
 
-   uint localI = 1;
+	if chainID := state.GetChainID(); chainID.Cmp(big.NewInt(1337)) != 0 {
+		t.Fatalf("Chain ID should be 1337, not %v", chainID)
+	}
+	if !state.chainConfig.IsPetersburg(big.NewInt(0)) || state.chainConfig.IsIstanbul(big.NewInt(1)) || !state.chainConfig.IsIstanbul(big.NewInt(2)) {
+		t.Fatalf("Forks should follow the genesis config, not %v", state.chainConfig)
+	}
 
-   event LocalChange(uint);
+	transfer := func(nonce uint64, signer ethTypes.Signer) *ethTypes.Transaction {
+		tx := ethTypes.NewTransaction(nonce, common.Address{1}, big.NewInt(1), 21000, big.NewInt(0), nil)
+		signed, err := ethTypes.SignTx(tx, signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	commit := func(txs ...*ethTypes.Transaction) {
+		for _, tx := range txs {
+			data, err := rlp.EncodeToBytes(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := state.ApplyTransaction(data, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-   function test(uint i) constant returns (uint){
-        return localI * i;
-   }
+	// A transaction signed for another chain is not valid on this one
+	if _, err := state.CheckTx(transfer(0, ethTypes.NewEIP155Signer(big.NewInt(1)))); err == nil {
+		t.Fatal("CheckTx should reject a transaction signed for chain 1")
+	}
 
-   function testAsync(uint i) {
-        localI += i;
-        LocalChange(localI);
-   }
-}
+	tx := transfer(0, state.GetSigner())
+	if !tx.Protected() || tx.ChainId().Cmp(big.NewInt(1337)) != 0 {
+		t.Fatalf("Transaction should be signed for chain 1337, not %v", tx.ChainId())
+	}
+	if _, err := state.CheckTx(tx); err != nil {
+		t.Fatal(err)
+	}
+	commit(tx)
 
-*/
+	// Since Byzantium, the receipt has a status instead of a state root
+	receipt, err := state.GetReceipt(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != ethTypes.ReceiptStatusSuccessful || len(receipt.PostState) != 0 {
+		t.Fatalf("Receipt should have a successful status, got %+v", receipt)
+	}
 
-func dummyContract() *Contract {
-	return &Contract{
-		name: "Test",
-		code: "6060604052600160005534610000575b6101168061001e6000396000f30060606040526000357c0100000000000000000000000000000000000000000000000000000000900463ffffffff16806329e99f07146046578063cb0d1c76146074575b6000565b34600057605e6004808035906020019091905050608e565b6040518082815260200191505060405180910390f35b34600057608c6004808035906020019091905050609d565b005b6000816000540290505b919050565b806000600082825401925050819055507ffa753cb3413ce224c9858a63f9d3cf8d9d02295bdb4916a594b41499014bb57f6000546040518082815260200191505060405180910390a15b505600a165627a7a723058203f0887849cabeb36c6f72cc345c5ff3521d889356357e6815dd8dbe9f7c41bbe0029",
-		abi:  "[{\"constant\":true,\"inputs\":[{\"name\":\"i\",\"type\":\"uint256\"}],\"name\":\"test\",\"outputs\":[{\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"type\":\"function\",\"stateMutability\":\"view\"},{\"constant\":false,\"inputs\":[{\"name\":\"i\",\"type\":\"uint256\"}],\"name\":\"testAsync\",\"outputs\":[],\"payable\":false,\"type\":\"function\",\"stateMutability\":\"nonpayable\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"name\":\"\",\"type\":\"uint256\"}],\"name\":\"LocalChange\",\"type\":\"event\"}]",
+	// CHAINID is only valid from the Istanbul block. Calls run in the context
+	// of the head block.
+	code := common.FromHex("0x4660005260206000f3")
+	msg := ethTypes.NewMessage(common.Address{}, nil, 0, big.NewInt(0), 1000000, big.NewInt(0), code, false)
+	if res, err := state.Call(msg); err == nil && len(res) != 0 {
+		t.Fatalf("CHAINID should not be valid in block 1, got %x", res)
+	}
+
+	commit()
+	res, err := state.Call(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chainID := new(big.Int).SetBytes(res); chainID.Cmp(big.NewInt(1337)) != 0 {
+		t.Fatalf("CHAINID should return 1337 in block 2, not %v", chainID)
+	}
+
+	// The signer also verifies the transactions that the consensus system
+	// delivers
+	data, err := rlp.EncodeToBytes(transfer(1, ethTypes.NewEIP155Signer(big.NewInt(1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.ApplyTransaction(data, 0); err == nil {
+		t.Fatal("ApplyTransaction should reject a transaction signed for chain 1")
 	}
 }
 
-func callDummyContractTest(test *Test, from accounts.Account, contract *Contract, expected *big.Int, t *testing.T) {
-	callData, err := contract.jsonABI.Pack("test", big.NewInt(10))
+func TestBlocks(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	err := test.Init()
+
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	callMsg := ethTypes.NewMessage(from.Address,
-		&contract.address,
-		0,
-		_defaultValue,
-		_defaultGas,
-		_defaultGasPrice,
-		callData,
-		false)
+	// The genesis accounts are committed in block 0
+	genesis := test.state.GetHeadBlock()
+	if genesis == nil || genesis.Number != 0 {
+		t.Fatalf("Head block should be genesis, not %v", genesis)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	tx, err := test.prepareTransaction(&from,
+		&to,
+		big.NewInt(1000),
+		uint64(21000),
+		big.NewInt(0),
+		[]byte{})
 
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	res, err := test.state.Call(callMsg)
+	data, err := rlp.EncodeToBytes(tx)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("call res: %v", res)
 
-	var parsedRes *big.Int
-	err = contract.jsonABI.Unpack(&parsedRes, "test", res)
+	err = test.state.ApplyTransaction(data, 0)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+	root, err := test.state.Commit(BlockInfo{Timestamp: 1234, Consensus: "test", ConsensusIndex: 7})
+	if err != nil {
+		t.Fatal(err)
 	}
-	t.Logf("parsed res: %v", parsedRes)
 
-	if parsedRes.Cmp(expected) != 0 {
-		t.Fatalf("Result should be %v, not %v", expected, parsedRes)
+	head := test.state.GetHeadBlock()
+
+	block, err := test.state.GetBlockByNumber(1)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-}
+	if block.Hash() != head.Hash() {
+		t.Fatalf("Block 1 should be the head block")
+	}
+	if block.ParentHash != genesis.Hash() {
+		t.Fatalf("Block 1 parent should be %v, not %v", genesis.Hash().Hex(), block.ParentHash.Hex())
+	}
+	if block.StateRoot != root {
+		t.Fatalf("Block 1 state root should be %v, not %v", root.Hex(), block.StateRoot.Hex())
+	}
+	if len(block.TxHashes) != 1 || block.TxHashes[0] != tx.Hash() {
+		t.Fatalf("Block 1 should contain transaction %v", tx.Hash().Hex())
+	}
+	if block.Timestamp != 1234 || block.ConsensusIndex != 7 {
+		t.Fatalf("Block 1 should carry the consensus information")
+	}
 
-func callDummyContractTestAsync(test *Test, from accounts.Account, contract *Contract, t *testing.T) {
-	callData, err := contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if _, err := test.state.GetBlockByHash(block.Hash()); err != nil {
+		t.Fatal(err)
+	}
+
+	txLookup, err := test.state.GetTxLookupEntry(tx.Hash())
 	if err != nil {
 		t.Fatal(err)
 	}
+	if txLookup.BlockHash != block.Hash() || txLookup.BlockNumber != 1 || txLookup.Index != 0 {
+		t.Fatalf("Wrong tx lookup entry %v", txLookup)
+	}
 
-	tx, err := test.prepareTransaction(&from,
-		&accounts.Account{Address: contract.address},
-		_defaultValue,
-		_defaultGas,
-		_defaultGasPrice,
-		callData)
+	// Timestamps never go back
+	if _, err := test.state.Commit(BlockInfo{Timestamp: 1000, Consensus: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	if head := test.state.GetHeadBlock(); head.Timestamp != 1234 {
+		t.Fatalf("Block 2 timestamp should be 1234, not %d", head.Timestamp)
+	}
 
+	// Calls run in the context of the head block. This init code returns
+	// BLOCKHASH(1), TIMESTAMP, and NUMBER.
+	code := common.FromHex("0x600140600052426020524360405260606000f3")
+	msg := ethTypes.NewMessage(from.Address, nil, 0, big.NewInt(0), 1000000, big.NewInt(0), code, false)
+	res, err := test.state.Call(msg)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(res) != 96 {
+		t.Fatalf("Call should return 96 bytes, not %d", len(res))
+	}
+	if hash := common.BytesToHash(res[:32]); hash != block.Hash() {
+		t.Fatalf("BLOCKHASH(1) should be %v, not %v", block.Hash().Hex(), hash.Hex())
+	}
+	if timestamp := new(big.Int).SetBytes(res[32:64]); timestamp.Uint64() != 1234 {
+		t.Fatalf("TIMESTAMP should be 1234, not %v", timestamp)
+	}
+	if number := new(big.Int).SetBytes(res[64:]); number.Uint64() != 2 {
+		t.Fatalf("NUMBER should be 2, not %v", number)
+	}
+}
 
-	// Convert to raw bytes
+func TestLatestState(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	tx, err := test.prepareTransaction(&from,
+		&to,
+		big.NewInt(1000),
+		uint64(21000),
+		big.NewInt(0),
+		[]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	data, err := rlp.EncodeToBytes(tx)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := test.state.ApplyTransaction(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := test.state.Commit(BlockInfo{}); err != nil {
+		t.Fatal(err)
+	}
 
-	// Try to process the block
-	err = test.state.ApplyTransaction(data, 0, common.Hash{})
+	// Without archive mode, only the latest state is available
+	if _, err := test.state.StateAtBlock(0); err != ErrNotArchive {
+		t.Fatalf("StateAtBlock(0) should fail with ErrNotArchive, not %v", err)
+	}
+	latest, err := test.state.StateAtRoot(test.state.GetHeadBlock().StateRoot)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = test.state.Commit()
-	if err != nil {
+	if latest.GetBalance(to.Address).Cmp(test.state.GetBalance(to.Address)) != 0 {
+		t.Fatalf("Latest balance should be %v, not %v", test.state.GetBalance(to.Address), latest.GetBalance(to.Address))
+	}
+}
+
+func TestHistoricalState(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewBackendTest("test_data/eth", database.LevelDB, true, logger, t)
+
+	if err := test.Init(); err != nil {
 		t.Fatal(err)
 	}
 
-	receipt, err := test.state.GetReceipt(tx.Hash())
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	// balances[i] is the balance of the recipient at block i
+	balances := []*big.Int{test.state.GetBalance(to.Address)}
+	for i := 0; i < 3; i++ {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		balances = append(balances, test.state.GetBalance(to.Address))
+	}
+
+	check := func() {
+		for _, number := range []uint64{0, 1, 2} {
+			st, err := test.state.StateAtBlock(number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := st.GetBalance(to.Address); b.Cmp(balances[number]) != 0 {
+				t.Fatalf("Balance at block %d should be %v, not %v", number, balances[number], b)
+			}
+			if n := st.GetNonce(from.Address); n != number {
+				t.Fatalf("Nonce at block %d should be %d, not %d", number, number, n)
+			}
+
+			// The recipient can only spend its balance at that block
+			spend := func(value *big.Int) ethTypes.Message {
+				return ethTypes.NewMessage(to.Address, &from.Address, 0, value, 0, big.NewInt(0), nil, false)
+			}
+			if gas, err := st.EstimateGas(spend(balances[number])); err != nil || gas != params.TxGas {
+				t.Fatalf("Spending the balance at block %d should need %d gas, got %d, %v", number, params.TxGas, gas, err)
+			}
+			if _, err := st.EstimateGas(spend(balances[number+1])); err == nil {
+				t.Fatalf("Spending more than the balance at block %d should fail", number)
+			}
+		}
+
+		if _, err := test.state.StateAtRoot(common.HexToHash("0x1234")); err == nil {
+			t.Fatal("StateAtRoot should fail with an unknown root")
+		}
+	}
+
+	// The state of the intermediate blocks is kept after later commits
+	check()
+
+	// and after a restart
+	if err := test.state.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	test.state, err = NewState(logger,
+		database.LevelDB,
+		test.dbFile,
+		test.cache,
+		"test_data/eth/genesis.json",
+		true,
+		128)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer test.state.Close()
 
-	t.Log(receipt)
+	check()
 }
 
-func TestCreateContract(t *testing.T) {
-
+// TestConcurrentReads reads the state from several goroutines while blocks are
+// committed. Run it with the race detector.
+func TestConcurrentReads(t *testing.T) {
 	os.RemoveAll("test_data/eth/chaindata")
 	defer os.RemoveAll("test_data/eth/chaindata")
 
 	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
 	defer test.state.db.Close()
 
-	err := test.Init()
-
-	if err != nil {
+	if err := test.Init(); err != nil {
 		t.Fatal(err)
 	}
 
 	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+	value := big.NewInt(1000)
+	balanceBefore := test.state.GetBalance(to.Address)
+
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// The balance of the recipient never goes back, and each read
+			// sees the state of a whole block
+			last := balanceBefore
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				balance := test.state.GetBalance(to.Address)
+				if balance.Cmp(last) < 0 {
+					errs <- fmt.Errorf("balance went from %v to %v", last, balance)
+					return
+				}
+				last = balance
+
+				if sent := new(big.Int).Sub(balance, balanceBefore); new(big.Int).Mod(sent, value).Sign() != 0 {
+					errs <- fmt.Errorf("balance %v is not the result of whole transfers", balance)
+					return
+				}
+
+				head := test.state.GetHeadBlock()
+				proof, err := test.state.GetProof(to.Address, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if proof.Balance.Cmp(last) < 0 {
+					errs <- fmt.Errorf("proven balance %v is older than %v", proof.Balance, last)
+					return
+				}
+
+				test.state.GetNonce(from.Address)
+				test.state.GetStorageAt(to.Address, common.Hash{})
+				test.state.GetPoolNonce(from.Address)
+
+				msg := ethTypes.NewMessage(from.Address, &to.Address, 0, value, 21000, big.NewInt(0), nil, false)
+				if _, err := test.state.Call(msg); err != nil {
+					errs <- err
+					return
+				}
+
+				if _, err := test.state.StateAtRoot(head.StateRoot); err != nil && err != ErrNotArchive {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
 
-	contract := dummyContract()
+	for i := 0; i < 20; i++ {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			value,
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	test.deployContract(from, contract, t)
+	close(done)
+	wg.Wait()
 
-	contract.parseABI(t)
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
 
-	// Call constant test method
-	callDummyContractTest(test, from, contract, big.NewInt(10), t)
+	expected := new(big.Int).Add(balanceBefore, new(big.Int).Mul(value, big.NewInt(20)))
+	if balance := test.state.GetBalance(to.Address); balance.Cmp(expected) != 0 {
+		t.Fatalf("Balance should be %v, not %v", expected, balance)
+	}
+}
 
-	// Execute state-altering testAsync method
-	callDummyContractTestAsync(test, from, contract, t)
+func TestPrune(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
 
-	// Call constant test method
-	callDummyContractTest(test, from, contract, big.NewInt(110), t)
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write every state to disk
+	test.state.was.archive = true
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	txHashes := []common.Hash{}
+	for i := 0; i < 5; i++ {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		txHashes = append(txHashes, tx.Hash())
+	}
 
+	head := test.state.GetHeadBlock()
+	old, err := test.state.GetBlockByNumber(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.New(database.LevelDB, "test_data/eth/chaindata", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	deleted, err := Prune(db, 2, bcommon.NewTestLogger(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted == 0 {
+		t.Fatal("Prune should delete the nodes of old states")
+	}
+
+	if err := verifyState(db, head.StateRoot); err != nil {
+		t.Fatalf("State of head block should be complete: %v", err)
+	}
+	if err := verifyState(db, old.StateRoot); err == nil {
+		t.Fatal("State of block 1 should be pruned")
+	}
+
+	// Transactions are stored under their hash, like trie nodes, but they
+	// must be kept
+	for _, hash := range txHashes {
+		if ok, _ := db.Has(hash.Bytes()); !ok {
+			t.Fatalf("Transaction %v should not be pruned", hash.Hex())
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, backend := range []string{database.LevelDB, database.Memory, database.Bolt} {
+		t.Run(backend, func(t *testing.T) {
+			testSnapshot(backend, t)
+		})
+	}
+}
+
+func testSnapshot(backend string, t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewBackendTest("test_data/eth", backend, false, bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	err := test.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	transfer := func() {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transfer()
+
+	head := test.state.GetHeadBlock()
+	balance := test.state.GetBalance(to.Address)
+
+	snap, err := test.state.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	// Move the state past the snapshot, then restore it
+	transfer()
+
+	if test.state.GetHeadBlock().Number != head.Number+1 {
+		t.Fatalf("Head block should have moved")
+	}
+
+	if err := test.state.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if test.state.GetHeadBlock().Hash() != head.Hash() {
+		t.Fatalf("Head block should be %v after restore", head.Hash().Hex())
+	}
+	if _, err := test.state.GetBlockByNumber(head.Number + 1); err == nil {
+		t.Fatalf("Block %d should not exist after restore", head.Number+1)
+	}
+	if b := test.state.GetBalance(to.Address); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should be %v after restore, not %v", balance, b)
+	}
+
+	// The restored state accepts new transactions
+	transfer()
+
+	if test.state.GetHeadBlock().ParentHash != head.Hash() {
+		t.Fatalf("New block should follow the restored head")
+	}
+}
+
+func TestInterruptedRestore(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+
+	snap, err := test.state.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	// The stream ends in the middle of its last entry
+	if err := test.state.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()-1])); err == nil {
+		t.Fatal("Restore of a truncated snapshot should fail")
+	}
+	test.state.db.Close()
+
+	_, err = NewState(logger,
+		database.LevelDB,
+		test.dbFile,
+		test.cache,
+		"test_data/eth/genesis.json",
+		false,
+		128)
+	if err != ErrRestoreInterrupted {
+		t.Fatalf("State should not be opened after an interrupted restore, error should be %v, not %v", ErrRestoreInterrupted, err)
+	}
+}
+
+func TestRestoreIncompleteState(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+
+	snap, err := test.state.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := snap.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	snap.Release()
+
+	// Copy the snapshot without the root node of the state
+	stream := rlp.NewStream(&buf, 0)
+	var header snapshotHeader
+	if err := stream.Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	var incomplete bytes.Buffer
+	if err := rlp.Encode(&incomplete, header); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var entry snapshotEntry
+		if err := stream.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(entry.Key, header.Root.Bytes()) {
+			continue
+		}
+		if err := rlp.Encode(&incomplete, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := test.state.Restore(&incomplete); err == nil {
+		t.Fatal("Restore of a snapshot without the state of its head block should fail")
+	}
+	test.state.db.Close()
+
+	_, err = NewState(logger,
+		database.LevelDB,
+		test.dbFile,
+		test.cache,
+		"test_data/eth/genesis.json",
+		false,
+		128)
+	if err != ErrRestoreInterrupted {
+		t.Fatalf("State should not be opened after a failed restore, error should be %v, not %v", ErrRestoreInterrupted, err)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+
+	err := test.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	reopen := func() {
+		test.state, err = NewState(logger,
+			database.LevelDB,
+			test.dbFile,
+			test.cache,
+			"test_data/eth/genesis.json",
+			false,
+			2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.state.SetReplayable(true)
+	}
+
+	transfer := func() common.Hash {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		return tx.Hash()
+	}
+
+	// After a clean shutdown, the State resumes from the head block, without
+	// creating the genesis accounts again
+	transfer()
+	balance := test.state.GetBalance(to.Address)
+
+	if err := test.state.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+
+	if n := test.state.GetHeadBlock().Number; n != 1 {
+		t.Fatalf("Head block should be 1, not %d", n)
+	}
+	if b := test.state.GetBalance(to.Address); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should be %v, not %v", balance, b)
+	}
+
+	// With a retention of 2, the state of block 2 is written as a checkpoint
+	// once block 4 is committed. The later ones are lost in a crash.
+	var hashes []common.Hash
+	var rejected common.Hash
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			// A transaction without signature is rejected in block 4
+			tx := ethTypes.NewTransaction(0, common.Address{}, big.NewInt(0), 21000, big.NewInt(0), nil)
+			data, err := rlp.EncodeToBytes(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.state.ApplyTransaction(data, 0)
+			rejected = tx.Hash()
+		}
+		hashes = append(hashes, transfer())
+		if i == 0 {
+			balance = test.state.GetBalance(to.Address)
+		}
+	}
+	if n := test.state.GetHeadBlock().Number; n != 5 {
+		t.Fatalf("Head block should be 5, not %d", n)
+	}
+	if _, err := test.state.GetRejectedTx(rejected); err != nil {
+		t.Fatalf("Transaction should be recorded as rejected: %v", err)
+	}
+
+	// Block 4 emitted logs
+	var bloom ethTypes.Bloom
+	bloom.Add(big.NewInt(4))
+	if err := writeMipmapBloom(test.state.commitDB, test.state.commitDB, 4, bloom); err != nil {
+		t.Fatal(err)
+	}
+	if err := test.state.commitDB.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	test.state.db.Close()
+	reopen()
+	defer test.state.Close()
+
+	head := test.state.GetHeadBlock()
+	if head.Number != 2 {
+		t.Fatalf("Head block should be 2 after a crash, not %d", head.Number)
+	}
+	if b := test.state.GetBalance(to.Address); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should be %v after a crash, not %v", balance, b)
+	}
+	if _, err := test.state.GetBlockByNumber(3); err == nil {
+		t.Fatal("Block 3 should be removed")
+	}
+	if _, err := test.state.GetTransaction(hashes[1]); err == nil {
+		t.Fatal("Transaction of block 3 should be removed")
+	}
+	if _, err := test.state.GetReceipt(hashes[0]); err != nil {
+		t.Fatalf("Receipt of block 2 should be kept: %v", err)
+	}
+	if _, err := test.state.GetRejectedTx(rejected); err == nil {
+		t.Fatal("Rejected transaction of block 4 should be removed")
+	}
+	for _, level := range MIPMapLevels {
+		if bloom, _ := readMipmapBloom(test.state.db, level, 4); bloom != (ethTypes.Bloom{}) {
+			t.Fatalf("Log bloom of block 4 should be removed from level %d", level)
+		}
+	}
+
+	// The next block follows the recovered head
+	transfer()
+
+	if test.state.GetHeadBlock().ParentHash != head.Hash() {
+		t.Fatal("New block should follow the recovered head")
+	}
+}
+
+// failingDB is a database whose batches cannot be written
+type failingDB struct {
+	database.Database
+}
+
+func (db failingDB) NewBatch() ethdb.Batch {
+	return failingBatch{db.Database.NewBatch()}
+}
+
+type failingBatch struct {
+	ethdb.Batch
+}
+
+func (b failingBatch) Write() error {
+	return errors.New("disk full")
+}
+
+// TestFailedCommit checks that the trie nodes that a failed commit moved out
+// of memory are written with the next commit
+func TestFailedCommit(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	apply := func(from, to accounts.Account) {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := test.state.commitDB.Database
+	test.state.commitDB.Database = failingDB{db}
+
+	apply(from, to)
+	if _, err := test.state.Commit(BlockInfo{}); err == nil {
+		t.Fatal("Commit should fail")
+	}
+	if n := test.state.GetHeadBlock().Number; n != 0 {
+		t.Fatalf("Head block should still be 0, not %d", n)
+	}
+
+	test.state.commitDB.Database = db
+
+	// The transaction of the failed commit is still applied to the WAS
+	apply(to, from)
+	if _, err := test.state.Commit(BlockInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	head := test.state.GetHeadBlock()
+	if head.Number != 1 {
+		t.Fatalf("Head block should be 1, not %d", head.Number)
+	}
+	if err := verifyState(db, head.StateRoot); err != nil {
+		t.Fatalf("State of head block should be on disk: %v", err)
+	}
+
+	test.state.Close()
+}
+
+// TestRecoveryWithoutReplay checks that no block is lost in a crash when the
+// consensus system cannot deliver them again, as with Solo
+func TestRecoveryWithoutReplay(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	for i := 0; i < 3; i++ {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	head := test.state.GetHeadBlock()
+	balance := test.state.GetBalance(to.Address)
+
+	test.state.db.Close()
+
+	st, err := NewState(logger,
+		database.LevelDB,
+		test.dbFile,
+		test.cache,
+		"test_data/eth/genesis.json",
+		false,
+		128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	if st.GetHeadBlock().Hash() != head.Hash() {
+		t.Fatalf("Head block should still be %d after a crash, not %d", head.Number, st.GetHeadBlock().Number)
+	}
+	if b := st.GetBalance(to.Address); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should be %v after a crash, not %v", balance, b)
+	}
+}
+
+func TestGenesisHash(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+	if err := test.state.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile("test_data/eth/genesis.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var genesis map[string]interface{}
+	if err := json.Unmarshal(data, &genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "shuffle-genesis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	open := func(genesis map[string]interface{}) error {
+		js, err := json.MarshalIndent(genesis, "", "    ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		genesisFile := filepath.Join(dir, "genesis.json")
+		if err := ioutil.WriteFile(genesisFile, js, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		state, err := NewState(logger, database.LevelDB, test.dbFile, test.cache, genesisFile, false, 128)
+		if err != nil {
+			return err
+		}
+		return state.Close()
+	}
+
+	// The same genesis, formatted differently and with its keys in another
+	// order, is accepted
+	if err := open(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another genesis is rejected
+	alloc := genesis["alloc"].(map[string]interface{})
+	alloc["2db386883ac7e575f28773a9cef5f7af275731af"] = alloc["59d6e09fde8bf65183ddd1e0ca06f3d618c44c57"]
+	if err := open(genesis); err == nil {
+		t.Fatal("A different genesis file should be rejected")
+	}
+
+	// The rejection leaves the database closed, and unchanged
+	delete(alloc, "2db386883ac7e575f28773a9cef5f7af275731af")
+	if err := open(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	// So are the changes to the fields that this version does not read, as
+	// they may matter to the version that created the database
+	genesis["shanghaiBlock"] = 0
+	if err := open(genesis); err == nil {
+		t.Fatal("A genesis file with another field should be rejected")
+	}
+}
+
+func TestStateSnapshot(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	logger := bcommon.NewTestLogger(t)
+
+	test := NewTest("test_data/eth", logger, t)
+	defer test.state.db.Close()
+
+	err := test.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	for i := 0; i < 3; i++ {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			big.NewInt(0),
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{Consensus: "huron", ConsensusIndex: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	block, err := test.state.GetBlockByNumber(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := test.state.GetStateSnapshot("huron", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewState(logger,
+		database.Memory,
+		"",
+		128,
+		"test_data/eth/genesis.json",
+		false,
+		128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.db.Close()
+
+	// A snapshot with a missing node is rejected
+	var corrupt stateSnapshot
+	if err := rlp.DecodeBytes(snapshot, &corrupt); err != nil {
+		t.Fatal(err)
+	}
+	nodes := corrupt.Nodes
+	corrupt.Nodes = nodes[1:]
+	corruptBytes, err := rlp.EncodeToBytes(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RestoreStateSnapshot(corruptBytes); err == nil {
+		t.Fatalf("Restoring an incomplete snapshot should fail")
+	}
+
+	// So is one with a transaction that is not in its block
+	corrupt.Nodes = nodes
+	if len(corrupt.History) != 3 {
+		t.Fatalf("Snapshot should contain blocks 2 to 0, not %d blocks", len(corrupt.History))
+	}
+	corrupt.History[1].Txs[0] = corrupt.History[0].Txs[0]
+	corruptBytes, err = rlp.EncodeToBytes(corrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.RestoreStateSnapshot(corruptBytes); err == nil {
+		t.Fatalf("Restoring a snapshot with a wrong transaction should fail")
+	}
+
+	if err := restored.RestoreStateSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	head := restored.GetHeadBlock()
+	if head.Hash() != block.Hash() {
+		t.Fatalf("Head block should be %v, not %v", block.Hash().Hex(), head.Hash().Hex())
+	}
+	if b := restored.GetBalance(to.Address); b.Cmp(big.NewInt(2000)) != 0 {
+		t.Fatalf("Balance should be 2000, not %v", b)
+	}
+	if n := restored.GetNonce(from.Address); n != 2 {
+		t.Fatalf("Nonce should be 2, not %d", n)
+	}
+
+	// The blocks before the snapshot's, with their transactions and
+	// receipts, are restored too
+	parent, err := test.state.GetBlockByNumber(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := restored.GetBlockByNumber(1); err != nil || b.Hash() != parent.Hash() {
+		t.Fatalf("Block 1 should be %v, got %v (%v)", parent.Hash().Hex(), b, err)
+	}
+	txHash := parent.TxHashes[0]
+	if tx, err := restored.GetTransaction(txHash); err != nil || tx.Hash() != txHash {
+		t.Fatalf("Transaction %v should be restored, got %v (%v)", txHash.Hex(), tx, err)
+	}
+	if receipt, err := restored.GetReceipt(txHash); err != nil || receipt.TxHash != txHash {
+		t.Fatalf("Receipt of %v should be restored, got %v (%v)", txHash.Hex(), receipt, err)
+	}
+
+	// BLOCKHASH reads the hashes of the restored blocks
+	code := common.FromHex("0x60014060005260206000f3")
+	msg := ethTypes.NewMessage(common.Address{}, nil, 0, big.NewInt(0), 1000000, big.NewInt(0), code, false)
+	res, err := restored.Call(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := common.BytesToHash(res); hash != parent.Hash() {
+		t.Fatalf("BLOCKHASH(1) should be %v, not %v", parent.Hash().Hex(), hash.Hex())
+	}
+
+	// A node is only restored from a snapshot that is ahead of it
+	if err := restored.RestoreStateSnapshot(snapshot); err == nil {
+		t.Fatal("Restoring a snapshot of the head block should fail")
+	}
+}
+
+//------------------------------------------------------------------------------
+type Contract struct {
+	name    string
+	address common.Address
+	code    string
+	abi     string
+	jsonABI abi.ABI
+}
+
+func (c *Contract) parseABI(t *testing.T) {
+	jABI, err := abi.JSON(strings.NewReader(c.abi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.jsonABI = jABI
+}
+
+/*
+
+pragma solidity 0.4.8;
+
+contract Test {
+
+   uint localI = 1;
+
+   event LocalChange(uint);
+
+   function test(uint i) constant returns (uint){
+        return localI * i;
+   }
+
+   function testAsync(uint i) {
+        localI += i;
+        LocalChange(localI);
+   }
+}
+
+*/
+
+func dummyContract() *Contract {
+	return &Contract{
+		name: "Test",
+		code: "6060604052600160005534610000575b6101168061001e6000396000f30060606040526000357c0100000000000000000000000000000000000000000000000000000000900463ffffffff16806329e99f07146046578063cb0d1c76146074575b6000565b34600057605e6004808035906020019091905050608e565b6040518082815260200191505060405180910390f35b34600057608c6004808035906020019091905050609d565b005b6000816000540290505b919050565b806000600082825401925050819055507ffa753cb3413ce224c9858a63f9d3cf8d9d02295bdb4916a594b41499014bb57f6000546040518082815260200191505060405180910390a15b505600a165627a7a723058203f0887849cabeb36c6f72cc345c5ff3521d889356357e6815dd8dbe9f7c41bbe0029",
+		abi:  "[{\"constant\":true,\"inputs\":[{\"name\":\"i\",\"type\":\"uint256\"}],\"name\":\"test\",\"outputs\":[{\"name\":\"\",\"type\":\"uint256\"}],\"payable\":false,\"type\":\"function\",\"stateMutability\":\"view\"},{\"constant\":false,\"inputs\":[{\"name\":\"i\",\"type\":\"uint256\"}],\"name\":\"testAsync\",\"outputs\":[],\"payable\":false,\"type\":\"function\",\"stateMutability\":\"nonpayable\"},{\"anonymous\":false,\"inputs\":[{\"indexed\":false,\"name\":\"\",\"type\":\"uint256\"}],\"name\":\"LocalChange\",\"type\":\"event\"}]",
+	}
+}
+
+func callDummyContractTest(test *Test, from accounts.Account, contract *Contract, expected *big.Int, t *testing.T) {
+	callData, err := contract.jsonABI.Pack("test", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callMsg := ethTypes.NewMessage(from.Address,
+		&contract.address,
+		0,
+		_defaultValue,
+		_defaultGas,
+		_defaultGasPrice,
+		callData,
+		false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := test.state.Call(callMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("call res: %v", res)
+
+	var parsedRes *big.Int
+	err = contract.jsonABI.Unpack(&parsedRes, "test", res)
+	if err != nil {
+		t.Error(err)
+	}
+	t.Logf("parsed res: %v", parsedRes)
+
+	if parsedRes.Cmp(expected) != 0 {
+		t.Fatalf("Result should be %v, not %v", expected, parsedRes)
+	}
+
+}
+
+func callDummyContractTestAsync(test *Test, from accounts.Account, contract *Contract, t *testing.T) {
+	callData, err := contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := test.prepareTransaction(&from,
+		&accounts.Account{Address: contract.address},
+		_defaultValue,
+		_defaultGas,
+		_defaultGasPrice,
+		callData)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Convert to raw bytes
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Try to process the block
+	err = test.state.ApplyTransaction(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = test.state.Commit(BlockInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt, err := test.state.GetReceipt(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log(receipt)
+}
+
+func TestCreateContract(t *testing.T) {
+
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	err := test.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+
+	test.deployContract(from, contract, t)
+
+	contract.parseABI(t)
+
+	// Call constant test method
+	callDummyContractTest(test, from, contract, big.NewInt(10), t)
+
+	// Execute state-altering testAsync method
+	callDummyContractTestAsync(test, from, contract, t)
+
+	// Call constant test method
+	callDummyContractTest(test, from, contract, big.NewInt(110), t)
+
+}
+
+func TestProof(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+
+	// The constructor sets localI, in the first slot, to 1
+	slot := common.Hash{}
+	one := common.BigToHash(big.NewInt(1))
+	if value := test.state.GetStorageAt(contract.address, slot); value != one {
+		t.Fatalf("Storage slot should be %s, not %s", one.Hex(), value.Hex())
+	}
+
+	proof, err := test.state.GetProof(contract.address, []common.Hash{slot})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(root common.Hash, key []byte, nodes [][]byte) []byte {
+		proofDb := memorydb.New()
+		for _, node := range nodes {
+			proofDb.Put(crypto.Keccak256(node), node)
+		}
+		value, _, err := trie.VerifyProof(root, crypto.Keccak256(key), proofDb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	// The account proof leads from the state root to the account
+	if root := test.state.GetHeadBlock().StateRoot; proof.Root != root {
+		t.Fatalf("Proof should be against %s, not %s", root.Hex(), proof.Root.Hex())
+	}
+	var account ethState.Account
+	if err := rlp.DecodeBytes(verify(proof.Root, contract.address.Bytes(), proof.AccountProof), &account); err != nil {
+		t.Fatal(err)
+	}
+	if account.Root != proof.StorageHash {
+		t.Fatalf("Storage hash should be %s, not %s", account.Root.Hex(), proof.StorageHash.Hex())
+	}
+	if common.BytesToHash(account.CodeHash) != proof.CodeHash {
+		t.Fatalf("Code hash should be %x, not %s", account.CodeHash, proof.CodeHash.Hex())
+	}
+
+	// The storage proof leads from the storage hash to the slot
+	var value []byte
+	if err := rlp.DecodeBytes(verify(proof.StorageHash, slot.Bytes(), proof.StorageProof[0].Proof), &value); err != nil {
+		t.Fatal(err)
+	}
+	if common.BytesToHash(value) != one || proof.StorageProof[0].Value != one {
+		t.Fatalf("Proven storage slot should be %s, not %x", one.Hex(), value)
+	}
+
+	// A missing account is proven absent
+	missing := common.HexToAddress("0x1234")
+	proof, err = test.state.GetProof(missing, []common.Hash{slot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := verify(proof.Root, missing.Bytes(), proof.AccountProof); value != nil {
+		t.Fatalf("Missing account should have no value, not %x", value)
+	}
+	if proof.StorageHash != ethTypes.EmptyRootHash || len(proof.StorageProof[0].Proof) != 0 {
+		t.Fatal("Missing account should have an empty storage")
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+
+	// The state of the head block is written to disk on shutdown
+	if err := test.state.was.flush(); err != nil {
+		t.Fatal(err)
+	}
+	root, err := StateRoot(test.state.db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpState(test.state.db, root, &buf); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := ReadDump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account, ok := dump.Accounts[contract.address]
+	if !ok {
+		t.Fatalf("Dump should contain the contract %s", contract.address.Hex())
+	}
+	if !bytes.Equal(account.Code, test.state.GetCode(contract.address)) {
+		t.Fatal("Dumped code should be the contract's")
+	}
+	if value := account.Storage[common.Hash{}]; value != common.BigToHash(big.NewInt(1)) {
+		t.Fatalf("Dumped storage slot should be 1, not %s", value.Hex())
+	}
+	if nonce := dump.Accounts[from.Address].Nonce; nonce != 1 {
+		t.Fatalf("Dumped nonce should be 1, not %d", nonce)
+	}
+
+	// A network started from the dump has the same state
+	base, err := test.state.GetGenesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis := GenesisFromDump(dump, base)
+	if _, ok := genesis.Alloc[strings.ToLower(base.Poa.Address)]; ok {
+		t.Fatal("POA contract should not be in the alloc section")
+	}
+
+	dir, err := ioutil.TempDir("", "shuffle-genesis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	js, err := json.Marshal(genesis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisFile := filepath.Join(dir, "genesis.json")
+	if err := ioutil.WriteFile(genesisFile, js, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := NewState(test.logger, database.Memory, "", 128, genesisFile, false, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.db.Close()
+
+	if newRoot := state.GetHeadBlock().StateRoot; newRoot != root {
+		t.Fatalf("State root from the dump should be %s, not %s", root.Hex(), newRoot.Hex())
+	}
+}
+
+func TestGetLogs(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+	contract.parseABI(t)
+
+	// Each call to testAsync emits a LocalChange event in its own block
+	callDummyContractTestAsync(test, from, contract, t)
+	callDummyContractTestAsync(test, from, contract, t)
+
+	head := test.state.GetHeadBlock().Number
+	localChange := contract.jsonABI.Events["LocalChange"].ID()
+
+	testCases := []struct {
+		filter   LogFilter
+		expected int
+	}{
+		{LogFilter{}, 2},
+		{LogFilter{Addresses: []common.Address{contract.address}}, 2},
+		{LogFilter{Addresses: []common.Address{from.Address}}, 0},
+		{LogFilter{Topics: [][]common.Hash{{localChange}}}, 2},
+		{LogFilter{Topics: [][]common.Hash{{common.Hash{}}}}, 0},
+		{LogFilter{Topics: [][]common.Hash{{localChange}, {localChange}}}, 0},
+	}
+
+	for i, tc := range testCases {
+		logs, err := test.state.GetLogs(0, head, tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != tc.expected {
+			t.Fatalf("case %d: expected %d logs, got %d", i, tc.expected, len(logs))
+		}
+		for _, log := range logs {
+			if log.Address != contract.address {
+				t.Fatalf("case %d: log emitted by %s", i, log.Address.Hex())
+			}
+		}
+	}
+
+	// The range excludes the first call
+	logs, err := test.state.GetLogs(head, head, LogFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].BlockNumber != head {
+		t.Fatalf("expected the log of block %d, got %v", head, logs)
+	}
+}
+
+func TestEstimateGas(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	// A plain transfer costs the intrinsic gas
+	transfer := ethTypes.NewMessage(from.Address, &to.Address, 0, big.NewInt(1000), 0, big.NewInt(0), nil, false)
+	gas, err := test.state.EstimateGas(transfer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gas != params.TxGas {
+		t.Fatalf("Transfer should need %d gas, not %d", params.TxGas, gas)
+	}
+
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+	contract.parseABI(t)
+
+	callData, err := contract.jsonABI.Pack("testAsync", big.NewInt(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := ethTypes.NewMessage(from.Address, &contract.address, 0, big.NewInt(0), 0, big.NewInt(0), callData, false)
+	gas, err = test.state.EstimateGas(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The estimate is enough, and one less is not
+	for _, tc := range []struct {
+		gas      uint64
+		expected *big.Int
+	}{
+		{gas - 1, big.NewInt(10)},
+		{gas, big.NewInt(110)},
+	} {
+		tx, err := test.prepareTransaction(&from,
+			&accounts.Account{Address: contract.address},
+			big.NewInt(0),
+			tc.gas,
+			big.NewInt(0),
+			callData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.CheckTx(tx); err != nil {
+			t.Fatal(err)
+		}
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+
+		callDummyContractTest(test, from, contract, tc.expected, t)
+	}
+}
+
+func TestFees(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+	proposer := common.HexToAddress("0xc0ffee0000000000000000000000000000000001")
+	gasPrice := big.NewInt(10)
+	fee := new(big.Int).Mul(big.NewInt(21000), gasPrice)
+
+	transfer := func() {
+		tx, err := test.prepareTransaction(&from,
+			&to,
+			big.NewInt(1000),
+			uint64(21000),
+			gasPrice,
+			[]byte{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := rlp.EncodeToBytes(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.CheckTx(tx); err != nil {
+			t.Fatal(err)
+		}
+		test.state.SetProposer(proposer)
+		if err := test.state.ApplyTransaction(data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// By default, the proposer is paid the fees
+	transfer()
+	if balance := test.state.GetBalance(proposer); balance.Cmp(fee) != 0 {
+		t.Fatalf("Proposer balance should be %v, not %v", fee, balance)
+	}
+	if coinbase := test.state.GetHeadBlock().Coinbase; coinbase != proposer {
+		t.Fatalf("Block coinbase should be %s, not %s", proposer.Hex(), coinbase.Hex())
+	}
+
+	// Burnt fees are not paid to anyone
+	test.state.was.fees = feePolicy{burn: true, burnZero: true}
+	burnBalance := test.state.GetBalance(common.Address{})
+	transfer()
+	if balance := test.state.GetBalance(proposer); balance.Cmp(fee) != 0 {
+		t.Fatalf("Proposer balance should still be %v, not %v", fee, balance)
+	}
+	if balance := test.state.GetBalance(common.Address{}); balance.Cmp(burnBalance) != 0 {
+		t.Fatalf("Zero address balance should still be %v, not %v", burnBalance, balance)
+	}
+	if coinbase := test.state.GetHeadBlock().Coinbase; coinbase != (common.Address{}) {
+		t.Fatalf("Block coinbase should be empty, not %s", coinbase.Hex())
+	}
+
+	// Without a fee policy in the genesis file, the fees of a block without a
+	// proposer are paid to the zero address, as they were before fee policies
+	test.state.was.fees = feePolicy{}
+	proposer = common.Address{}
+	transfer()
+	burnBalance.Add(burnBalance, fee)
+	if balance := test.state.GetBalance(common.Address{}); balance.Cmp(burnBalance) != 0 {
+		t.Fatalf("Zero address balance should be %v, not %v", burnBalance, balance)
+	}
+
+	// Transactions below the minimum gas price are rejected
+	test.state.SetMinGasPrice(big.NewInt(11))
+	tx, err := test.prepareTransaction(&from,
+		&to,
+		big.NewInt(1000),
+		uint64(21000),
+		gasPrice,
+		[]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := test.state.CheckTx(tx); err == nil {
+		t.Fatal("CheckTx should reject a transaction below the minimum gas price")
+	}
+}
+
+func TestTxPool(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+	signer := test.state.GetSigner()
+
+	newValueTx := func(nonce uint64, gasPrice int64, value *big.Int) *ethTypes.Transaction {
+		tx := ethTypes.NewTransaction(nonce, to.Address, value, 21000, big.NewInt(gasPrice), nil)
+		signature, err := test.keyStore.SignHash(from, signer.Hash(tx).Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		signedTx, err := tx.WithSignature(signer, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signedTx
+	}
+
+	newTx := func(nonce uint64, gasPrice int64) *ethTypes.Transaction {
+		return newValueTx(nonce, gasPrice, big.NewInt(1000))
+	}
+
+	checkTx := func(tx *ethTypes.Transaction, expected ...*ethTypes.Transaction) {
+		pending, err := test.state.CheckTx(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != len(expected) {
+			t.Fatalf("%d transactions should become pending, not %d", len(expected), len(pending))
+		}
+		for i := range expected {
+			if pending[i].Hash() != expected[i].Hash() {
+				t.Fatalf("Pending transaction %d should be %s, not %s", i, expected[i].Hash().Hex(), pending[i].Hash().Hex())
+			}
+		}
+	}
+
+	checkStats := func(expectedPending, expectedQueued int) {
+		pending, queued := test.state.GetPoolStats()
+		if pending != expectedPending || queued != expectedQueued {
+			t.Fatalf("TxPool should have %d pending and %d queued transactions, not %d and %d", expectedPending, expectedQueued, pending, queued)
+		}
+	}
+
+	commit := func(txs ...*ethTypes.Transaction) {
+		for _, tx := range txs {
+			data, err := rlp.EncodeToBytes(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.state.ApplyTransaction(data, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := test.state.Commit(BlockInfo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A nonce gap queues the transaction
+	tx1 := newTx(1, 10)
+	checkTx(tx1)
+	checkStats(0, 1)
+
+	if _, err := test.state.CheckTx(tx1); err != ErrAlreadyKnown {
+		t.Fatalf("Duplicate should fail with ErrAlreadyKnown, not %v", err)
+	}
+	if _, err := test.state.CheckTx(newTx(1, 10)); err == nil {
+		t.Fatal("Replacement with the same gas price should fail")
+	}
+	tx1 = newTx(1, 11)
+	checkTx(tx1)
+	checkStats(0, 1)
+
+	// Filling the gap promotes the queued transaction
+	tx0 := newTx(0, 10)
+	checkTx(tx0, tx0, tx1)
+	checkStats(2, 0)
+
+	if _, err := test.state.CheckTx(newTx(0, 20)); err == nil {
+		t.Fatal("Pending transactions should not be replaced")
+	}
+
+	// Committed transactions leave the pool
+	tx3 := newTx(3, 10)
+	checkTx(tx3)
+	commit(tx0, tx1)
+	checkStats(0, 1)
+
+	// Queued transactions are promoted after the commit that fills the gap
+	ch := make(chan PromotedTxsEvent, 1)
+	sub := test.state.SubscribePromotedTxs(ch)
+	defer sub.Unsubscribe()
+
+	commit(newTx(2, 10))
+	checkStats(1, 0)
+
+	ev := <-ch
+	if len(ev.Txs) != 1 || ev.Txs[0].Hash() != tx3.Hash() {
+		t.Fatalf("Commit should promote %s, not %v", tx3.Hash().Hex(), ev.Txs)
+	}
+
+	// The promoted transactions that were not taken yet come first, as the
+	// transactions that follow them could not be submitted before
+	tx4 := newTx(4, 10)
+	checkTx(tx4, tx3, tx4)
+	if promoted := test.state.TakePromotedTxs(); len(promoted) != 0 {
+		t.Fatalf("Promoted transactions should be taken once, got %d again", len(promoted))
+	}
+
+	// Pending transactions are applied again after a commit, so that the
+	// nonces handed out account for them
+	commit(tx3)
+	checkStats(1, 0)
+	if nonce := test.state.GetPoolNonce(from.Address); nonce != 5 {
+		t.Fatalf("Pool nonce should be 5, not %d", nonce)
+	}
+
+	// Pending transactions that a commit invalidates are dropped, along with
+	// the ones that follow them
+	droppedCh := make(chan DroppedTxEvent, 4)
+	droppedSub := test.state.SubscribeDroppedTxs(droppedCh)
+	defer droppedSub.Unsubscribe()
+
+	tx5, tx6 := newTx(5, 10), newTx(6, 10)
+	checkTx(tx5, tx5)
+	checkTx(tx6, tx6)
+	checkStats(3, 0)
+
+	// Another transaction with nonce 4 spends the whole balance
+	balance := test.state.GetBalance(from.Address)
+	value := new(big.Int).Sub(balance, big.NewInt(21000*10))
+	commit(newValueTx(4, 10, value))
+	checkStats(0, 0)
+
+	for _, tx := range []*ethTypes.Transaction{tx5, tx6} {
+		ev := <-droppedCh
+		if ev.Tx.Hash() != tx.Hash() {
+			t.Fatalf("Commit should drop %s, not %s", tx.Hash().Hex(), ev.Tx.Hash().Hex())
+		}
+	}
+	if nonce := test.state.GetPoolNonce(from.Address); nonce != 5 {
+		t.Fatalf("Pool nonce should be 5, not %d", nonce)
+	}
+
+	// Expired transactions are dropped on the next commit
+	test.state.SetTxPoolLimits(defaultTxPoolSize, 0)
+	checkTx(newTx(7, 10))
+	commit()
+	checkStats(0, 0)
+
+	if ev := <-droppedCh; ev.Reason != ErrTxExpired {
+		t.Fatalf("Expired transaction should be dropped with ErrTxExpired, not %v", ev.Reason)
+	}
+}
+
+func TestRejectedTx(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+	to := test.keyStore.Accounts()[1]
+
+	balance := test.state.GetBalance(from.Address)
+	nonce := test.state.GetNonce(from.Address)
+
+	// The sender cannot afford the transfer
+	tx, err := test.prepareTransaction(&from,
+		&to,
+		new(big.Int).Add(balance, big.NewInt(1)),
+		uint64(21000),
+		big.NewInt(0),
+		[]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := rlp.EncodeToBytes(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := test.state.ApplyTransaction(data, 0); err == nil {
+		t.Fatal("Applying the transaction should fail")
+	}
+	if _, err := test.state.Commit(BlockInfo{}); err != nil {
+		t.Fatal(err)
+	}
+
+	head := test.state.GetHeadBlock()
+	if len(head.TxHashes) != 0 {
+		t.Fatalf("Block should have no transactions, not %d", len(head.TxHashes))
+	}
+	if _, err := test.state.GetTransaction(tx.Hash()); err == nil {
+		t.Fatal("Rejected transaction should not be stored with the committed ones")
+	}
+
+	rejected, err := test.state.GetRejectedTx(tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rejected.Tx.Hash() != tx.Hash() {
+		t.Fatalf("Rejected transaction should be %s, not %s", tx.Hash().Hex(), rejected.Tx.Hash().Hex())
+	}
+	if rejected.BlockNumber != head.Number || rejected.BlockHash != head.Hash() {
+		t.Fatalf("Rejected transaction should be recorded in block %d, not %d", head.Number, rejected.BlockNumber)
+	}
+	if rejected.Reason != vm.ErrInsufficientBalance.Error() {
+		t.Fatalf("Reason should be %q, not %q", vm.ErrInsufficientBalance, rejected.Reason)
+	}
+
+	// The state is left untouched
+	if b := test.state.GetBalance(from.Address); b.Cmp(balance) != 0 {
+		t.Fatalf("Balance should still be %v, not %v", balance, b)
+	}
+	if n := test.state.GetNonce(from.Address); n != nonce {
+		t.Fatalf("Nonce should still be %d, not %d", nonce, n)
+	}
+}
+
+func TestTraceTransaction(t *testing.T) {
+	os.RemoveAll("test_data/eth/chaindata")
+	defer os.RemoveAll("test_data/eth/chaindata")
+
+	test := NewTest("test_data/eth", bcommon.NewTestLogger(t), t)
+	defer test.state.db.Close()
+
+	if err := test.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := test.keyStore.Accounts()[0]
+
+	contract := dummyContract()
+	test.deployContract(from, contract, t)
+	contract.parseABI(t)
+
+	callDummyContractTestAsync(test, from, contract, t)
+
+	txHash := test.state.GetHeadBlock().TxHashes[0]
+	receipt, err := test.state.GetReceipt(txHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := test.state.TraceTransaction(txHash, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Failed {
+		t.Fatal("Traced transaction should not fail")
+	}
+	if res.Gas != receipt.GasUsed {
+		t.Fatalf("Traced gas should be %d, not %d", receipt.GasUsed, res.Gas)
+	}
+	if len(res.StructLogs) == 0 {
+		t.Fatal("Struct logger should record the executed opcodes")
+	}
+
+	res, err = test.state.TraceTransaction(txHash, &TraceConfig{Tracer: "callTracer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var call struct {
+		Type string
+		To   common.Address
+	}
+	if err := json.Unmarshal(res.Result, &call); err != nil {
+		t.Fatal(err)
+	}
+	if call.Type != "CALL" || call.To != contract.address {
+		t.Fatalf("callTracer should return a CALL to %s, not %s", contract.address.Hex(), string(res.Result))
+	}
 }
 
 /*
@@ -0,0 +1,169 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	ethState "github.com/ethereum/go-ethereum/core/state"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+// defaultTraceTimeout is how long a JavaScript tracer can run
+const defaultTraceTimeout = 5 * time.Second
+
+// TraceConfig selects how an execution is traced. Without a Tracer, every
+// opcode is recorded by a struct logger, configured by the LogConfig.
+type TraceConfig struct {
+	*vm.LogConfig
+
+	// Tracer is the name of a built-in JavaScript tracer, like callTracer or
+	// prestateTracer, or the code of a custom one
+	Tracer string
+
+	// Timeout bounds the execution of a JavaScript tracer, as a duration
+	// string like "10s"
+	Timeout string
+}
+
+// TraceResult is the outcome of a traced execution. StructLogs is set when
+// the struct logger is used, Result otherwise.
+type TraceResult struct {
+	Gas         uint64
+	Failed      bool
+	ReturnValue []byte
+	StructLogs  []vm.StructLog
+	Result      []byte
+}
+
+// TraceTransaction executes a committed transaction again, on top of the
+// state of the previous block and of the transactions that preceded it in its
+// block. The state of the previous block must still be available, which is
+// only guaranteed in archive mode.
+func (s *State) TraceTransaction(txHash common.Hash, config *TraceConfig) (*TraceResult, error) {
+	entry, err := s.GetTxLookupEntry(txHash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := s.GetBlockByHash(entry.BlockHash)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := s.GetBlockByHash(block.ParentHash)
+	if err != nil {
+		return nil, err
+	}
+
+	statedb, err := s.openState(parent.StateRoot)
+	if err != nil {
+		return nil, fmt.Errorf("state of block %d is not available: %v", parent.Number, err)
+	}
+
+	for i, hash := range block.TxHashes {
+		tx, err := s.GetTransaction(hash)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := tx.AsMessage(s.signer)
+		if err != nil {
+			return nil, err
+		}
+
+		context := NewContext(msg.From(), msg.Gas(), msg.GasPrice(), block.Number, block.Timestamp, getHashFn(s.db))
+		context.Coinbase = block.Coinbase
+		statedb.Prepare(hash, block.Hash(), i)
+
+		if uint64(i) == entry.Index {
+			return s.trace(context, statedb, msg, config)
+		}
+
+		vmenv := vm.NewEVM(context, statedb, &s.chainConfig, vm.Config{})
+		if _, _, _, err := s.fees.applyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas())); err != nil {
+			return nil, fmt.Errorf("applying transaction %v: %v", hash.Hex(), err)
+		}
+		statedb.Finalise(true)
+	}
+
+	return nil, fmt.Errorf("transaction %v not found in block %d", txHash.Hex(), block.Number)
+}
+
+// TraceCall traces a readonly transaction on the latest state, like Call
+func (s *State) TraceCall(callMsg ethTypes.Message, config *TraceConfig) (*TraceResult, error) {
+	statedb, head := s.headState()
+	context := NewContext(callMsg.From(), 0, big.NewInt(0), head.Number, head.Timestamp, getHashFn(s.db))
+	return s.trace(context, statedb, callMsg, config)
+}
+
+// TraceCall traces a readonly transaction on a copy of the historical state
+func (h *HistoricalState) TraceCall(callMsg ethTypes.Message, config *TraceConfig) (*TraceResult, error) {
+	context := NewContext(callMsg.From(), 0, big.NewInt(0), h.block.Number, h.block.Timestamp, getHashFn(h.state.db))
+	return h.state.trace(context, h.ethState.Copy(), callMsg, config)
+}
+
+// trace executes a message with the tracer selected by the config. Tracing is
+// only ever enabled here, the EVMs of the WAS, TxPool, and calls run without.
+func (s *State) trace(context vm.Context, statedb *ethState.StateDB, msg core.Message, config *TraceConfig) (*TraceResult, error) {
+	if config == nil {
+		config = &TraceConfig{}
+	}
+
+	var (
+		tracer       vm.Tracer
+		structLogger *vm.StructLogger
+		jsTracer     *tracers.Tracer
+	)
+
+	if config.Tracer != "" {
+		timeout := defaultTraceTimeout
+		if config.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(config.Timeout); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		if jsTracer, err = tracers.New(config.Tracer); err != nil {
+			return nil, err
+		}
+
+		// Stop the tracer if it runs for too long
+		deadline := time.AfterFunc(timeout, func() {
+			jsTracer.Stop(errors.New("execution timeout"))
+		})
+		defer deadline.Stop()
+
+		tracer = jsTracer
+	} else {
+		structLogger = vm.NewStructLogger(config.LogConfig)
+		tracer = structLogger
+	}
+
+	vmenv := vm.NewEVM(context, statedb, &s.chainConfig, vm.Config{Debug: true, Tracer: tracer})
+
+	ret, gas, failed, err := s.fees.applyMessage(vmenv, msg, new(core.GasPool).AddGas(gasLimit))
+	if err != nil {
+		return nil, fmt.Errorf("tracing failed: %v", err)
+	}
+
+	res := &TraceResult{
+		Gas:         gas,
+		Failed:      failed,
+		ReturnValue: ret,
+	}
+
+	if jsTracer != nil {
+		if res.Result, err = jsTracer.GetResult(); err != nil {
+			return nil, err
+		}
+	} else {
+		res.StructLogs = structLogger.StructLogs()
+	}
+
+	return res, nil
+}
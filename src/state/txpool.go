@@ -1,6 +1,13 @@
 package state
 
 import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	ethState "github.com/ethereum/go-ethereum/core/state"
@@ -10,6 +17,59 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// defaultTxPoolSize is the default number of transactions that the TxPool
+	// holds, pending and queued
+	defaultTxPoolSize = 4096
+
+	// defaultTxLifetime is the default time after which a transaction that is
+	// still in the TxPool is dropped
+	defaultTxLifetime = 3 * time.Hour
+
+	// maxQueuedPerAccount is the number of queued transactions that an
+	// account can have
+	maxQueuedPerAccount = 64
+
+	// priceBump is the percentage by which a replacement transaction must
+	// raise the gas price of the one it replaces
+	priceBump = 10
+)
+
+var (
+	// ErrAlreadyKnown is returned when a transaction is already in the TxPool
+	ErrAlreadyKnown = errors.New("already known")
+
+	// ErrTxPoolFull is returned when the TxPool is full, and the transaction
+	// does not pay more than any of the queued ones
+	ErrTxPoolFull = errors.New("transaction pool is full")
+
+	// ErrTooManyQueued is returned when the sender has too many queued
+	// transactions
+	ErrTooManyQueued = errors.New("too many queued transactions from sender")
+
+	// ErrTxExpired is the reason given for transactions dropped because they
+	// outlived their lifetime
+	ErrTxExpired = errors.New("transaction expired")
+)
+
+// poolTx is a transaction held by the TxPool. The seq of pending transactions
+// is the order in which they were applied to the statedb.
+type poolTx struct {
+	tx    *ethTypes.Transaction
+	from  common.Address
+	added time.Time
+	seq   uint64
+}
+
+// txList holds the transactions of an account, by nonce
+type txList map[uint64]*poolTx
+
+// TxPool holds the transactions submitted through this node until they are
+// committed. Pending transactions have the next nonces of their sender, so
+// they are executable; they are applied to the TxPool's statedb, on top of the
+// last committed state, and handed over to the consensus system. Queued
+// transactions have a nonce gap, they wait for the missing transactions to be
+// submitted before being promoted to pending.
 type TxPool struct {
 	ethState *ethState.StateDB
 
@@ -17,9 +77,28 @@ type TxPool struct {
 	chainConfig  params.ChainConfig // vm.env is still tightly coupled with chainConfig
 	vmConfig     vm.Config
 	gasLimit     uint64
+	minGasPrice  *big.Int
+	blockNumber  uint64
+	getHash      vm.GetHashFunc
 	totalUsedGas uint64
 	gp           *core.GasPool
 
+	all     map[common.Hash]*poolTx
+	pending map[common.Address]txList
+	queued  map[common.Address]txList
+	seq     uint64
+
+	size     int
+	lifetime time.Duration
+
+	// promoted holds the transactions promoted by Promote until they are taken
+	// to be submitted, in order, by Add or TakePromoted
+	promoted []*ethTypes.Transaction
+
+	// mu protects the statedb and the transaction lists, as transactions are
+	// added by the Service while the consensus system commits blocks
+	mu sync.Mutex
+
 	logger *logrus.Logger
 }
 
@@ -28,6 +107,7 @@ func NewTxPool(ethState *ethState.StateDB,
 	chainConfig params.ChainConfig,
 	vmConfig vm.Config,
 	gasLimit uint64,
+	getHash vm.GetHashFunc,
 	logger *logrus.Logger) *TxPool {
 
 	return &TxPool{
@@ -36,48 +116,444 @@ func NewTxPool(ethState *ethState.StateDB,
 		chainConfig: chainConfig,
 		vmConfig:    vmConfig,
 		gasLimit:    gasLimit,
+		getHash:     getHash,
+		minGasPrice: big.NewInt(0),
+		all:         make(map[common.Hash]*poolTx),
+		pending:     make(map[common.Address]txList),
+		queued:      make(map[common.Address]txList),
+		size:        defaultTxPoolSize,
+		lifetime:    defaultTxLifetime,
 		logger:      logger,
 	}
 }
 
-func (p *TxPool) Reset(root common.Hash) error {
+// Reset sets the TxPool's statedb to the given root, and prepares it to check
+// the transactions of the block with the given number. The pending
+// transactions that were committed are removed, and the others are applied
+// again on top of the new root, in their original order, so that the nonces
+// handed out by GetNonce account for them. The ones that cannot be applied
+// anymore are dropped, and returned along with the transactions that outlived
+// their lifetime.
+func (p *TxPool) Reset(root common.Hash, blockNumber uint64) ([]DroppedTxEvent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
 	err := p.ethState.Reset(root)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	p.blockNumber = blockNumber
 	p.totalUsedGas = 0
 	p.gp = new(core.GasPool).AddGas(p.gasLimit)
 
-	return nil
+	dropped := p.expire()
+
+	pending := []*poolTx{}
+	for _, list := range p.pending {
+		for _, ptx := range list {
+			pending = append(pending, ptx)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].seq < pending[j].seq
+	})
+
+	for _, ptx := range pending {
+		if ptx.tx.Nonce() < p.ethState.GetNonce(ptx.from) {
+			p.remove(p.pending, ptx)
+			continue
+		}
+
+		// Pending transactions may span several blocks, so they do not draw
+		// from the gas pool of the next one. The transactions that follow a
+		// dropped one have a nonce gap, so they are dropped too.
+		p.gp.AddGas(ptx.tx.Gas())
+		if err := p.execute(ptx); err != nil {
+			p.gp.SubGas(ptx.tx.Gas())
+			p.remove(p.pending, ptx)
+			dropped = append(dropped, DroppedTxEvent{Tx: ptx.tx, Reason: err})
+		}
+	}
+
+	return dropped, nil
+}
+
+// Add adds a transaction to the TxPool. If the transaction has the next nonce
+// of its sender, it is applied to the statedb and becomes pending, along with
+// the queued transactions that follow it. These are returned, in nonce order,
+// to be submitted to the consensus system, after the promoted transactions
+// that were not taken yet, which may precede them. Otherwise, it is queued.
+//
+// A queued transaction can be replaced by another with the same nonce and a
+// gas price higher by priceBump percent. Pending transactions cannot, as they
+// are already in the hands of the consensus system.
+func (p *TxPool) Add(tx *ethTypes.Transaction) (promoted, pending []*ethTypes.Transaction, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.all[tx.Hash()]; ok {
+		return nil, nil, ErrAlreadyKnown
+	}
+
+	from, err := p.validate(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ptx := &poolTx{tx: tx, from: from, added: time.Now()}
+
+	nonce := p.ethState.GetNonce(from)
+	switch {
+	case tx.Nonce() < nonce:
+		return nil, nil, core.ErrNonceTooLow
+	case tx.Nonce() > nonce:
+		return nil, nil, p.enqueue(ptx)
+	}
+
+	if err := p.makeRoom(tx); err != nil {
+		return nil, nil, err
+	}
+	if err := p.execute(ptx); err != nil {
+		p.logger.WithError(err).Error("Applying transaction to TxPool")
+		return nil, nil, err
+	}
+	p.insert(p.pending, ptx)
+
+	return p.takePromoted(), append([]*ethTypes.Transaction{tx}, p.promote(from)...), nil
+}
+
+// Promote moves the queued transactions that have become executable to
+// pending, and returns them in nonce order for each sender. It is called after
+// Reset. They are also kept until they are taken to be submitted.
+func (p *TxPool) Promote() []*ethTypes.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	promoted := []*ethTypes.Transaction{}
+	for from := range p.queued {
+		promoted = append(promoted, p.promote(from)...)
+	}
+	p.promoted = append(p.promoted, promoted...)
+	return promoted
+}
+
+// TakePromoted returns the transactions promoted by Promote that were not
+// taken yet, in order, and forgets them
+func (p *TxPool) TakePromoted() []*ethTypes.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.takePromoted()
+}
+
+func (p *TxPool) takePromoted() []*ethTypes.Transaction {
+	promoted := p.promoted
+	p.promoted = nil
+	return promoted
+}
+
+// Stats returns the number of pending and queued transactions
+func (p *TxPool) Stats() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := 0
+	for _, list := range p.pending {
+		pending += len(list)
+	}
+	return pending, len(p.all) - pending
+}
+
+// setStateDB replaces the TxPool's statedb, when the State is restored from a
+// snapshot. It must be followed by a Reset.
+func (p *TxPool) setStateDB(statedb *ethState.StateDB) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ethState = statedb
+}
+
+// SetMinGasPrice sets the lowest gas price accepted by Add
+func (p *TxPool) SetMinGasPrice(price *big.Int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.minGasPrice = new(big.Int).Set(price)
+}
+
+// GetMinGasPrice returns the lowest gas price accepted by Add
+func (p *TxPool) GetMinGasPrice() *big.Int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return new(big.Int).Set(p.minGasPrice)
+}
+
+// SetLimits sets the number of transactions that the TxPool holds, and the
+// time after which they are dropped
+func (p *TxPool) SetLimits(size int, lifetime time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.size = size
+	p.lifetime = lifetime
+}
+
+func (p *TxPool) GetNonce(addr common.Address) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.ethState.GetNonce(addr)
 }
 
-func (p *TxPool) CheckTx(tx *ethTypes.Transaction) error {
+// validate runs the checks that do not depend on the state, and returns the
+// sender of the transaction
+func (p *TxPool) validate(tx *ethTypes.Transaction) (common.Address, error) {
+	if tx.GasPrice().Cmp(p.minGasPrice) < 0 {
+		return common.Address{}, fmt.Errorf("%v: gas price %v is below the minimum %v", core.ErrUnderpriced, tx.GasPrice(), p.minGasPrice)
+	}
+	if tx.Value().Sign() < 0 {
+		return common.Address{}, core.ErrNegativeValue
+	}
+	if tx.Gas() > p.gasLimit {
+		return common.Address{}, core.ErrGasLimit
+	}
+
+	from, err := ethTypes.Sender(p.signer, tx)
+	if err != nil {
+		return common.Address{}, core.ErrInvalidSender
+	}
 
-	msg, err := tx.AsMessage(p.signer)
+	number := new(big.Int).SetUint64(p.blockNumber)
+	intrGas, err := core.IntrinsicGas(tx.Data(), tx.To() == nil, p.chainConfig.IsHomestead(number), p.chainConfig.IsIstanbul(number))
+	if err != nil {
+		return common.Address{}, err
+	}
+	if tx.Gas() < intrGas {
+		return common.Address{}, core.ErrIntrinsicGas
+	}
+
+	return from, nil
+}
+
+// execute applies a transaction to the statedb. The proposer of the block that
+// will include it is not known, so the fees are not paid to anyone. The
+// statedb is left untouched if the transaction cannot be applied.
+func (p *TxPool) execute(ptx *poolTx) error {
+	msg, err := ptx.tx.AsMessage(p.signer)
 	if err != nil {
-		p.logger.WithError(err).Error("Converting Transaction to Message")
 		return err
 	}
 
-	context := NewContext(msg.From(), msg.Gas(), msg.GasPrice())
+	// The timestamp of the block is only known once it is proposed
+	context := NewContext(msg.From(), msg.Gas(), msg.GasPrice(), p.blockNumber, uint64(time.Now().Unix()), p.getHash)
 
 	// The EVM should never be reused and is not thread safe.
 	vmenv := vm.NewEVM(context, p.ethState, &p.chainConfig, p.vmConfig)
 
-	// Apply the transaction to the current state (included in the env)
-	_, gas, _, err := core.ApplyMessage(vmenv, msg, p.gp)
+	snapshot := p.ethState.Snapshot()
+	_, gas, _, err := feePolicy{burnZero: true}.applyMessage(vmenv, msg, p.gp)
 	if err != nil {
-		p.logger.WithError(err).Error("Applying transaction to TxPool")
+		p.ethState.RevertToSnapshot(snapshot)
 		return err
 	}
 
 	p.totalUsedGas += gas
+	p.seq++
+	ptx.seq = p.seq
 
 	return nil
 }
 
-func (p *TxPool) GetNonce(addr common.Address) uint64 {
-	return p.ethState.GetNonce(addr)
+// enqueue adds a transaction to the queue of its sender, possibly replacing
+// one with the same nonce
+func (p *TxPool) enqueue(ptx *poolTx) error {
+	if old, ok := p.queued[ptx.from][ptx.tx.Nonce()]; ok {
+		threshold := new(big.Int).Mul(old.tx.GasPrice(), big.NewInt(100+priceBump))
+		threshold.Div(threshold, big.NewInt(100))
+		if ptx.tx.GasPrice().Cmp(threshold) < 0 {
+			return core.ErrReplaceUnderpriced
+		}
+		p.remove(p.queued, old)
+	} else {
+		if len(p.queued[ptx.from]) >= maxQueuedPerAccount {
+			return ErrTooManyQueued
+		}
+		if err := p.makeRoom(ptx.tx); err != nil {
+			return err
+		}
+	}
+
+	p.insert(p.queued, ptx)
+
+	return nil
+}
+
+// promote moves the queued transactions of an account that follow its last
+// pending one to pending. A transaction that cannot be applied is dropped, and
+// the ones after it stay queued.
+func (p *TxPool) promote(from common.Address) []*ethTypes.Transaction {
+	promoted := []*ethTypes.Transaction{}
+
+	for {
+		ptx, ok := p.queued[from][p.ethState.GetNonce(from)]
+		if !ok {
+			break
+		}
+		p.remove(p.queued, ptx)
+
+		if err := p.execute(ptx); err != nil {
+			p.logger.WithError(err).WithField("hash", ptx.tx.Hash().Hex()).Debug("Dropping queued transaction")
+			break
+		}
+
+		p.insert(p.pending, ptx)
+		promoted = append(promoted, ptx.tx)
+	}
+
+	return promoted
+}
+
+// makeRoom evicts the cheapest queued transaction if the TxPool is full. It
+// fails if the new transaction does not pay more.
+func (p *TxPool) makeRoom(tx *ethTypes.Transaction) error {
+	if len(p.all) < p.size {
+		return nil
+	}
+
+	var cheapest *poolTx
+	for _, list := range p.queued {
+		for _, ptx := range list {
+			if cheapest == nil || ptx.tx.GasPrice().Cmp(cheapest.tx.GasPrice()) < 0 {
+				cheapest = ptx
+			}
+		}
+	}
+	if cheapest == nil || cheapest.tx.GasPrice().Cmp(tx.GasPrice()) >= 0 {
+		return ErrTxPoolFull
+	}
+
+	p.logger.WithField("hash", cheapest.tx.Hash().Hex()).Debug("Evicting queued transaction")
+	p.remove(p.queued, cheapest)
+
+	return nil
+}
+
+// expire drops the transactions that outlived their lifetime
+func (p *TxPool) expire() []DroppedTxEvent {
+	dropped := []DroppedTxEvent{}
+	for _, ptx := range p.all {
+		if time.Since(ptx.added) < p.lifetime {
+			continue
+		}
+		p.remove(p.pending, ptx)
+		p.remove(p.queued, ptx)
+		dropped = append(dropped, DroppedTxEvent{Tx: ptx.tx, Reason: ErrTxExpired})
+	}
+	return dropped
+}
+
+func (p *TxPool) insert(lists map[common.Address]txList, ptx *poolTx) {
+	if lists[ptx.from] == nil {
+		lists[ptx.from] = make(txList)
+	}
+	lists[ptx.from][ptx.tx.Nonce()] = ptx
+	p.all[ptx.tx.Hash()] = ptx
+}
+
+func (p *TxPool) remove(lists map[common.Address]txList, ptx *poolTx) {
+	list := lists[ptx.from]
+	if list[ptx.tx.Nonce()] != ptx {
+		return
+	}
+	delete(list, ptx.tx.Nonce())
+	if len(list) == 0 {
+		delete(lists, ptx.from)
+	}
+	delete(p.all, ptx.tx.Hash())
+}
+
+// EstimateGas returns the lowest gas limit with which the message executes
+// without failing on top of the TxPool's statedb, so that it accounts for the
+// transactions that are not committed yet. The gas of the message is used as
+// upper bound if it is set. Each attempt runs on a copy of the statedb.
+func (p *TxPool) EstimateGas(msg ethTypes.Message) (uint64, error) {
+	p.mu.Lock()
+	statedb := p.ethState.Copy()
+	blockNumber := p.blockNumber
+	p.mu.Unlock()
+
+	return estimateGas(msg, statedb, p.gasLimit, func(attempt ethTypes.Message, statedb *ethState.StateDB) *vm.EVM {
+		context := NewContext(attempt.From(), attempt.Gas(), attempt.GasPrice(), blockNumber, uint64(time.Now().Unix()), p.getHash)
+		return vm.NewEVM(context, statedb, &p.chainConfig, p.vmConfig)
+	})
+}
+
+// estimateGas binary searches the lowest gas limit, up to gasLimit or the gas
+// of the message, with which the message executes without failing on statedb.
+// newEVM returns the EVM of an attempt; each one runs on a copy of statedb.
+func estimateGas(msg ethTypes.Message,
+	statedb *ethState.StateDB,
+	gasLimit uint64,
+	newEVM func(attempt ethTypes.Message, statedb *ethState.StateDB) *vm.EVM) (uint64, error) {
+
+	lo := params.TxGas - 1
+	hi := gasLimit
+	if msg.Gas() >= params.TxGas {
+		hi = msg.Gas()
+	}
+
+	// The sender must be able to pay for all the gas
+	if msg.GasPrice().Sign() > 0 {
+		available := new(big.Int).Sub(statedb.GetBalance(msg.From()), msg.Value())
+		if available.Sign() < 0 {
+			return 0, core.ErrInsufficientFunds
+		}
+		allowance := new(big.Int).Div(available, msg.GasPrice())
+		if allowance.IsUint64() && allowance.Uint64() < hi {
+			hi = allowance.Uint64()
+		}
+	}
+	limit := hi
+
+	executable := func(gas uint64) (bool, error) {
+		attempt := ethTypes.NewMessage(msg.From(),
+			msg.To(),
+			msg.Nonce(),
+			msg.Value(),
+			gas,
+			msg.GasPrice(),
+			msg.Data(),
+			false)
+
+		vmenv := newEVM(attempt, statedb.Copy())
+
+		_, _, failed, err := core.ApplyMessage(vmenv, attempt, new(core.GasPool).AddGas(gas))
+		if err != nil {
+			return false, err
+		}
+		return !failed, nil
+	}
+
+	// Binary search for the lowest gas that does not fail
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		if ok, _ := executable(mid); ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+
+	if hi == limit {
+		ok, err := executable(hi)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("gas required exceeds allowance (%d) or always failing transaction", limit)
+		}
+	}
+
+	return hi, nil
 }
@@ -1,7 +1,8 @@
 package state
 
-// DatabaseReader wraps the Get method of a backing data store.
+// DatabaseReader wraps the Has and Get method of a backing data store.
 type DatabaseReader interface {
+	Has(key []byte) (bool, error)
 	Get(key []byte) (value []byte, err error)
 }
 
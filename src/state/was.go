@@ -18,18 +18,35 @@ import (
 // also handles persisting transactions, logs, and receipts to the DB.
 // NOT THREAD SAFE
 type WriteAheadState struct {
-	db       ethdb.Database
+	db       *commitDB
 	ethState *ethState.StateDB
 
 	signer      ethTypes.Signer
 	chainConfig params.ChainConfig // vm.env is still tightly coupled with chainConfig
 	vmConfig    vm.Config
 	gasLimit    uint64
+	fees        feePolicy
+
+	head *Block
+
+	// proposer is the node that proposed the block being built, if known. Its
+	// coinbase is paid the fees, depending on the fee policy.
+	proposer common.Address
+
+	// In archive mode, the state trie of every block is written to disk, and
+	// so it is if the blocks are not replayable, cf. State.SetReplayable.
+	// Otherwise, the tries of the last retention blocks are kept in memory,
+	// oldest first, in recentRoots.
+	archive     bool
+	replayable  bool
+	retention   uint64
+	recentRoots []trieRoot
 
 	txIndex      int
 	transactions []*ethTypes.Transaction
 	receipts     []*ethTypes.Receipt
 	allLogs      []*ethTypes.Log
+	rejected     []*RejectedTx
 
 	totalUsedGas uint64
 	gp           *core.GasPool
@@ -37,15 +54,30 @@ type WriteAheadState struct {
 	logger *logrus.Logger
 }
 
-func NewWriteAheadState(db ethdb.Database,
+// trieRoot is the root of the state trie of a block
+type trieRoot struct {
+	number uint64
+	root   common.Hash
+}
+
+func NewWriteAheadState(db *commitDB,
+	stateCache ethState.Database,
 	root common.Hash,
 	signer ethTypes.Signer,
 	chainConfig params.ChainConfig,
 	vmConfig vm.Config,
 	gasLimit uint64,
+	fees feePolicy,
+	archive bool,
+	retention uint64,
 	logger *logrus.Logger) (*WriteAheadState, error) {
 
-	ethState, err := ethState.New(root, ethState.NewDatabase(db))
+	ethState, err := ethState.New(root, stateCache)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := readHeadBlock(db)
 	if err != nil {
 		return nil, err
 	}
@@ -53,10 +85,14 @@ func NewWriteAheadState(db ethdb.Database,
 	return &WriteAheadState{
 		db:          db,
 		ethState:    ethState,
+		head:        head,
 		signer:      signer,
 		chainConfig: chainConfig,
 		vmConfig:    vmConfig,
 		gasLimit:    gasLimit,
+		fees:        fees,
+		archive:     archive,
+		retention:   retention,
 		gp:          new(core.GasPool).AddGas(gasLimit),
 		logger:      logger,
 	}, nil
@@ -69,10 +105,12 @@ func (was *WriteAheadState) Reset(root common.Hash) error {
 		return err
 	}
 
+	was.proposer = common.Address{}
 	was.txIndex = 0
 	was.transactions = []*ethTypes.Transaction{}
 	was.receipts = []*ethTypes.Receipt{}
 	was.allLogs = []*ethTypes.Log{}
+	was.rejected = []*RejectedTx{}
 
 	was.totalUsedGas = 0
 	was.gp = new(core.GasPool).AddGas(was.gasLimit)
@@ -80,35 +118,53 @@ func (was *WriteAheadState) Reset(root common.Hash) error {
 	return nil
 }
 
-func (was *WriteAheadState) ApplyTransaction(tx ethTypes.Transaction, txIndex int, blockHash common.Hash) error {
+// ApplyTransaction applies a transaction to the WAS. The transaction is added
+// to the block that will be produced by the next call to Commit. If it cannot
+// be applied, the state is left untouched, and it is recorded as rejected by
+// that call to Commit instead. The timestamp is that of the block, as agreed
+// by the consensus system, which must be the same for all its transactions.
+func (was *WriteAheadState) ApplyTransaction(tx ethTypes.Transaction, timestamp uint64) error {
 
 	msg, err := tx.AsMessage(was.signer)
 	if err != nil {
 		was.logger.WithError(err).Error("Converting Transaction to Message")
+		was.reject(&tx, err)
 		return err
 	}
 
-	context := NewContext(msg.From(), msg.Gas(), msg.GasPrice())
+	number := was.nextBlockNumber()
+	context := NewContext(msg.From(), msg.Gas(), msg.GasPrice(), number, was.blockTime(timestamp), getHashFn(was.db))
+	context.Coinbase = was.coinbase()
 
 	//Prepare the ethState with transaction Hash so that it can be used in emitted
-	//logs
-	was.ethState.Prepare(tx.Hash(), blockHash, txIndex)
+	//logs. The block hash is only known upon Commit.
+	was.ethState.Prepare(tx.Hash(), common.Hash{}, was.txIndex)
 
 	vmenv := vm.NewEVM(context, was.ethState, &was.chainConfig, was.vmConfig)
 
-	// Apply the transaction to the current state (included in the env)
-	_, gas, failed, err := core.ApplyMessage(vmenv, msg, was.gp)
+	// Apply the transaction to the current state (included in the env). Some
+	// checks fail after the gas was bought, so the state is reverted.
+	snapshot := was.ethState.Snapshot()
+	_, gas, failed, err := was.fees.applyMessage(vmenv, msg, was.gp)
 	if err != nil {
+		was.ethState.RevertToSnapshot(snapshot)
 		was.logger.WithError(err).Error("Applying transaction to WAS")
+		was.reject(&tx, err)
 		return err
 	}
 
 	was.totalUsedGas += gas
 
-	// Create a new receipt for the transaction, storing the intermediate root and gas used by the tx
-	// based on the eip phase, we're passing wether the root touch-delete accounts.
-	root := was.ethState.IntermediateRoot(true) //this has side effects. It updates StateObjects (SmartContract memory)
-	receipt := ethTypes.NewReceipt(root.Bytes(), failed, was.totalUsedGas)
+	// Create a new receipt for the transaction. Since Byzantium, receipts carry
+	// a status code instead of the intermediate root. Empty accounts are
+	// always deleted, as they have been on every Shuffle chain.
+	var root []byte
+	if was.chainConfig.IsByzantium(context.BlockNumber) {
+		was.ethState.Finalise(true)
+	} else {
+		root = was.ethState.IntermediateRoot(true).Bytes() //this has side effects. It updates StateObjects (SmartContract memory)
+	}
+	receipt := ethTypes.NewReceipt(root, failed, was.totalUsedGas)
 	receipt.TxHash = tx.Hash()
 	receipt.GasUsed = gas
 	// if the transaction created a contract, store the creation address in the receipt.
@@ -130,59 +186,243 @@ func (was *WriteAheadState) ApplyTransaction(tx ethTypes.Transaction, txIndex in
 	return nil
 }
 
-func (was *WriteAheadState) Commit() (common.Hash, error) {
+// Commit persists all the state changes, transactions, and receipts to the
+// DB, as part of a new block which becomes the head of the chain. They are
+// written in a single batch, along with the block and the head pointer, so a
+// crash cannot leave a block half written; the block records the consensus
+// index that it was committed at, which the consensus system resumes from.
+func (was *WriteAheadState) Commit(info BlockInfo) (*Block, error) {
 	// Commit all state changes to the database
 	root, err := was.ethState.Commit(true)
 	if err != nil {
 		was.logger.WithError(err).Error("Committing state")
-		return common.Hash{}, err
+		return nil, err
 	}
 
-	//XXX FORCE DISK WRITE
-	//Apparenty shl does something smarter here... but cant figure it out
-	was.ethState.Database().TrieDB().Commit(root, true)
+	block := was.newBlock(root, info)
+	blockHash := block.Hash()
 
-	if err := was.writeTransactions(); err != nil {
+	// The block hash is only known now, so update the logs before they are
+	// persisted with the receipts
+	for _, receipt := range was.receipts {
+		for _, log := range receipt.Logs {
+			log.BlockHash = blockHash
+			log.BlockNumber = block.Number
+		}
+	}
+
+	// The records of the block are collected before the trie is committed,
+	// which moves trie nodes from the trie.Database to the commitDB. If the
+	// commit fails, the records are dropped, but those trie nodes stay
+	// pending, and are written along with the next block.
+	records := was.db.newBatch()
+
+	if err := was.writeTransactions(records, block); err != nil {
 		was.logger.WithError(err).Error("Writing txs")
-		return common.Hash{}, err
+		return nil, err
 	}
-	if err := was.writeReceipts(); err != nil {
+	if err := was.writeReceipts(records); err != nil {
 		was.logger.WithError(err).Error("Writing receipts")
-		return common.Hash{}, err
+		return nil, err
+	}
+	if err := was.writeRejectedTxs(records, block); err != nil {
+		was.logger.WithError(err).Error("Writing rejected txs")
+		return nil, err
+	}
+	if err := writeBlock(records, block); err != nil {
+		was.logger.WithError(err).Error("Writing block")
+		return nil, err
+	}
+	if err := writeMipmapBloom(was.db, records, block.Number, block.LogsBloom); err != nil {
+		was.logger.WithError(err).Error("Writing log index")
+		return nil, err
+	}
+
+	if err := was.commitTrie(block.Number, root); err != nil {
+		was.logger.WithError(err).Error("Committing state trie")
+		return nil, err
+	}
+
+	if err := records.Write(); err != nil {
+		was.db.Drop(records)
+		was.logger.WithError(err).Error("Writing block records")
+		return nil, err
+	}
+	if err := was.db.Write(); err != nil {
+		was.db.Drop(records)
+		was.logger.WithError(err).Error("Writing batch")
+		return nil, err
+	}
+
+	was.head = block
+
+	return block, nil
+}
+
+// commitTrie makes the state trie of a new block durable. In archive mode, it
+// is written to disk. Otherwise, it stays in memory while it is one of the last
+// retention tries; the trie.Database counts the references to each node, so
+// the nodes of older tries are garbage collected as soon as no recent trie
+// shares them. One trie in retention is written to disk as a checkpoint on
+// its way out, so that the State can be recovered after a crash, by replaying
+// the following blocks, and so is the trie of the genesis block, so that there
+// is always one to recover from. If the blocks cannot be replayed, every trie
+// is written to disk.
+func (was *WriteAheadState) commitTrie(number uint64, root common.Hash) error {
+	triedb := was.ethState.Database().TrieDB()
+
+	if was.archive || !was.replayable || number == 0 {
+		return triedb.Commit(root, false)
+	}
+
+	triedb.Reference(root, common.Hash{})
+	was.recentRoots = append(was.recentRoots, trieRoot{number: number, root: root})
+
+	// Flush the oldest nodes if the recent tries take up too much memory
+	if nodes, _ := triedb.Size(); nodes > trieDirtyLimit {
+		if err := triedb.Cap(trieDirtyLimit - ethdb.IdealBatchSize); err != nil {
+			return err
+		}
+	}
+
+	for uint64(len(was.recentRoots)) > was.retention {
+		oldest := was.recentRoots[0]
+		was.recentRoots = was.recentRoots[1:]
+
+		if oldest.number%was.retention == 0 {
+			if err := triedb.Commit(oldest.root, false); err != nil {
+				return err
+			}
+		}
+		triedb.Dereference(oldest.root)
+	}
+
+	return nil
+}
+
+// flush writes the state trie of the head block to disk
+func (was *WriteAheadState) flush() error {
+	if was.head == nil {
+		return nil
+	}
+	if err := was.ethState.Database().TrieDB().Commit(was.head.StateRoot, false); err != nil {
+		return err
+	}
+	return was.db.Write()
+}
+
+// newBlock creates the block resulting from the transactions applied since the
+// last Reset, on top of the current head.
+func (was *WriteAheadState) newBlock(root common.Hash, info BlockInfo) *Block {
+	info.Timestamp = was.blockTime(info.Timestamp)
+
+	block := &Block{
+		StateRoot:    root,
+		ReceiptsRoot: ethTypes.DeriveSha(ethTypes.Receipts(was.receipts)),
+		LogsBloom:    ethTypes.CreateBloom(ethTypes.Receipts(was.receipts)),
+		GasUsed:      was.totalUsedGas,
+		Coinbase:     was.coinbase(),
+		TxHashes:     make([]common.Hash, len(was.transactions)),
+		BlockInfo:    info,
+	}
+
+	block.Number = was.nextBlockNumber()
+	if was.head != nil {
+		block.ParentHash = was.head.Hash()
+	}
+
+	for i, tx := range was.transactions {
+		block.TxHashes[i] = tx.Hash()
+	}
+
+	return block
+}
+
+// coinbase returns the address that is paid the fees of the block being built
+func (was *WriteAheadState) coinbase() common.Address {
+	return was.fees.coinbase(was.proposer)
+}
+
+// blockTime returns the timestamp of the block being built. Timestamps never go
+// back, even if the clock of the node that set them was behind, so the
+// timestamp of the head block is a lower bound.
+func (was *WriteAheadState) blockTime(timestamp uint64) uint64 {
+	if was.head != nil && timestamp < was.head.Timestamp {
+		return was.head.Timestamp
 	}
-	return root, nil
+	return timestamp
 }
 
-func (was *WriteAheadState) writeTransactions() error {
-	batch := was.db.NewBatch()
+// nextBlockNumber returns the number of the block that the transactions
+// applied since the last Reset will be committed in
+func (was *WriteAheadState) nextBlockNumber() uint64 {
+	if was.head == nil {
+		return 0
+	}
+	return was.head.Number + 1
+}
+
+func (was *WriteAheadState) writeTransactions(db DatabasePutter, block *Block) error {
+	blockHash := block.Hash()
 
-	for _, tx := range was.transactions {
+	for i, tx := range was.transactions {
 		data, err := rlp.EncodeToBytes(tx)
 		if err != nil {
 			return err
 		}
-		if err := batch.Put(tx.Hash().Bytes(), data); err != nil {
+		if err := db.Put(tx.Hash().Bytes(), data); err != nil {
+			return err
+		}
+		entry := TxLookupEntry{
+			BlockHash:   blockHash,
+			BlockNumber: block.Number,
+			Index:       uint64(i),
+		}
+		if err := writeTxLookupEntry(db, tx.Hash(), entry); err != nil {
 			return err
 		}
 	}
 
-	// Write the scheduled data into the database
-	return batch.Write()
+	return nil
 }
 
-func (was *WriteAheadState) writeReceipts() error {
-	batch := was.db.NewBatch()
-
+func (was *WriteAheadState) writeReceipts(db DatabasePutter) error {
 	for _, receipt := range was.receipts {
-		storageReceipt := (*ethTypes.ReceiptForStorage)(receipt)
-		data, err := rlp.EncodeToBytes(storageReceipt)
-		if err != nil {
+		if err := writeReceipt(db, receipt); err != nil {
 			return err
 		}
-		if err := batch.Put(append(receiptsPrefix, receipt.TxHash.Bytes()...), data); err != nil {
+	}
+
+	return nil
+}
+
+func (was *WriteAheadState) writeRejectedTxs(db DatabasePutter, block *Block) error {
+	blockHash := block.Hash()
+
+	for _, rejected := range was.rejected {
+		rejected.BlockHash = blockHash
+		rejected.BlockNumber = block.Number
+		if err := writeRejectedTx(db, rejected); err != nil {
 			return err
 		}
 	}
 
-	return batch.Write()
+	return nil
+}
+
+// reject records a transaction that could not be applied, with the reason
+func (was *WriteAheadState) reject(tx *ethTypes.Transaction, err error) {
+	was.rejected = append(was.rejected, &RejectedTx{
+		Tx:     tx,
+		Reason: err.Error(),
+	})
+}
+
+// logs returns the logs of the transactions applied since the last Reset
+func (was *WriteAheadState) logs() []*ethTypes.Log {
+	logs := []*ethTypes.Log{}
+	for _, receipt := range was.receipts {
+		logs = append(logs, receipt.Logs...)
+	}
+	return logs
 }